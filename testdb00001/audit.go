@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Audit actions recorded for a QRRequest. AuditView is only found in trails
+// written before views moved to QRView.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditCancel = "cancel"
+	AuditView   = "view"
+	AuditPaid   = "paid"
+	AuditExpire = "expire"
+	// Legal holds and the retention worker
+	AuditHold    = "hold"
+	AuditRelease = "release"
+	AuditPurge   = "purge"
+	AuditArchive = "archive"
+)
+
+// AuditEvent is one entry of the append-only audit trail. Events of a merchant
+// form a hash chain: every Hash covers the event fields and the PrevHash of the
+// merchant's previous event, so editing or deleting a row breaks the chain.
+type AuditEvent struct {
+	ID          uint64 `gorm:"primaryKey;autoIncrement"`
+	MerchantID  string `gorm:"index"`
+	QRRequestID string `gorm:"index"`
+	Actor       string
+	IP          string
+	RequestID   string
+	Action      string
+	Diff        string // JSON kept as text so the hashed bytes survive a round trip
+	CreatedAt   int64
+	PrevHash    string
+	Hash        string `gorm:"index"`
+
+	// QRCreatedAt is the CreatedAt of the request, so the rollup worker can
+	// find its hour once the row is purged or archived. It is not hashed.
+	QRCreatedAt int64
+}
+
+// QRView records that a QRRequest was read. Views change nothing, so they are
+// kept out of the hash chain: chaining them would serialise every read of a
+// merchant behind the chain lock.
+type QRView struct {
+	ID          uint64 `gorm:"primaryKey;autoIncrement"`
+	MerchantID  string `gorm:"index"`
+	QRRequestID string `gorm:"index"`
+	Actor       string
+	IP          string
+	RequestID   string
+	Path        string
+	CreatedAt   int64
+}
+
+// recordView records that the caller of c read qr
+func recordView(db *gorm.DB, c *fiber.Ctx, qr *QRRequest) error {
+	requestID, _ := c.Locals(localRequestID).(string)
+	return db.Create(&QRView{
+		MerchantID:  qr.MerchantID,
+		QRRequestID: qr.ID,
+		Actor:       currentActor(c),
+		IP:          c.IP(),
+		RequestID:   requestID,
+		Path:        c.Path(),
+		CreatedAt:   time.Now().UnixNano(),
+	}).Error
+}
+
+// FieldChange is the before and after value of one changed field
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// setupAuditTrail makes audit_events append-only at the database level
+func setupAuditTrail(db *gorm.DB) error {
+	return db.Exec(`
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+`).Error
+}
+
+// diffQRRequest lists the fields that differ between before and after. A nil
+// before means the request was created. Fields the API never shows, unexported
+// or tagged json:"-", are left out.
+func diffQRRequest(before, after *QRRequest) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	var b reflect.Value
+	if before != nil {
+		b = reflect.ValueOf(*before)
+	}
+	a := reflect.ValueOf(*after)
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); !f.IsExported() || f.Tag.Get("json") == "-" {
+			continue
+		}
+		av := a.Field(i).Interface()
+		var bv interface{}
+		if b.IsValid() {
+			bv = b.Field(i).Interface()
+			if reflect.DeepEqual(bv, av) {
+				continue
+			}
+		}
+		// Sensitive values never reach the audit trail in clear
+		if s, ok := av.(EncryptedString); ok {
+			av = maskPII(string(s))
+			if bv != nil {
+				bv = maskPII(string(bv.(EncryptedString)))
+			}
+		}
+		changes[t.Field(i).Name] = FieldChange{Before: bv, After: av}
+	}
+	return changes
+}
+
+// hash computes the chain hash of the event from its fields and PrevHash
+func (e *AuditEvent) hash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%d|%s",
+		e.MerchantID, e.QRRequestID, e.Actor, e.IP, e.RequestID, e.Action, e.Diff, e.CreatedAt, e.PrevHash)))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditActor identifies who caused an audit event
+type AuditActor struct {
+	Actor     string
+	IP        string
+	RequestID string
+}
+
+// systemActor is the actor of changes made by background workers
+func systemActor(worker string) AuditActor {
+	return AuditActor{Actor: "system:" + worker}
+}
+
+// recordAudit appends an event for qr inside tx on behalf of the caller of
+// c. It must be called in the same transaction as the mutation it describes.
+func recordAudit(tx *gorm.DB, c *fiber.Ctx, action string, before, after *QRRequest) error {
+	requestID, _ := c.Locals(localRequestID).(string)
+	actor := AuditActor{Actor: currentActor(c), IP: c.IP(), RequestID: requestID}
+	return appendAuditEvent(tx, actor, action, before, after)
+}
+
+// appendAuditEvent appends an event for qr inside tx
+func appendAuditEvent(tx *gorm.DB, actor AuditActor, action string, before, after *QRRequest) error {
+	diff := "{}"
+	if before != nil || action == AuditCreate {
+		b, err := json.Marshal(diffQRRequest(before, after))
+		if err != nil {
+			return err
+		}
+		diff = string(b)
+	}
+
+	event := &AuditEvent{
+		MerchantID:  after.MerchantID,
+		QRRequestID: after.ID,
+		Actor:       actor.Actor,
+		IP:          actor.IP,
+		RequestID:   actor.RequestID,
+		Action:      action,
+		Diff:        diff,
+		CreatedAt:   time.Now().UnixNano(),
+		QRCreatedAt: after.CreatedAt,
+	}
+
+	// Serialise writers of the same merchant chain until the transaction ends
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "audit:"+event.MerchantID).Error; err != nil {
+		return err
+	}
+
+	var prev AuditEvent
+	err := tx.Where("merchant_id = ?", event.MerchantID).Order("id DESC").Limit(1).Find(&prev).Error
+	if err != nil {
+		return err
+	}
+	event.PrevHash = prev.Hash
+	event.Hash = event.hash()
+
+	return tx.Create(event).Error
+}
+
+// verifyAuditChain checks that every event still matches its hash and links
+// to an existing earlier event of the same merchant
+func verifyAuditChain(db *gorm.DB, events []AuditEvent) (bool, error) {
+	for _, e := range events {
+		if e.hash() != e.Hash {
+			return false, nil
+		}
+		if e.PrevHash == "" {
+			continue
+		}
+		var count int64
+		err := db.Model(&AuditEvent{}).
+			Where("merchant_id = ? AND hash = ? AND id < ?", e.MerchantID, e.PrevHash, e.ID).
+			Count(&count).Error
+		if err != nil {
+			return false, err
+		}
+		if count == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getQRAuditHandler returns the audit trail of a QRRequest
+func getQRAuditHandler(db *gorm.DB) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db := requestDB(c, db)
+		qr, err := getCallerQRRequest(db, c, c.Params("id"))
+		if err != nil {
+			return qrRequestError(err)
+		}
+
+		var events []AuditEvent
+		if err := db.Where("qr_request_id = ? AND merchant_id = ?", qr.ID, qr.MerchantID).Order("id").Find(&events).Error; err != nil {
+			return internalError(err)
+		}
+
+		valid, err := verifyAuditChain(db, events)
+		if err != nil {
+			return internalError(err)
+		}
+
+		var views []QRView
+		if err := db.Where("qr_request_id = ? AND merchant_id = ?", qr.ID, qr.MerchantID).Order("id").Find(&views).Error; err != nil {
+			return internalError(err)
+		}
+
+		return c.JSON(fiber.Map{"events": events, "chainValid": valid, "views": views})
+	}
+}
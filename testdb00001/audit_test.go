@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestDiffQRRequestSkipsHiddenFields(t *testing.T) {
+	before := &QRRequest{ID: "qr1", Remark: "old", IdempotencyKey: "key1", RecipientIDIndex: "index1"}
+	after := &QRRequest{ID: "qr1", Remark: "new", IdempotencyKey: "key2", RecipientIDIndex: "index2"}
+
+	changes := diffQRRequest(before, after)
+	if len(changes) != 1 {
+		t.Fatalf("want only Remark, got %+v", changes)
+	}
+	if got := changes["Remark"]; got.Before != "old" || got.After != "new" {
+		t.Fatalf("Remark change %+v", got)
+	}
+
+	created := diffQRRequest(nil, after)
+	for _, name := range []string{"IdempotencyKey", "RecipientIDIndex"} {
+		if _, ok := created[name]; ok {
+			t.Errorf("create diff includes %s", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Keys under which the auth middleware stores the caller in fiber.Ctx locals
+const (
+	localMerchantID = "merchantID"
+	localActor      = "actor"
+	localRole       = "role"
+)
+
+// apiKeyFromRequest returns an API key sent either in X-API-Key or as a
+// bearer token
+func apiKeyFromRequest(c *fiber.Ctx) string {
+	if key := c.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := c.Get(fiber.HeaderAuthorization)
+	if strings.HasPrefix(auth, "Bearer "+apiKeyPrefix) {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// authRequired accepts a merchant API key or a JWT carrying a merchant_id
+// claim and records the authenticated merchant for the handlers
+func (h *Handler) authRequired() fiber.Handler {
+	jwtMiddleware := jwtware.New(jwtware.Config{
+		SigningKey: jwtSecretKey,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			if err.Error() == "Missing or malformed JWT" {
+				return newAppError(fiber.StatusUnauthorized, ErrCodeUnauthorized)
+			}
+			return &AppError{Status: fiber.StatusUnauthorized, Code: ErrCodeTokenInvalid, Err: err}
+		},
+		SuccessHandler: func(c *fiber.Ctx) error {
+			token := c.Locals("user").(*jwt.Token)
+			claims := token.Claims.(jwt.MapClaims)
+			merchantID, _ := claims["merchant_id"].(string)
+			if merchantID == "" {
+				return newAppError(fiber.StatusUnauthorized, ErrCodeTokenNoMerchant)
+			}
+			// Tokens issued before roles existed get the least privilege
+			role, _ := claims["role"].(string)
+			if !isValidRole(role) {
+				role = RoleViewer
+			}
+			subject, _ := claims["name"].(string)
+			sandbox, _ := claims["sandbox"].(bool)
+			c.Locals(localMerchantID, merchantID)
+			c.Locals(localActor, "jwt:"+subject)
+			c.Locals(localRole, role)
+			c.Locals(localSandbox, sandbox)
+			return c.Next()
+		},
+	})
+
+	return func(c *fiber.Ctx) error {
+		if key := apiKeyFromRequest(c); key != "" {
+			apiKey, err := authenticateAPIKey(requestDB(c, h.db), key)
+			if err != nil {
+				return newAppError(fiber.StatusUnauthorized, ErrCodeAPIKeyInvalid)
+			}
+			c.Locals(localMerchantID, apiKey.MerchantID)
+			c.Locals(localActor, "apikey:"+apiKey.Prefix)
+			c.Locals(localRole, apiKey.Role)
+			c.Locals(localSandbox, apiKey.Sandbox)
+			return c.Next()
+		}
+		return jwtMiddleware(c)
+	}
+}
+
+// currentMerchantID returns the merchant authenticated for this request
+func currentMerchantID(c *fiber.Ctx) string {
+	id, _ := c.Locals(localMerchantID).(string)
+	return id
+}
+
+// currentActor describes who is making the request, e.g. "jwt:enersys" or
+// "apikey:qrk_1a2b3c4d5e6f"
+func currentActor(c *fiber.Ctx) string {
+	actor, _ := c.Locals(localActor).(string)
+	return actor
+}
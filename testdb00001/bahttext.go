@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	thaiDigits = []string{"ศูนย์", "หนึ่ง", "สอง", "สาม", "สี่", "ห้า", "หก", "เจ็ด", "แปด", "เก้า"}
+	thaiPlaces = []string{"", "สิบ", "ร้อย", "พัน", "หมื่น", "แสน"}
+)
+
+// thaiGroup reads 0 < n < 1,000,000 in Thai, e.g. 21 is ยี่สิบเอ็ด. A final
+// one is also read เอ็ด when higher reports that ล้าน came before it, as in
+// หนึ่งล้านเอ็ด.
+func thaiGroup(n int64, higher bool) string {
+	var b strings.Builder
+	for place := 5; place >= 0; place-- {
+		d := n / pow10(place) % 10
+		switch {
+		case d == 0:
+		case place == 1 && d == 1:
+			b.WriteString("สิบ")
+		case place == 1 && d == 2:
+			b.WriteString("ยี่สิบ")
+		case place == 0 && d == 1 && (n > 9 || higher):
+			b.WriteString("เอ็ด")
+		default:
+			b.WriteString(thaiDigits[d] + thaiPlaces[place])
+		}
+	}
+	return b.String()
+}
+
+// thaiNumber reads n > 0 in Thai, grouping by ล้าน (millions)
+func thaiNumber(n int64) string {
+	if n >= 1000000 {
+		s := thaiNumber(n/1000000) + "ล้าน"
+		if rest := n % 1000000; rest > 0 {
+			s += thaiGroup(rest, true)
+		}
+		return s
+	}
+	return thaiGroup(n, false)
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+// bahtText spells out m the way Thai documents print amounts, e.g. 1,250.50
+// is หนึ่งพันสองร้อยห้าสิบบาทห้าสิบสตางค์ and 100 is หนึ่งร้อยบาทถ้วน
+func bahtText(m Money) string {
+	prefix := ""
+	if m < 0 {
+		prefix, m = "ลบ", -m
+	}
+	baht, satang := int64(m)/100, int64(m)%100
+	if baht == 0 && satang == 0 {
+		return "ศูนย์บาทถ้วน"
+	}
+
+	s := prefix
+	if baht > 0 {
+		s += thaiNumber(baht) + "บาท"
+	}
+	if satang == 0 {
+		return s + "ถ้วน"
+	}
+	return s + thaiGroup(satang, false) + "สตางค์"
+}
+
+// formatBaht renders m with thousands separators, e.g. 1,250.50
+func formatBaht(m Money) string {
+	s := m.String()
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	return fmt.Sprintf("%s%s.%s", sign, b.String(), frac)
+}
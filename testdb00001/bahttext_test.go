@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestBahtText(t *testing.T) {
+	tests := []struct {
+		satang Money
+		want   string
+	}{
+		{0, "ศูนย์บาทถ้วน"},
+		{1, "หนึ่งสตางค์"},
+		{100, "หนึ่งบาทถ้วน"},
+		{2100, "ยี่สิบเอ็ดบาทถ้วน"},
+		{10100, "หนึ่งร้อยเอ็ดบาทถ้วน"},
+		{125050, "หนึ่งพันสองร้อยห้าสิบบาทห้าสิบสตางค์"},
+		{100000000, "หนึ่งล้านบาทถ้วน"},
+		{100000100, "หนึ่งล้านเอ็ดบาทถ้วน"},
+		{200002100, "สองล้านยี่สิบเอ็ดบาทถ้วน"},
+		{1100000000, "สิบเอ็ดล้านบาทถ้วน"},
+		{-150, "ลบหนึ่งบาทห้าสิบสตางค์"},
+	}
+	for _, tt := range tests {
+		if got := bahtText(tt.satang); got != tt.want {
+			t.Errorf("bahtText(%s) = %s, want %s", tt.satang, got, tt.want)
+		}
+	}
+}
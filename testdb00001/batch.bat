@@ -6,6 +6,10 @@ set SERVER_PORT=3456
 set DB_NAME=db
 set InjectTestData=InjectTestData
 set TEST_SERVER_PORT=3123
+set DEV_MODE=true
+set ADMIN_SECRET=change-me
+set MASTER_KEYS=k1:ZGV2LW1hc3Rlci1rZXktZG8tbm90LXVzZS1pbi1wcm9k
+set BLIND_INDEX_KEY=change-me-too
 
 echo DB_HOST set to %DB_HOST%
 echo DB_PORT set to %DB_PORT%
@@ -24,6 +28,10 @@ echo InjectTestData set to %InjectTestData%
 @REM export SERVER_PORT=3003
 @REM export DB_NAME=db
 @REM export InjectTestData=InjectTestData
+@REM export DEV_MODE=true
+@REM export ADMIN_SECRET=change-me
+@REM export MASTER_KEYS=k1:ZGV2LW1hc3Rlci1rZXktZG8tbm90LXVzZS1pbi1wcm9k
+@REM export BLIND_INDEX_KEY=change-me-too
 
 @REM echo "DB_HOST set to $DB_HOST"
 @REM echo "DB_PORT set to $DB_PORT"
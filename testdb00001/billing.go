@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Billing schedule statuses. A schedule ends after its EndAt and is errored
+// when issuing one of its bills failed, see LastError.
+const (
+	ScheduleStatusActive    = "active"
+	ScheduleStatusCancelled = "cancelled"
+	ScheduleStatusEnded     = "ended"
+	ScheduleStatusErrored   = "errored"
+)
+
+// What a schedule does with cycles missed while the service was down
+const (
+	// MissedRunsSkip issues only the latest missed cycle
+	MissedRunsSkip = "skip"
+	// MissedRunsCatchUp issues every missed cycle
+	MissedRunsCatchUp = "catchup"
+)
+
+// Errors of billing schedules
+const (
+	ErrCodeScheduleNotFound  = "BILLING_SCHEDULE_NOT_FOUND"
+	ErrCodeScheduleNotActive = "BILLING_SCHEDULE_NOT_ACTIVE"
+)
+
+const (
+	defaultBillingTimezone = "Asia/Bangkok"
+	// minBillingInterval stops rules that would bill customers every minute
+	minBillingInterval = time.Hour
+	// maxBillingCatchUp bounds the cycles one schedule issues per run, the
+	// rest follow on the next run
+	maxBillingCatchUp = 12
+	// maxReferenceLength is the EMVCo limit of Reference1 and Reference2
+	maxReferenceLength = 20
+)
+
+// BillingSchedule issues a bill-payment QRRequest every cycle. The cycle is
+// either a cron expression or a day of the month, in Timezone. Reference1
+// and Reference2 are templates, see renderReference.
+type BillingSchedule struct {
+	ID          string `gorm:"primaryKey"`
+	MerchantID  string `gorm:"index"`
+	Name        string
+	CustomerRef string
+	Cron        string
+	// DayOfMonth is clamped to the length of the month, 31 bills on the
+	// last day
+	DayOfMonth   int
+	TimeOfDay    string // HH:MM
+	Timezone     string
+	Amount       Money
+	BillerID     string
+	MerchantName string
+	Reference1   string
+	Reference2   string
+	Remark       string
+	// ExpireAfter is how long an issued QR stays payable, in seconds
+	ExpireAfter int64
+	MissedRuns  string
+	Status      string `gorm:"index"`
+	TestMode    bool   `gorm:"index"`
+	StartAt     int64
+	EndAt       int64
+	// NextRunAt is the next cycle to issue, 0 once the schedule is over
+	NextRunAt int64 `gorm:"index"`
+	LastRunAt int64
+	Cycles    int64
+	// LastError is why the schedule stopped issuing bills
+	LastError string
+	CreatedAt int64
+}
+
+// BillingRun records the QRRequest a schedule issued for a cycle
+type BillingRun struct {
+	ID          uint   `gorm:"primaryKey"`
+	ScheduleID  string `gorm:"uniqueIndex:idx_billing_run,priority:1"`
+	CycleAt     int64  `gorm:"uniqueIndex:idx_billing_run,priority:2"`
+	Cycle       int64
+	QRRequestID string
+	CreatedAt   int64
+}
+
+// location returns the schedule's timezone
+func (s *BillingSchedule) location() (*time.Location, error) {
+	return time.LoadLocation(s.Timezone)
+}
+
+// next returns the first cycle after t
+func (s *BillingSchedule) next(t time.Time) (time.Time, error) {
+	loc, err := s.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t = t.In(loc)
+
+	if s.Cron != "" {
+		sched, err := cron.ParseStandard(s.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return sched.Next(t), nil
+	}
+
+	hour, minute, err := parseTimeOfDay(s.TimeOfDay)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for months := 0; ; months++ {
+		first := time.Date(t.Year(), t.Month()+time.Month(months), 1, 0, 0, 0, 0, loc)
+		day := s.DayOfMonth
+		if last := first.AddDate(0, 1, -1).Day(); day > last {
+			day = last
+		}
+		cycle := time.Date(first.Year(), first.Month(), day, hour, minute, 0, 0, loc)
+		if cycle.After(t) {
+			return cycle, nil
+		}
+	}
+}
+
+// firstRun returns the first cycle at or after StartAt, or now when unset
+func (s *BillingSchedule) firstRun(now time.Time) (time.Time, error) {
+	start := now
+	if s.StartAt > 0 {
+		start = time.Unix(s.StartAt, 0)
+	}
+	return s.next(start.Add(-time.Second))
+}
+
+func parseTimeOfDay(s string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+var referencePlaceholder = regexp.MustCompile(`\{[A-Z]+\}`)
+
+var validReference = regexp.MustCompile(`^[A-Z0-9]*$`)
+
+// renderReference fills a reference template for a cycle. It knows
+// {CUSTOMER}, {YYYY}, {YY}, {MM}, {DD} and {CYCLE}; dates are the cycle's in
+// the schedule's timezone.
+func (s *BillingSchedule) renderReference(template string, cycleAt time.Time, cycle int64) string {
+	return strings.ToUpper(referencePlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		switch p {
+		case "{CUSTOMER}":
+			return s.CustomerRef
+		case "{YYYY}":
+			return cycleAt.Format("2006")
+		case "{YY}":
+			return cycleAt.Format("06")
+		case "{MM}":
+			return cycleAt.Format("01")
+		case "{DD}":
+			return cycleAt.Format("02")
+		case "{CYCLE}":
+			return strconv.FormatInt(cycle, 10)
+		}
+		return p
+	}))
+}
+
+type billingScheduleInput struct {
+	Name        string      `json:"name"`
+	CustomerRef string      `json:"customerRef"`
+	Cron        string      `json:"cron"`
+	DayOfMonth  int         `json:"dayOfMonth"`
+	TimeOfDay   string      `json:"timeOfDay"`
+	Timezone    string      `json:"timezone"`
+	Amount      json.Number `json:"amount"`
+	BillerID    string      `json:"billerId"`
+	// MerchantName defaults to the merchant's default name
+	MerchantName string `json:"merchantName"`
+	Reference1   string `json:"reference1"`
+	Reference2   string `json:"reference2"`
+	Remark       string `json:"remark"`
+	ExpireAfter  int64  `json:"expireAfter"`
+	MissedRuns   string `json:"missedRuns"`
+	StartAt      int64  `json:"startAt"`
+	EndAt        int64  `json:"endAt"`
+	TestMode     bool   `json:"testMode"`
+}
+
+// toSchedule validates in and returns the active schedule it describes
+func (in *billingScheduleInput) toSchedule(now time.Time) (*BillingSchedule, error) {
+	s := &BillingSchedule{
+		ID:           uuid.New().String(),
+		Name:         in.Name,
+		CustomerRef:  strings.ToUpper(in.CustomerRef),
+		Cron:         strings.TrimSpace(in.Cron),
+		DayOfMonth:   in.DayOfMonth,
+		TimeOfDay:    in.TimeOfDay,
+		Timezone:     in.Timezone,
+		BillerID:     in.BillerID,
+		MerchantName: in.MerchantName,
+		Reference1:   in.Reference1,
+		Reference2:   in.Reference2,
+		Remark:       in.Remark,
+		ExpireAfter:  in.ExpireAfter,
+		MissedRuns:   in.MissedRuns,
+		Status:       ScheduleStatusActive,
+		TestMode:     in.TestMode,
+		StartAt:      in.StartAt,
+		EndAt:        in.EndAt,
+		CreatedAt:    now.Unix(),
+	}
+	if s.Timezone == "" {
+		s.Timezone = defaultBillingTimezone
+	}
+	if s.TimeOfDay == "" && s.Cron == "" {
+		s.TimeOfDay = "09:00"
+	}
+	if s.MissedRuns == "" {
+		s.MissedRuns = MissedRunsSkip
+	}
+
+	var fields []FieldError
+	invalid := func(field, code, detail string) {
+		fields = append(fields, FieldError{Field: field, Code: code, Detail: detail})
+	}
+
+	var err error
+	if s.Amount, err = parseMoney("amount", in.Amount); err != nil {
+		var appErr *AppError
+		if errors.As(err, &appErr) {
+			fields = append(fields, appErr.Fields...)
+		}
+	} else if s.Amount <= 0 {
+		invalid("amount", ErrCodeAmountInvalid, "")
+	}
+
+	switch {
+	case s.Cron != "" && s.DayOfMonth != 0:
+		invalid("cron", ErrCodeFieldInvalid, "give either cron or dayOfMonth")
+	case s.Cron != "":
+		if _, err := cron.ParseStandard(s.Cron); err != nil || strings.Contains(s.Cron, "TZ=") {
+			invalid("cron", ErrCodeFieldInvalid, "a 5-field cron expression, the timezone goes in timezone")
+		}
+	case s.DayOfMonth == 0:
+		invalid("dayOfMonth", ErrCodeFieldRequired, "give either cron or dayOfMonth")
+	case s.DayOfMonth < 1 || s.DayOfMonth > 31:
+		invalid("dayOfMonth", ErrCodeFieldInvalid, "between 1 and 31")
+	}
+	if s.Cron == "" {
+		if _, _, err := parseTimeOfDay(s.TimeOfDay); err != nil {
+			invalid("timeOfDay", ErrCodeFieldInvalid, "HH:MM")
+		}
+	}
+	if _, err := s.location(); err != nil {
+		invalid("timezone", ErrCodeFieldInvalid, "an IANA timezone such as Asia/Bangkok")
+	}
+	if s.MissedRuns != MissedRunsSkip && s.MissedRuns != MissedRunsCatchUp {
+		invalid("missedRuns", ErrCodeFieldInvalid, "skip or catchup")
+	}
+	if s.ExpireAfter < 0 {
+		invalid("expireAfter", ErrCodeFieldInvalid, "")
+	}
+	if s.EndAt > 0 && s.EndAt <= max(s.StartAt, now.Unix()) {
+		invalid("endAt", ErrCodeFieldInvalid, "after startAt and now")
+	}
+
+	// References must stay valid for any cycle, so render a long one
+	sample := time.Date(2099, time.December, 31, 0, 0, 0, 0, time.UTC)
+	if s.Reference1 == "" {
+		invalid("reference1", ErrCodeFieldRequired, "")
+	}
+	for field, template := range map[string]string{"reference1": s.Reference1, "reference2": s.Reference2} {
+		ref := s.renderReference(template, sample, 99999)
+		if !validReference.MatchString(ref) || len(ref) > maxReferenceLength {
+			invalid(field, ErrCodeFieldInvalid, fmt.Sprintf("at most %d letters and digits once the placeholders are filled", maxReferenceLength))
+		}
+	}
+	if len(fields) > 0 {
+		return nil, validationError(fields...)
+	}
+
+	first, err := s.firstRun(now)
+	if err != nil {
+		return nil, invalidField("cron", ErrCodeFieldInvalid)
+	}
+	if second, err := s.next(first); err != nil || second.Sub(first) < minBillingInterval {
+		return nil, validationError(FieldError{Field: "cron", Code: ErrCodeFieldInvalid, Detail: "cycles must be at least an hour apart"})
+	}
+	s.NextRunAt = first.Unix()
+	if s.EndAt > 0 && s.NextRunAt > s.EndAt {
+		return nil, validationError(FieldError{Field: "endAt", Code: ErrCodeFieldInvalid, Detail: "no cycle before endAt"})
+	}
+	return s, nil
+}
+
+// dueCycles returns the cycles of s to issue at now, oldest first, and the
+// cycle to run next, zero when the schedule is over. With MissedRunsSkip
+// only the latest due cycle is issued.
+func (s *BillingSchedule) dueCycles(now time.Time) ([]time.Time, time.Time, error) {
+	var due []time.Time
+	cycle := time.Unix(s.NextRunAt, 0)
+	skipped := 0
+	for !cycle.After(now) {
+		if s.EndAt > 0 && cycle.Unix() > s.EndAt {
+			return due, time.Time{}, nil
+		}
+		if s.MissedRuns == MissedRunsSkip && len(due) > 0 {
+			skipped++
+			due = due[:0]
+		}
+		due = append(due, cycle)
+		next, err := s.next(cycle)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		cycle = next
+		if s.MissedRuns == MissedRunsCatchUp && len(due) == maxBillingCatchUp {
+			break
+		}
+	}
+	if skipped > 0 {
+		slog.Warn("skipped missed billing cycles", "schedule_id", s.ID, "count", skipped)
+	}
+	if s.EndAt > 0 && cycle.Unix() > s.EndAt {
+		cycle = time.Time{}
+	}
+	return due, cycle, nil
+}
+
+// issueBill creates the QRRequest of one cycle
+func (s *BillingSchedule) issueBill(tx *gorm.DB, cycleAt, now time.Time) (*QRRequest, error) {
+	loc, err := s.location()
+	if err != nil {
+		return nil, err
+	}
+	cycle := s.Cycles + 1
+	local := cycleAt.In(loc)
+
+	qr := &QRRequest{
+		ID:           newQRRequestID(now),
+		MerchantID:   s.MerchantID,
+		Type:         "billpayment",
+		MerchantName: s.MerchantName,
+		Reference1:   s.renderReference(s.Reference1, local, cycle),
+		Reference2:   s.renderReference(s.Reference2, local, cycle),
+		Amount:       s.Amount.Baht(),
+		Onetime:      true,
+		Remark:       s.Remark,
+		CreatedAt:    now.Unix(),
+		Status:       QRStatusPending,
+		TestMode:     s.TestMode,
+		// A cycle can only ever be issued once
+		IdempotencyKey: fmt.Sprintf("billing:%s:%d", s.ID, cycleAt.Unix()),
+	}
+	qr.TxID = qr.Reference1
+	if s.ExpireAfter > 0 {
+		qr.Expire = now.Unix() + s.ExpireAfter
+	}
+	qr.QRCode, err = GenerateBillPaymentQRCode(qr.ID, s.BillerID, qr.MerchantName, qr.Reference1, qr.Reference2, qr.Amount, qr.Onetime)
+	if err != nil {
+		return nil, err
+	}
+	if qr.TestMode {
+		qr.QRCode = markSandboxPayload(qr.QRCode)
+	}
+
+	if err := CreateQRRequest(tx, qr); err != nil {
+		return nil, err
+	}
+	if err := appendAuditEvent(tx, systemActor("billing"), AuditCreate, nil, qr); err != nil {
+		return nil, err
+	}
+	run := BillingRun{ScheduleID: s.ID, CycleAt: cycleAt.Unix(), Cycle: cycle, QRRequestID: qr.ID, CreatedAt: now.Unix()}
+	if err := tx.Create(&run).Error; err != nil {
+		return nil, err
+	}
+	s.Cycles = cycle
+	s.LastRunAt = cycleAt.Unix()
+	return qr, nil
+}
+
+// runBillingWorker issues the bills of due schedules every interval until
+// ctx is cancelled. Cycles missed while the service was down are issued on
+// the first run according to each schedule's MissedRuns.
+func runBillingWorker(ctx context.Context, h *Handler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := h.issueDueBills(ctx, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "billing worker failed", "error", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "issued bills", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// issuedBill is a bill to announce once its transaction has committed
+type issuedBill struct {
+	schedule BillingSchedule
+	qr       *QRRequest
+	cycleAt  time.Time
+}
+
+// issueDue issues the due cycles of s and moves it to its next run. It runs
+// in a savepoint of tx, so a failure leaves none of its bills behind.
+func (s *BillingSchedule) issueDue(tx *gorm.DB, now time.Time) ([]issuedBill, error) {
+	var bills []issuedBill
+	saved := *s
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		due, next, err := s.dueCycles(now)
+		if err != nil {
+			return err
+		}
+		for _, cycleAt := range due {
+			qr, err := s.issueBill(tx, cycleAt, now)
+			if err != nil {
+				return err
+			}
+			bills = append(bills, issuedBill{schedule: *s, qr: qr, cycleAt: cycleAt})
+		}
+		s.NextRunAt = next.Unix()
+		if next.IsZero() {
+			s.NextRunAt = 0
+			s.Status = ScheduleStatusEnded
+		}
+		return nil
+	})
+	if err != nil {
+		*s = saved
+		return nil, err
+	}
+	return bills, nil
+}
+
+// issueDueBills issues the due cycles of all schedules in batches and
+// returns how many bills were issued
+func (h *Handler) issueDueBills(ctx context.Context, now time.Time) (int, error) {
+	issued := 0
+	for ctx.Err() == nil {
+		var schedules []BillingSchedule
+		var bills []issuedBill
+		err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND next_run_at > 0 AND next_run_at <= ?", ScheduleStatusActive, now.Unix()).
+				Limit(50).Find(&schedules).Error
+			if err != nil {
+				return err
+			}
+			for i := range schedules {
+				s := &schedules[i]
+				due, err := s.issueDue(tx, now)
+				if err != nil {
+					// The savepoint dropped this schedule's bills, the rest
+					// of the batch goes ahead
+					slog.ErrorContext(ctx, "billing schedule failed", "schedule", s.ID, "error", err)
+					s.Status = ScheduleStatusErrored
+					s.LastError = err.Error()
+				}
+				if err := tx.Save(s).Error; err != nil {
+					return err
+				}
+				bills = append(bills, due...)
+			}
+			return nil
+		})
+		if err != nil {
+			return issued, err
+		}
+		if len(schedules) == 0 {
+			break
+		}
+		for _, bill := range bills {
+			observeQRCreated(bill.qr)
+			h.notifyBillIssued(ctx, &bill.schedule, bill.qr, bill.cycleAt)
+		}
+		issued += len(bills)
+	}
+	return issued, nil
+}
+
+// scheduleError maps errors of loading or changing a BillingSchedule
+func scheduleError(err error) error {
+	var appErr *AppError
+	switch {
+	case errors.As(err, &appErr):
+		return appErr
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return newAppError(fiber.StatusNotFound, ErrCodeScheduleNotFound)
+	}
+	return internalError(err)
+}
+
+// getCallerSchedule loads a schedule of the authenticated merchant. Sandbox
+// callers cannot see live schedules.
+func getCallerSchedule(db *gorm.DB, c *fiber.Ctx, id string) (*BillingSchedule, error) {
+	var s BillingSchedule
+	if err := db.First(&s, "id = ? AND merchant_id = ?", id, currentMerchantID(c)).Error; err != nil {
+		return nil, err
+	}
+	if isSandbox(c) && !s.TestMode {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &s, nil
+}
+
+// createBillingSchedule handles POST /billing/schedules
+func (h *Handler) createBillingSchedule(c *fiber.Ctx) error {
+	in := new(billingScheduleInput)
+	if err := c.BodyParser(in); err != nil {
+		return badRequestError(err)
+	}
+	s, err := in.toSchedule(time.Now())
+	if err != nil {
+		return err
+	}
+	s.MerchantID = currentMerchantID(c)
+	// Sandbox credentials can only create test schedules
+	s.TestMode = s.TestMode || isSandbox(c)
+
+	db := requestDB(c, h.db)
+	merchant, err := GetMerchant(db, s.MerchantID)
+	if err != nil {
+		return merchantError(err)
+	}
+	if s.BillerID == "" {
+		ids := merchant.BillerIDList()
+		if len(ids) == 0 {
+			return invalidField("billerId", ErrCodeFieldRequired)
+		}
+		s.BillerID = ids[0]
+	}
+	if !merchant.AllowsBiller(s.BillerID) {
+		return newAppError(fiber.StatusForbidden, ErrCodeBillerNotAllowed)
+	}
+	if s.MerchantName == "" {
+		s.MerchantName = merchant.DefaultMerchantName
+	}
+
+	if err := db.Create(s).Error; err != nil {
+		return internalError(err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(s)
+}
+
+// listBillingSchedules handles GET /billing/schedules, newest first
+func (h *Handler) listBillingSchedules(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	testMode := isSandbox(c) || c.QueryBool("testMode")
+	query := requestDB(c, h.db).Where("merchant_id = ? AND test_mode = ?", currentMerchantID(c), testMode)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if customer := c.Query("customerRef"); customer != "" {
+		query = query.Where("customer_ref = ?", strings.ToUpper(customer))
+	}
+
+	var schedules []BillingSchedule
+	if err := query.Order("created_at DESC").Limit(limit).Offset(c.QueryInt("offset")).Find(&schedules).Error; err != nil {
+		return internalError(err)
+	}
+	return c.JSON(schedules)
+}
+
+// getBillingSchedule handles GET /billing/schedules/:id
+func (h *Handler) getBillingSchedule(c *fiber.Ctx) error {
+	s, err := getCallerSchedule(requestDB(c, h.db), c, c.Params("id"))
+	if err != nil {
+		return scheduleError(err)
+	}
+	return c.JSON(s)
+}
+
+// cancelBillingSchedule handles POST /billing/schedules/:id/cancel. Bills
+// already issued stay payable.
+func (h *Handler) cancelBillingSchedule(c *fiber.Ctx) error {
+	var s *BillingSchedule
+	err := requestDB(c, h.db).Transaction(func(tx *gorm.DB) error {
+		var err error
+		s, err = getCallerSchedule(tx.Clauses(clause.Locking{Strength: "UPDATE"}), c, c.Params("id"))
+		if err != nil {
+			return err
+		}
+		if s.Status != ScheduleStatusActive && s.Status != ScheduleStatusErrored {
+			return newAppError(fiber.StatusConflict, ErrCodeScheduleNotActive)
+		}
+		s.Status = ScheduleStatusCancelled
+		s.NextRunAt = 0
+		return tx.Save(s).Error
+	})
+	if err != nil {
+		return scheduleError(err)
+	}
+	return c.JSON(s)
+}
+
+// listBillingRuns handles GET /billing/schedules/:id/runs, newest first
+func (h *Handler) listBillingRuns(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	s, err := getCallerSchedule(db, c, c.Params("id"))
+	if err != nil {
+		return scheduleError(err)
+	}
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	var runs []BillingRun
+	if err := db.Where("schedule_id = ?", s.ID).Order("cycle_at DESC").
+		Limit(limit).Offset(c.QueryInt("offset")).Find(&runs).Error; err != nil {
+		return internalError(err)
+	}
+	return c.JSON(runs)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// callbackTimeout bounds a single callback delivery
+const callbackTimeout = 10 * time.Second
+
+// allowPrivateTargets lets callbacks and chat webhooks reach loopback and
+// private addresses; set from Config.DevMode so they can be tried locally
+var allowPrivateTargets bool
+
+var errPrivateTarget = errors.New("webhook target is a private or loopback address")
+
+// publicAddress reports whether addr can be reached from the internet.
+// Merchants choose webhook URLs, which must not reach the service's own
+// network.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() &&
+		!netip.MustParsePrefix("100.64.0.0/10").Contains(addr)
+}
+
+// validateWebhookURL checks a merchant supplied callback or chat webhook URL
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("an http or https URL")
+	}
+	if allowPrivateTargets {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateTarget
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddress(addr) {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+// newWebhookClient returns the client for merchant supplied URLs. It refuses
+// to connect to private and loopback addresses, whatever a name resolves
+// to, and ignores proxy settings so the check sees the real target.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivateTargets {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(addrPort.Addr()) {
+				return errPrivateTarget
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return newOutboundClientWith(timeout, transport)
+}
+
+// PaidCallback is posted to the merchant's callback URL when a QRRequest is
+// paid. TestMode is set for sandbox payments.
+type PaidCallback struct {
+	Event       string  `json:"event"`
+	QRRequestID string  `json:"qrRequestId"`
+	MerchantID  string  `json:"merchantId"`
+	TxID        string  `json:"txId,omitempty"`
+	Amount      float64 `json:"amount"`
+	TransRef    string  `json:"transRef"`
+	PaidAt      int64   `json:"paidAt"`
+	TestMode    bool    `json:"testMode"`
+}
+
+// notifyPaid notifies the merchant's channels and posts a PaidCallback to the
+// merchant's callback URL, if one is configured. Delivery happens in the
+// background and failures are logged.
+func (h *Handler) notifyPaid(c *fiber.Ctx, qr *QRRequest, transRef string, paidAt int64) {
+	ctx := context.WithoutCancel(c.UserContext())
+	merchant, err := GetMerchant(h.db.WithContext(ctx), qr.MerchantID)
+	if err != nil {
+		return
+	}
+	data := newNotificationData(EventQRPaid, qr)
+	data.TransRef = transRef
+	data.PaidAt = formatSlipTime(paidAt)
+	h.notifications.Notify(ctx, merchant, data)
+	if merchant.Settings.CallbackURL == "" {
+		return
+	}
+
+	callback := PaidCallback{
+		Event:       "qr.paid",
+		QRRequestID: qr.ID,
+		MerchantID:  qr.MerchantID,
+		TxID:        qr.TxID,
+		Amount:      qr.Amount,
+		TransRef:    transRef,
+		PaidAt:      paidAt,
+		TestMode:    qr.TestMode,
+	}
+	h.deliverCallback(ctx, merchant.Settings.CallbackURL, qr.ID, callback)
+}
+
+// BillIssuedCallback is posted to the merchant's callback URL when a billing
+// schedule issues the QRRequest of a cycle
+type BillIssuedCallback struct {
+	Event       string  `json:"event"`
+	ScheduleID  string  `json:"scheduleId"`
+	CustomerRef string  `json:"customerRef,omitempty"`
+	QRRequestID string  `json:"qrRequestId"`
+	MerchantID  string  `json:"merchantId"`
+	Reference1  string  `json:"reference1"`
+	Reference2  string  `json:"reference2,omitempty"`
+	Amount      float64 `json:"amount"`
+	QRCode      string  `json:"qrCode"`
+	CycleAt     int64   `json:"cycleAt"`
+	Expire      int64   `json:"expire,omitempty"`
+	TestMode    bool    `json:"testMode"`
+}
+
+// notifyBillIssued posts a BillIssuedCallback like notifyPaid
+func (h *Handler) notifyBillIssued(ctx context.Context, s *BillingSchedule, qr *QRRequest, cycleAt time.Time) {
+	merchant, err := GetMerchant(h.db.WithContext(ctx), qr.MerchantID)
+	if err != nil {
+		return
+	}
+	h.notifications.Notify(ctx, merchant, newNotificationData(EventBillIssued, qr))
+	if merchant.Settings.CallbackURL == "" {
+		return
+	}
+
+	callback := BillIssuedCallback{
+		Event:       "bill.issued",
+		ScheduleID:  s.ID,
+		CustomerRef: s.CustomerRef,
+		QRRequestID: qr.ID,
+		MerchantID:  qr.MerchantID,
+		Reference1:  qr.Reference1,
+		Reference2:  qr.Reference2,
+		Amount:      qr.Amount,
+		QRCode:      qr.QRCode,
+		CycleAt:     cycleAt.Unix(),
+		Expire:      qr.Expire,
+		TestMode:    qr.TestMode,
+	}
+	h.deliverCallback(ctx, merchant.Settings.CallbackURL, qr.ID, callback)
+}
+
+// deliverCallback posts callback in the background; shutdown waits for it,
+// see waitCallbacks. Failures are logged.
+func (h *Handler) deliverCallback(ctx context.Context, url, qrRequestID string, callback interface{}) {
+	h.callbacks.Add(1)
+	go func() {
+		defer h.callbacks.Done()
+		if err := h.sendCallback(ctx, url, callback); err != nil {
+			slog.WarnContext(ctx, "callback failed", "qr_request_id", qrRequestID, "error", err)
+		}
+	}()
+}
+
+// waitCallbacks blocks until callbacks in flight are delivered or ctx ends
+func (h *Handler) waitCallbacks(ctx context.Context) error {
+	return waitContext(ctx, &h.callbacks, "callbacks")
+}
+
+func (h *Handler) sendCallback(ctx context.Context, url string, callback interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(callback)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	resp, err := h.callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package client is a typed Go client for the QR generator API.
+//
+//	c := client.New("https://qr.example.com", client.WithAPIKey(key))
+//	qr, err := c.CreateQR(ctx, client.CreateQRInput{Amount: 100})
+//	if client.IsCode(err, client.CodeAmountInvalid) {
+//		...
+//	}
+//
+// Reads, logins and creates carrying an idempotency key are retried on
+// network errors and 429/502/503/504 responses; other calls are sent once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiPrefix is where the service mounts its API
+const apiPrefix = "/v1"
+
+// Client calls the QR generator API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+	retryWait  time.Duration
+	apiKey     string
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken authenticates requests with a JWT issued by /login
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithAPIKey authenticates requests with a merchant API key
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithRetries sets how often a retryable request is retried and the wait
+// before the first retry, which doubles on every further attempt
+func WithRetries(n int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.retryWait = wait
+	}
+}
+
+// WithTimeout bounds every call, retries included, unless the context
+// passed to it has an earlier deadline
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// New returns a client for the service at baseURL, e.g.
+// "http://localhost:3000"
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/") + apiPrefix,
+		httpClient: http.DefaultClient,
+		timeout:    30 * time.Second,
+		retries:    2,
+		retryWait:  200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token returns the JWT the client currently authenticates with
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+// request describes one API call
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	header http.Header
+	// retry marks calls that are safe to send more than once
+	retry bool
+}
+
+// do sends req and decodes a successful response into out
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return err
+		}
+	}
+
+	attempts := 1
+	if req.retry {
+		attempts += c.retries
+	}
+	wait := c.retryWait
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, req, body)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				return nil
+			}
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+
+		if err == nil {
+			err = parseError(resp)
+			if !retryableStatus(resp.StatusCode) {
+				return err
+			}
+			if after := retryAfter(resp); after > wait {
+				wait = after
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= attempts {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
+
+// send makes a single attempt
+func (c *Client) send(ctx context.Context, req request, body []byte) (*http.Response, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if token := c.Token(); token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	} else if c.apiKey != "" {
+		httpReq.Header.Set("X-API-Key", c.apiKey)
+	}
+	return c.httpClient.Do(httpReq)
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter reads a Retry-After header given in seconds
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parseError reads the problem document of a failed response. Bodies that
+// are not problem documents, e.g. from a proxy, still give an *Error with the
+// status.
+func parseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &Error{Status: resp.StatusCode}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && json.Unmarshal(data, apiErr) == nil && apiErr.Code != "" {
+		apiErr.Status = resp.StatusCode
+		return apiErr
+	}
+	apiErr.Code = codeForStatus(resp.StatusCode)
+	apiErr.Title = http.StatusText(resp.StatusCode)
+	if text := strings.TrimSpace(string(data)); text != "" {
+		apiErr.Detail = text
+	}
+	return apiErr
+}
+
+// errMissingID guards against calls that would hit the collection instead
+var errMissingID = errors.New("client: id is required")
+
+func escapeID(id string) (string, error) {
+	if id == "" {
+		return "", errMissingID
+	}
+	return url.PathEscape(id), nil
+}
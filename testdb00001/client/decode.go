@@ -0,0 +1,113 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/howeyc/crc16"
+)
+
+// Payload is a decoded Thai QR (EMVCo) payment payload
+type Payload struct {
+	// Onetime is true for a dynamic QR (point of initiation 12)
+	Onetime bool
+	// AID identifies the scheme, e.g. A000000677010112 for bill payment
+	AID          string
+	BillerID     string
+	Reference1   string
+	Reference2   string
+	Currency     string
+	Amount       float64
+	Country      string
+	MerchantName string
+	// Fields holds every top-level tag of the payload
+	Fields map[string]string
+}
+
+// Merchant account tags: 29 is PromptPay credit transfer, 30 bill payment
+var merchantAccountTags = []string{"30", "29"}
+
+// Decode parses a QR payload such as QRRequest.QRCode and checks its CRC
+func Decode(data string) (*Payload, error) {
+	data = strings.TrimSpace(data)
+	if err := checkCRC(data); err != nil {
+		return nil, err
+	}
+	fields, err := parseTLV(data)
+	if err != nil {
+		return nil, err
+	}
+	if fields["00"] != "01" {
+		return nil, fmt.Errorf("client: unsupported payload format %q", fields["00"])
+	}
+
+	p := &Payload{
+		Onetime:      fields["01"] == "12",
+		Currency:     fields["53"],
+		Country:      fields["58"],
+		MerchantName: fields["59"],
+		Fields:       fields,
+	}
+	if amount, ok := fields["54"]; ok {
+		if p.Amount, err = strconv.ParseFloat(amount, 64); err != nil {
+			return nil, fmt.Errorf("client: invalid amount %q", amount)
+		}
+	}
+	for _, tag := range merchantAccountTags {
+		account, ok := fields[tag]
+		if !ok {
+			continue
+		}
+		sub, err := parseTLV(account)
+		if err != nil {
+			return nil, fmt.Errorf("client: merchant account: %v", err)
+		}
+		p.AID = sub["00"]
+		p.BillerID = sub["01"]
+		p.Reference1 = sub["02"]
+		p.Reference2 = sub["03"]
+		break
+	}
+	return p, nil
+}
+
+// parseTLV splits an EMVCo tag-length-value string into its fields
+func parseTLV(data string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for i := 0; i < len(data); {
+		if i+4 > len(data) {
+			return nil, fmt.Errorf("client: truncated field at offset %d", i)
+		}
+		tag := data[i : i+2]
+		length, err := strconv.Atoi(data[i+2 : i+4])
+		if err != nil {
+			return nil, fmt.Errorf("client: invalid length for tag %s", tag)
+		}
+		i += 4
+		if i+length > len(data) {
+			return nil, fmt.Errorf("client: value of tag %s overflows payload", tag)
+		}
+		fields[tag] = data[i : i+length]
+		i += length
+	}
+	return fields, nil
+}
+
+// checkCRC validates the trailing CRC16 (CCITT-FALSE) field
+func checkCRC(data string) error {
+	if len(data) < 8 || data[len(data)-8:len(data)-4] != "6304" {
+		return fmt.Errorf("client: payload has no CRC field")
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	expected := fmt.Sprintf("%04X", crc16.ChecksumCCITTFalse([]byte(body)))
+	if !strings.EqualFold(expected, sum) {
+		return fmt.Errorf("client: crc mismatch: got %s, expected %s", strings.ToUpper(sum), expected)
+	}
+	return nil
+}
+
+// Payload decodes the QR code of the request
+func (qr *QRRequest) Payload() (*Payload, error) {
+	return Decode(qr.QRCode)
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Codes of the service's error responses. They are stable, match on them
+// rather than on titles, which are localized.
+const (
+	CodeInternal            = "INTERNAL_ERROR"
+	CodeBadRequest          = "BAD_REQUEST"
+	CodeValidation          = "VALIDATION_FAILED"
+	CodeNotFound            = "NOT_FOUND"
+	CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	CodePayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	CodeUnauthorized        = "UNAUTHORIZED"
+	CodeTokenInvalid        = "TOKEN_INVALID"
+	CodeTokenNoMerchant     = "TOKEN_NO_MERCHANT"
+	CodeAPIKeyInvalid       = "API_KEY_INVALID"
+	CodeAdminSecretInvalid  = "ADMIN_SECRET_INVALID"
+	CodeCredentialsRequired = "CREDENTIALS_REQUIRED"
+	CodePermissionDenied    = "PERMISSION_DENIED"
+
+	CodeFieldRequired   = "FIELD_REQUIRED"
+	CodeFieldInvalid    = "FIELD_INVALID"
+	CodeAmountInvalid   = "AMOUNT_INVALID"
+	CodeAmountPrecision = "AMOUNT_PRECISION"
+
+	CodeQRNotFound       = "QR_NOT_FOUND"
+	CodeQRNotPending     = "QR_NOT_PENDING"
+	CodeMerchantNotFound = "MERCHANT_NOT_FOUND"
+	CodeBillerNotAllowed = "BILLER_NOT_ALLOWED"
+	CodeQRSandbox        = "QR_SANDBOX"
+	CodeQRNotSandbox     = "QR_NOT_SANDBOX"
+
+	// CodeUnavailable is used for 502/503/504 responses without a problem
+	// document, e.g. from a load balancer
+	CodeUnavailable = "SERVICE_UNAVAILABLE"
+)
+
+// Error is an error response of the service
+type Error struct {
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Title     string       `json:"title"`
+	Detail    string       `json:"detail"`
+	RequestID string       `json:"requestId"`
+	Fields    []FieldError `json:"errors"`
+}
+
+// FieldError describes one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Title)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	for _, f := range e.Fields {
+		msg += fmt.Sprintf("; %s: %s", f.Field, f.Code)
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// IsCode reports whether err is an error response with code, or has one of
+// its field errors with code
+func IsCode(err error, code string) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == code {
+		return true
+	}
+	for _, f := range apiErr.Fields {
+		if f.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err means the resource does not exist
+func IsNotFound(err error) bool {
+	return IsCode(err, CodeNotFound) || IsCode(err, CodeQRNotFound) || IsCode(err, CodeMerchantNotFound)
+}
+
+// codeForStatus gives responses without a problem document a code
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	if status < 500 {
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
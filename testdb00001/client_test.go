@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"testdb00001/client"
+)
+
+// The client tests run the real Fiber app behind httptest. Tests that need
+// the database run against TEST_DATABASE_DSN and are skipped without it,
+// e.g. TEST_DATABASE_DSN="host=localhost user=postgres dbname=qr_test sslmode=disable"
+
+const testAdminSecret = "test-admin-secret"
+
+// newTestServer serves the app with db, which may be nil for tests that
+// never reach a handler using it
+func newTestServer(t *testing.T, db *gorm.DB) *httptest.Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DevMode = true
+	cfg.AdminSecret = testAdminSecret
+	jwtSecretKey = []byte("client-test-secret")
+
+	openAPI, err := loadOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
+	app.Use(requestIDMiddleware)
+	setupRoutes(app, cfg, db, NewHandler(db, NewLifecycle()), openAPI)
+
+	srv := httptest.NewServer(adaptor.FiberApp(app))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testDB connects to TEST_DATABASE_DSN and migrates it
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.DevMode = true
+	if err := setupFieldEncryption(cfg, db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestClientAdminLogin(t *testing.T) {
+	srv := newTestServer(t, nil)
+	ctx := context.Background()
+
+	c := client.New(srv.URL)
+	token, err := c.Login(ctx, testAdminSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == "" || c.Token() != token {
+		t.Fatalf("Login returned %q, client holds %q", token, c.Token())
+	}
+
+	_, err = client.New(srv.URL).Login(ctx, "wrong")
+	if !client.IsCode(err, client.CodeAdminSecretInvalid) {
+		t.Fatalf("wrong admin secret: got %v", err)
+	}
+}
+
+func TestClientErrorMapping(t *testing.T) {
+	srv := newTestServer(t, nil)
+	ctx := context.Background()
+
+	_, err := client.New(srv.URL).GetQR(ctx, "some-id")
+	if !client.IsCode(err, client.CodeUnauthorized) {
+		t.Fatalf("without credentials: got %v", err)
+	}
+
+	_, err = client.New(srv.URL, client.WithToken("not-a-jwt")).GetQR(ctx, "some-id")
+	if !client.IsCode(err, client.CodeTokenInvalid) {
+		t.Fatalf("invalid token: got %v", err)
+	}
+
+	c := client.New(srv.URL)
+	if _, err := c.Login(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.CreateQR(ctx, client.CreateQRInput{Amount: -1})
+	apiErr, ok := err.(*client.Error)
+	if !ok || apiErr.Status != http.StatusBadRequest || apiErr.Code != client.CodeValidation {
+		t.Fatalf("negative amount: got %v", err)
+	}
+	if len(apiErr.Fields) == 0 || apiErr.Fields[0].Field != "amount" {
+		t.Fatalf("negative amount: want a field error on amount, got %+v", apiErr.Fields)
+	}
+	if apiErr.RequestID == "" {
+		t.Fatal("error without request ID")
+	}
+
+	if _, err := c.GetQR(ctx, ""); err == nil {
+		t.Fatal("GetQR with an empty id succeeded")
+	}
+}
+
+// flakyTransport fails the first request of every call with status. With
+// forward set the request still reaches the server and only its response is
+// lost, like a connection dropped by a proxy.
+type flakyTransport struct {
+	next    http.RoundTripper
+	status  int
+	forward bool
+	calls   atomic.Int32
+	keys    []string
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.keys = append(f.keys, req.Header.Get("Idempotency-Key"))
+	if f.calls.Add(1) > 1 {
+		return f.next.RoundTrip(req)
+	}
+	if f.forward {
+		resp, err := f.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+	return &http.Response{
+		StatusCode: f.status,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(bytes.NewReader([]byte("upstream unavailable"))),
+		Request:    req,
+	}, nil
+}
+
+func TestClientRetriesWithoutProblemDocument(t *testing.T) {
+	srv := newTestServer(t, nil)
+	flaky := &flakyTransport{next: http.DefaultTransport, status: http.StatusServiceUnavailable}
+	c := client.New(srv.URL, client.WithHTTPClient(&http.Client{Transport: flaky}), client.WithRetries(2, time.Millisecond))
+
+	if _, err := c.Login(context.Background(), testAdminSecret); err != nil {
+		t.Fatal(err)
+	}
+	if n := flaky.calls.Load(); n != 2 {
+		t.Fatalf("want one retry, got %d calls", n)
+	}
+
+	// Calls that are not retried surface the status as a typed error
+	flaky.calls.Store(0)
+	_, err := c.CancelQR(context.Background(), "some-id")
+	if !client.IsCode(err, client.CodeUnavailable) {
+		t.Fatalf("cancel through a failing proxy: got %v", err)
+	}
+}
+
+func TestClientQRLifecycle(t *testing.T) {
+	srv := newTestServer(t, testDB(t))
+	ctx := context.Background()
+	c := client.New(srv.URL)
+	if _, err := c.Login(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := c.CreateQR(ctx, client.CreateQRInput{Amount: 125.5, Remark: "client test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Status != client.StatusPending || created.Amount != 125.5 {
+		t.Fatalf("created %+v", created)
+	}
+
+	got, err := c.GetQR(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != created.ID || got.Remark != "client test" {
+		t.Fatalf("got %+v, want %+v", got, created)
+	}
+
+	today := time.Now().In(bangkokTime).Format("2006-01-02")
+	list, err := c.ListQRs(ctx, client.ListOptions{Status: client.StatusPending, From: today, To: today, Limit: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, qr := range list {
+		found = found || qr.ID == created.ID
+	}
+	if !found {
+		t.Fatalf("%s not listed for %s", created.ID, today)
+	}
+
+	cancelled, err := c.CancelQR(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Status != client.StatusCancelled {
+		t.Fatalf("cancelled status %q", cancelled.Status)
+	}
+	if _, err := c.CancelQR(ctx, created.ID); !client.IsCode(err, client.CodeQRNotPending) {
+		t.Fatalf("second cancel: got %v", err)
+	}
+
+	if _, err := c.GetQR(ctx, newQRRequestID(time.Now())); !client.IsNotFound(err) {
+		t.Fatalf("unknown id: got %v", err)
+	}
+	if _, err := c.CreateQR(ctx, client.CreateQRInput{Amount: 10.555}); !client.IsCode(err, client.CodeAmountPrecision) {
+		t.Fatalf("three decimals: got %v", err)
+	}
+}
+
+func TestClientCreateRetryIsIdempotent(t *testing.T) {
+	srv := newTestServer(t, testDB(t))
+	ctx := context.Background()
+	c := client.New(srv.URL)
+	if _, err := c.Login(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt creates the request but its response is lost
+	flaky := &flakyTransport{next: http.DefaultTransport, status: http.StatusBadGateway, forward: true}
+	retrying := client.New(srv.URL, client.WithToken(c.Token()),
+		client.WithHTTPClient(&http.Client{Transport: flaky}), client.WithRetries(2, time.Millisecond))
+	qr, err := retrying.CreateQR(ctx, client.CreateQRInput{Amount: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flaky.keys) != 2 || flaky.keys[0] == "" || flaky.keys[0] != flaky.keys[1] {
+		t.Fatalf("retry sent idempotency keys %q", flaky.keys)
+	}
+
+	// The same key returns the original, not a second request
+	again, err := c.CreateQR(ctx, client.CreateQRInput{Amount: 42, IdempotencyKey: flaky.keys[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != qr.ID {
+		t.Fatalf("same idempotency key created %s, then %s", qr.ID, again.ID)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config structure. Values are layered: defaults, then the optional config
+// file, then environment variables. Every env variable can also be given as
+// <NAME>_FILE pointing to a file holding the value (Docker secrets).
+type Config struct {
+	DBHost     string `yaml:"dbHost" toml:"dbHost" env:"DB_HOST"`
+	DBName     string `yaml:"dbName" toml:"dbName" env:"DB_NAME"`
+	DBPort     string `yaml:"dbPort" toml:"dbPort" env:"DB_PORT"`
+	DBUser     string `yaml:"dbUser" toml:"dbUser" env:"DB_USER"`
+	DBPassword string `yaml:"dbPassword" toml:"dbPassword" env:"DB_PASSWORD" secret:"true"`
+	ServerPort string `yaml:"serverPort" toml:"serverPort" env:"SERVER_PORT"`
+	// MetricsPort serves /metrics on a separate, internal listener. Without
+	// it /metrics is on ServerPort and needs the metrics:read permission.
+	MetricsPort string `yaml:"metricsPort" toml:"metricsPort" env:"METRICS_PORT"`
+
+	DBSSLMode         string        `yaml:"dbSslMode" toml:"dbSslMode" env:"DB_SSLMODE"`
+	DBTimeZone        string        `yaml:"dbTimeZone" toml:"dbTimeZone" env:"DB_TIMEZONE"`
+	DBMaxOpenConns    int           `yaml:"dbMaxOpenConns" toml:"dbMaxOpenConns" env:"DB_MAX_OPEN_CONNS"`
+	DBMaxIdleConns    int           `yaml:"dbMaxIdleConns" toml:"dbMaxIdleConns" env:"DB_MAX_IDLE_CONNS"`
+	DBConnMaxLifetime time.Duration `yaml:"dbConnMaxLifetime" toml:"dbConnMaxLifetime" env:"DB_CONN_MAX_LIFETIME"`
+	DBConnMaxIdleTime time.Duration `yaml:"dbConnMaxIdleTime" toml:"dbConnMaxIdleTime" env:"DB_CONN_MAX_IDLE_TIME"`
+
+	JWTSecret string `yaml:"jwtSecret" toml:"jwtSecret" env:"JWT_SECRET" secret:"true"`
+
+	// ShutdownDelay keeps serving with readiness false before draining starts,
+	// ShutdownTimeout bounds the whole shutdown
+	ShutdownDelay   time.Duration `yaml:"shutdownDelay" toml:"shutdownDelay" env:"SHUTDOWN_DELAY"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+
+	// ReadinessTimeout bounds the /readyz dependency checks, whose result is
+	// reused for ReadinessCacheTTL
+	ReadinessTimeout  time.Duration `yaml:"readinessTimeout" toml:"readinessTimeout" env:"READINESS_TIMEOUT"`
+	ReadinessCacheTTL time.Duration `yaml:"readinessCacheTtl" toml:"readinessCacheTtl" env:"READINESS_CACHE_TTL"`
+
+	// LogLevel is debug, info, warn or error. LogSampleRate is the fraction
+	// of successful requests written to the access log; failures are always
+	// logged. Statements slower than DBSlowQuery are logged as warnings.
+	LogLevel      string        `yaml:"logLevel" toml:"logLevel" env:"LOG_LEVEL"`
+	LogSampleRate float64       `yaml:"logSampleRate" toml:"logSampleRate" env:"LOG_SAMPLE_RATE"`
+	DBSlowQuery   time.Duration `yaml:"dbSlowQuery" toml:"dbSlowQuery" env:"DB_SLOW_QUERY"`
+
+	// TraceExporter is none, stdout, file (written to TraceFile) or otlp,
+	// which is configured by the standard OTEL_EXPORTER_OTLP_* variables.
+	// TraceSampleRatio applies to traces not started by a caller.
+	TraceExporter    string  `yaml:"traceExporter" toml:"traceExporter" env:"TRACE_EXPORTER"`
+	TraceFile        string  `yaml:"traceFile" toml:"traceFile" env:"TRACE_FILE"`
+	TraceSampleRatio float64 `yaml:"traceSampleRatio" toml:"traceSampleRatio" env:"TRACE_SAMPLE_RATIO"`
+	ServiceName      string  `yaml:"serviceName" toml:"serviceName" env:"SERVICE_NAME"`
+
+	// ExpirePending runs the expiry worker, which moves pending QR requests
+	// past Expire to expired every ExpiryInterval
+	ExpirePending  bool          `yaml:"expirePending" toml:"expirePending" env:"EXPIRE_PENDING"`
+	ExpiryInterval time.Duration `yaml:"expiryInterval" toml:"expiryInterval" env:"EXPIRY_INTERVAL"`
+	// BillingInterval is how often due billing schedules are issued
+	BillingInterval time.Duration `yaml:"billingInterval" toml:"billingInterval" env:"BILLING_INTERVAL"`
+	// ReportInterval is how often the report rollups catch up with changes
+	ReportInterval time.Duration `yaml:"reportInterval" toml:"reportInterval" env:"REPORT_INTERVAL"`
+
+	// ExportDir holds the files of export jobs, which are deleted ExportTTL
+	// after they are written. Jobs run and downloads are served on any
+	// instance, so with several instances it must be a shared volume (NFS,
+	// EFS, a ReadWriteMany claim); a local directory per instance makes
+	// downloads fail with EXPORT_FILE_MISSING.
+	// ExportInterval is how often queued jobs are looked for.
+	ExportDir      string        `yaml:"exportDir" toml:"exportDir" env:"EXPORT_DIR"`
+	ExportTTL      time.Duration `yaml:"exportTtl" toml:"exportTtl" env:"EXPORT_TTL"`
+	ExportInterval time.Duration `yaml:"exportInterval" toml:"exportInterval" env:"EXPORT_INTERVAL"`
+
+	// RetentionRules are the default retention rules as status:action:days,
+	// e.g. "expired:purge:90,paid:archive:730"; merchants may override them.
+	// Archived rows go to RetentionArchive, the archive table or gzipped
+	// NDJSON files with manifests under RetentionArchiveDir.
+	RetentionRules      string        `yaml:"retentionRules" toml:"retentionRules" env:"RETENTION_RULES"`
+	RetentionArchive    string        `yaml:"retentionArchive" toml:"retentionArchive" env:"RETENTION_ARCHIVE"`
+	RetentionArchiveDir string        `yaml:"retentionArchiveDir" toml:"retentionArchiveDir" env:"RETENTION_ARCHIVE_DIR"`
+	RetentionInterval   time.Duration `yaml:"retentionInterval" toml:"retentionInterval" env:"RETENTION_INTERVAL"`
+
+	// PartitionPremake is how many monthly partitions of qr_requests are
+	// created ahead of the current month. With PartitionDetachAfter set,
+	// partitions more than that many months old are detached and kept as
+	// plain tables, unless they hold pending requests or legal holds.
+	PartitionPremake     int           `yaml:"partitionPremake" toml:"partitionPremake" env:"PARTITION_PREMAKE"`
+	PartitionDetachAfter int           `yaml:"partitionDetachAfter" toml:"partitionDetachAfter" env:"PARTITION_DETACH_AFTER"`
+	PartitionInterval    time.Duration `yaml:"partitionInterval" toml:"partitionInterval" env:"PARTITION_INTERVAL"`
+
+	// DevMode enables the test-data routes and anonymous login
+	DevMode     bool   `yaml:"devMode" toml:"devMode" env:"DEV_MODE"`
+	AdminSecret string `yaml:"adminSecret" toml:"adminSecret" env:"ADMIN_SECRET" secret:"true"`
+
+	// MasterKeys wrap the field encryption data keys, "id:base64,..." with
+	// the active key first. BlindIndexKey keys the lookup hashes.
+	MasterKeys    string `yaml:"masterKeys" toml:"masterKeys" env:"MASTER_KEYS" secret:"true"`
+	BlindIndexKey string `yaml:"blindIndexKey" toml:"blindIndexKey" env:"BLIND_INDEX_KEY" secret:"true"`
+	// EncryptInterval is how often values written in clear, by instances of
+	// an older version during a rolling deploy, are looked for and encrypted
+	EncryptInterval time.Duration `yaml:"encryptInterval" toml:"encryptInterval" env:"ENCRYPT_INTERVAL"`
+
+	// PDFFont and PDFFontBold are TrueType fonts with Thai glyphs for the
+	// PDF slips. When unset, an installed TLWG font is used if found.
+	PDFFont     string `yaml:"pdfFont" toml:"pdfFont" env:"PDF_FONT"`
+	PDFFontBold string `yaml:"pdfFontBold" toml:"pdfFontBold" env:"PDF_FONT_BOLD"`
+
+	// SMTP* configure the email notifications. SMTPFake replaces the relay
+	// with an in-process server that only logs the emails (dev mode only).
+	SMTPHost     string `yaml:"smtpHost" toml:"smtpHost" env:"SMTP_HOST"`
+	SMTPPort     string `yaml:"smtpPort" toml:"smtpPort" env:"SMTP_PORT"`
+	SMTPUser     string `yaml:"smtpUser" toml:"smtpUser" env:"SMTP_USER"`
+	SMTPPassword string `yaml:"smtpPassword" toml:"smtpPassword" env:"SMTP_PASSWORD" secret:"true"`
+	SMTPFrom     string `yaml:"smtpFrom" toml:"smtpFrom" env:"SMTP_FROM"`
+	SMTPFake     bool   `yaml:"smtpFake" toml:"smtpFake" env:"SMTP_FAKE"`
+
+	// SMSGatewayURL receives {"to", "message"} posts for SMS notifications
+	SMSGatewayURL   string `yaml:"smsGatewayUrl" toml:"smsGatewayUrl" env:"SMS_GATEWAY_URL"`
+	SMSGatewayToken string `yaml:"smsGatewayToken" toml:"smsGatewayToken" env:"SMS_GATEWAY_TOKEN" secret:"true"`
+
+	// SlipProviderURL is the slip verification service asked about transfers
+	// that were not recorded from bank callbacks, see HTTPSlipProvider
+	SlipProviderURL   string `yaml:"slipProviderUrl" toml:"slipProviderUrl" env:"SLIP_PROVIDER_URL"`
+	SlipProviderToken string `yaml:"slipProviderToken" toml:"slipProviderToken" env:"SLIP_PROVIDER_TOKEN" secret:"true"`
+
+	// NotifyFile, when set, receives every notification as a JSON line
+	// instead of the real channels; "-" is stdout. NotifyRateLimit caps the
+	// notifications per merchant and minute, 0 for no limit.
+	NotifyFile      string `yaml:"notifyFile" toml:"notifyFile" env:"NOTIFY_FILE"`
+	NotifyRateLimit int    `yaml:"notifyRateLimit" toml:"notifyRateLimit" env:"NOTIFY_RATE_LIMIT"`
+	NotifyRetries   int    `yaml:"notifyRetries" toml:"notifyRetries" env:"NOTIFY_RETRIES"`
+}
+
+// DefaultConfig returns the built-in defaults
+func DefaultConfig() *Config {
+	return &Config{
+		DBHost:              "localhost",
+		DBPort:              "5432",
+		ServerPort:          "3456",
+		DBSSLMode:           "disable",
+		DBTimeZone:          "Asia/Bangkok",
+		DBMaxOpenConns:      20,
+		DBMaxIdleConns:      5,
+		DBConnMaxLifetime:   30 * time.Minute,
+		DBConnMaxIdleTime:   5 * time.Minute,
+		ShutdownTimeout:     30 * time.Second,
+		ReadinessTimeout:    2 * time.Second,
+		ReadinessCacheTTL:   2 * time.Second,
+		ExpiryInterval:      time.Minute,
+		BillingInterval:     time.Minute,
+		ReportInterval:      time.Minute,
+		ExportDir:           "exports",
+		ExportTTL:           24 * time.Hour,
+		ExportInterval:      10 * time.Second,
+		RetentionArchive:    ArchiveTable,
+		RetentionArchiveDir: "archive",
+		RetentionInterval:   24 * time.Hour,
+		PartitionPremake:    3,
+		PartitionInterval:   time.Hour,
+		EncryptInterval:     10 * time.Minute,
+		SMTPPort:            "587",
+		NotifyRateLimit:     60,
+		NotifyRetries:       3,
+		LogLevel:            "info",
+		LogSampleRate:       1,
+		DBSlowQuery:         200 * time.Millisecond,
+		TraceExporter:       "none",
+		TraceFile:           "traces.json",
+		TraceSampleRatio:    1,
+		ServiceName:         "qr-generator",
+	}
+}
+
+// LoadConfigFile layers defaults, the given file (if any) and the
+// environment, then validates the result. The config is returned together
+// with the validation errors so it can still be inspected.
+func LoadConfigFile(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	var fileErr error
+	if path != "" {
+		fileErr = cfg.loadFile(path)
+	}
+	envErr := cfg.loadEnv(os.LookupEnv)
+
+	return cfg, errors.Join(fileErr, envErr, cfg.Validate())
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config file: unsupported format %q, use .yaml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadEnv applies every env variable named by an env tag, or its _FILE
+// variant. All problems are reported together.
+func (cfg *Config) loadEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		value, ok := lookup(name)
+		if file, fromFile := lookup(name + "_FILE"); fromFile {
+			if ok {
+				errs = append(errs, fmt.Errorf("%s and %s_FILE are both set", name, name))
+				continue
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s_FILE: %v", name, err))
+				continue
+			}
+			value, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		field.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported config type %s", field.Type())
+	}
+	return nil
+}
+
+// baselineJWTSecret was the built-in JWT secret of earlier versions. It is
+// public, so tokens signed with it prove nothing.
+const baselineJWTSecret = "3ab92c27e5d24fe682e73b3a9d9c2a62"
+
+var validSSLModes = map[string]bool{
+	"disable": true, "allow": true, "prefer": true,
+	"require": true, "verify-ca": true, "verify-full": true,
+}
+
+// Validate checks the whole config and returns every problem found
+func (cfg *Config) Validate() error {
+	var errs []error
+	required := func(value, name string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	port := func(value, name string) {
+		if value == "" {
+			return
+		}
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			errs = append(errs, fmt.Errorf("%s must be a port number, got %q", name, value))
+		}
+	}
+
+	required(cfg.DBHost, "DB_HOST")
+	required(cfg.DBName, "DB_NAME")
+	required(cfg.DBUser, "DB_USER")
+	required(cfg.DBPort, "DB_PORT")
+	required(cfg.ServerPort, "SERVER_PORT")
+	port(cfg.DBPort, "DB_PORT")
+	port(cfg.ServerPort, "SERVER_PORT")
+	port(cfg.MetricsPort, "METRICS_PORT")
+	if cfg.MetricsPort != "" && cfg.MetricsPort == cfg.ServerPort {
+		errs = append(errs, errors.New("METRICS_PORT must differ from SERVER_PORT"))
+	}
+
+	if !validSSLModes[cfg.DBSSLMode] {
+		errs = append(errs, fmt.Errorf("DB_SSLMODE %q is not a valid sslmode", cfg.DBSSLMode))
+	}
+	if _, err := time.LoadLocation(cfg.DBTimeZone); err != nil {
+		errs = append(errs, fmt.Errorf("DB_TIMEZONE %q: %v", cfg.DBTimeZone, err))
+	}
+	if cfg.DBMaxOpenConns < 0 || cfg.DBMaxIdleConns < 0 {
+		errs = append(errs, errors.New("DB_MAX_OPEN_CONNS and DB_MAX_IDLE_CONNS must not be negative"))
+	}
+	if cfg.DBMaxOpenConns > 0 && cfg.DBMaxIdleConns > cfg.DBMaxOpenConns {
+		errs = append(errs, errors.New("DB_MAX_IDLE_CONNS must not exceed DB_MAX_OPEN_CONNS"))
+	}
+	if cfg.DBConnMaxLifetime < 0 || cfg.DBConnMaxIdleTime < 0 {
+		errs = append(errs, errors.New("DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME must not be negative"))
+	}
+
+	if cfg.ShutdownDelay < 0 || cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("SHUTDOWN_DELAY must not be negative and SHUTDOWN_TIMEOUT must be positive"))
+	} else if cfg.ShutdownDelay >= cfg.ShutdownTimeout {
+		errs = append(errs, errors.New("SHUTDOWN_DELAY must be shorter than SHUTDOWN_TIMEOUT"))
+	}
+
+	if cfg.ReadinessTimeout <= 0 || cfg.ReadinessCacheTTL < 0 {
+		errs = append(errs, errors.New("READINESS_TIMEOUT must be positive and READINESS_CACHE_TTL must not be negative"))
+	}
+
+	if cfg.ExpiryInterval <= 0 {
+		errs = append(errs, errors.New("EXPIRY_INTERVAL must be positive"))
+	}
+	if cfg.BillingInterval <= 0 {
+		errs = append(errs, errors.New("BILLING_INTERVAL must be positive"))
+	}
+	if cfg.ReportInterval <= 0 {
+		errs = append(errs, errors.New("REPORT_INTERVAL must be positive"))
+	}
+	required(cfg.ExportDir, "EXPORT_DIR")
+	if cfg.ExportTTL <= 0 || cfg.ExportInterval <= 0 {
+		errs = append(errs, errors.New("EXPORT_TTL and EXPORT_INTERVAL must be positive"))
+	}
+	if _, err := parseRetentionRules(cfg.RetentionRules); err != nil {
+		errs = append(errs, fmt.Errorf("RETENTION_RULES: %w", err))
+	}
+	switch cfg.RetentionArchive {
+	case ArchiveTable:
+	case ArchiveFile:
+		required(cfg.RetentionArchiveDir, "RETENTION_ARCHIVE_DIR")
+	default:
+		errs = append(errs, fmt.Errorf("RETENTION_ARCHIVE %q must be table or file", cfg.RetentionArchive))
+	}
+	if cfg.RetentionInterval <= 0 {
+		errs = append(errs, errors.New("RETENTION_INTERVAL must be positive"))
+	}
+	if cfg.PartitionPremake < 1 || cfg.PartitionDetachAfter < 0 || cfg.PartitionInterval <= 0 {
+		errs = append(errs, errors.New("PARTITION_PREMAKE and PARTITION_INTERVAL must be positive and PARTITION_DETACH_AFTER must not be negative"))
+	}
+	if cfg.EncryptInterval <= 0 {
+		errs = append(errs, errors.New("ENCRYPT_INTERVAL must be positive"))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL %q must be debug, info, warn or error", cfg.LogLevel))
+	}
+	if cfg.LogSampleRate < 0 || cfg.LogSampleRate > 1 {
+		errs = append(errs, errors.New("LOG_SAMPLE_RATE must be between 0 and 1"))
+	}
+	if cfg.DBSlowQuery < 0 {
+		errs = append(errs, errors.New("DB_SLOW_QUERY must not be negative"))
+	}
+
+	switch cfg.TraceExporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		required(cfg.TraceFile, "TRACE_FILE")
+	default:
+		errs = append(errs, fmt.Errorf("TRACE_EXPORTER %q must be none, stdout, file or otlp", cfg.TraceExporter))
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		errs = append(errs, errors.New("TRACE_SAMPLE_RATIO must be between 0 and 1"))
+	}
+
+	if cfg.MasterKeys != "" {
+		if _, _, err := parseMasterKeys(cfg.MasterKeys); err != nil {
+			errs = append(errs, fmt.Errorf("MASTER_KEYS: %v", err))
+		}
+	}
+	if cfg.PDFFontBold != "" && cfg.PDFFont == "" {
+		errs = append(errs, errors.New("PDF_FONT_BOLD requires PDF_FONT"))
+	}
+	for name, path := range map[string]string{"PDF_FONT": cfg.PDFFont, "PDF_FONT_BOLD": cfg.PDFFontBold} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	if cfg.SMTPHost != "" || cfg.SMTPFake {
+		required(cfg.SMTPFrom, "SMTP_FROM")
+	}
+	if cfg.SMTPFake && !cfg.DevMode {
+		errs = append(errs, errors.New("SMTP_FAKE requires DEV_MODE"))
+	}
+	if cfg.NotifyRateLimit < 0 || cfg.NotifyRetries < 0 {
+		errs = append(errs, errors.New("NOTIFY_RATE_LIMIT and NOTIFY_RETRIES must not be negative"))
+	}
+
+	if cfg.JWTSecret == baselineJWTSecret {
+		errs = append(errs, errors.New("JWT_SECRET is the published example secret, generate a new one"))
+	}
+	if !cfg.DevMode {
+		required(cfg.JWTSecret, "JWT_SECRET")
+		required(cfg.MasterKeys, "MASTER_KEYS")
+		required(cfg.BlindIndexKey, "BLIND_INDEX_KEY")
+	}
+
+	return errors.Join(errs...)
+}
+
+// DSN returns the Postgres connection string
+func (cfg *Config) DSN() string {
+	params := []struct{ key, value string }{
+		{"host", cfg.DBHost},
+		{"user", cfg.DBUser},
+		{"password", cfg.DBPassword},
+		{"dbname", cfg.DBName},
+		{"port", cfg.DBPort},
+		{"sslmode", cfg.DBSSLMode},
+		{"TimeZone", cfg.DBTimeZone},
+	}
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.key + "=" + dsnQuote(p.value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// dsnQuote quotes a connection string value the way libpq reads it, so
+// passwords with spaces, quotes or backslashes survive
+func dsnQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// Redacted returns a copy of the config with every secret replaced
+func (cfg *Config) Redacted() *Config {
+	out := *cfg
+	v := reflect.ValueOf(&out).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString("[REDACTED]")
+		}
+	}
+	return &out
+}
+
+// runConfigCommand implements the "config" subcommand
+func runConfigCommand(args []string, cfg *Config, loadErr error, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(stderr, "usage: config print")
+		return 2
+	}
+
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	stdout.Write(out)
+
+	if loadErr != nil {
+		fmt.Fprintf(stderr, "\nconfiguration is invalid:\n%v\n", loadErr)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string
+	}{
+		{"missing host", func(cfg *Config) { cfg.DBHost = " " }, "DB_HOST is required"},
+		{"bad port", func(cfg *Config) { cfg.DBPort = "70000" }, `DB_PORT must be a port number, got "70000"`},
+		{"shared metrics port", func(cfg *Config) { cfg.MetricsPort = cfg.ServerPort }, "METRICS_PORT must differ from SERVER_PORT"},
+		{"bad sslmode", func(cfg *Config) { cfg.DBSSLMode = "maybe" }, `DB_SSLMODE "maybe" is not a valid sslmode`},
+		{"bad retention rules", func(cfg *Config) { cfg.RetentionRules = "paid:shred:30" }, "RETENTION_RULES"},
+		{"no secrets outside dev mode", func(cfg *Config) { cfg.DevMode = false }, "MASTER_KEYS is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.DBName, cfg.DBUser, cfg.DevMode = "qr", "postgres", true
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("default dev config: %v", err)
+			}
+			tt.change(cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigLoadEnvFromFile(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "db_password")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"DB_PASSWORD_FILE":  secret,
+		"DB_MAX_OPEN_CONNS": "7",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg := DefaultConfig()
+	if err := cfg.loadEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DBPassword != "s3cret" || cfg.DBMaxOpenConns != 7 {
+		t.Errorf("DBPassword = %q, DBMaxOpenConns = %d", cfg.DBPassword, cfg.DBMaxOpenConns)
+	}
+
+	env["DB_PASSWORD"] = "other"
+	env["JWT_SECRET_FILE"] = filepath.Join(dir, "missing")
+	err := DefaultConfig().loadEnv(lookup)
+	for _, want := range []string{"DB_PASSWORD and DB_PASSWORD_FILE are both set", "JWT_SECRET_FILE:"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadEnv() = %v, want an error containing %q", err, want)
+		}
+	}
+}
+
+func TestConfigDSN(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DBUser = "app user"
+	cfg.DBPassword = `p a'ss\word=`
+	cfg.DBName = "qr"
+
+	want := `host='localhost' user='app user' password='p a\'ss\\word=' dbname='qr' port='5432' sslmode='disable' TimeZone='Asia/Bangkok'`
+	if got := cfg.DSN(); got != want {
+		t.Errorf("DSN() = %s, want %s", got, want)
+	}
+
+	parsed, err := pgconn.ParseConfig(cfg.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.User != cfg.DBUser || parsed.Password != cfg.DBPassword || parsed.Database != cfg.DBName {
+		t.Errorf("parsed user %q, password %q, database %q", parsed.User, parsed.Password, parsed.Database)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DataKey is a data encryption key stored wrapped by a master key. Fields are
+// encrypted with the newest data key; older keys stay around for decryption.
+type DataKey struct {
+	ID          string `gorm:"primaryKey"`
+	MasterKeyID string
+	WrappedKey  string
+	CreatedAt   int64
+}
+
+// FieldCipher encrypts sensitive columns with envelope encryption and computes
+// blind indexes for looking them up
+type FieldCipher struct {
+	db            *gorm.DB
+	mu            sync.RWMutex
+	masterKeys    map[string][]byte
+	activeMaster  string
+	dataKeys      map[string][]byte
+	activeDataKey string
+	indexKey      []byte
+}
+
+// fieldCipher is used by EncryptedString when reading and writing rows
+var fieldCipher *FieldCipher
+
+const encryptedPrefix = "enc:v1:"
+
+// devMasterKey is only used when DEV_MODE is on and no keys are configured
+const devMasterKey = "dev:ZGV2LW1hc3Rlci1rZXktZG8tbm90LXVzZS1pbi1wcm9k"
+
+// parseMasterKeys reads "id:base64key,id2:base64key2". The first key is the
+// active one used to wrap new data keys.
+func parseMasterKeys(spec string) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	active := ""
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(part, ":")
+		if !ok || id == "" {
+			return nil, "", fmt.Errorf("master key %q must be in the form id:base64key", part)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("master key %s: %v", id, err)
+		}
+		// Any length is accepted; the AES key is derived with SHA-256
+		sum := sha256.Sum256(key)
+		keys[id] = sum[:]
+		if active == "" {
+			active = id
+		}
+	}
+	if active == "" {
+		return nil, "", errors.New("no master key configured")
+	}
+	return keys, active, nil
+}
+
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAESGCM(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// setupFieldEncryption builds the FieldCipher from the configured keys, makes
+// sure an active data key exists and encrypts rows written before encryption
+func setupFieldEncryption(cfg *Config, db *gorm.DB) error {
+	masterSpec, indexKey := cfg.MasterKeys, cfg.BlindIndexKey
+	if masterSpec == "" && cfg.DevMode {
+		slog.Warn("MASTER_KEYS not set, using the development master key")
+		masterSpec = devMasterKey
+	}
+	if indexKey == "" && cfg.DevMode {
+		indexKey = "dev-blind-index-key"
+	}
+	if indexKey == "" {
+		return errors.New("BLIND_INDEX_KEY is required")
+	}
+
+	masters, active, err := parseMasterKeys(masterSpec)
+	if err != nil {
+		return err
+	}
+	fc := &FieldCipher{
+		db:           db,
+		masterKeys:   masters,
+		activeMaster: active,
+		dataKeys:     make(map[string][]byte),
+		indexKey:     []byte(indexKey),
+	}
+	if err := fc.loadDataKeys(db); err != nil {
+		return err
+	}
+	fieldCipher = fc
+
+	_, err = encryptLegacyRows(context.Background(), db)
+	return err
+}
+
+// loadDataKeys unwraps every stored data key and creates the first one if the
+// table is empty
+func (fc *FieldCipher) loadDataKeys(db *gorm.DB) error {
+	var rows []DataKey
+	if err := db.Order("created_at").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, row := range rows {
+		key, err := fc.unwrapLocked(row)
+		if err != nil {
+			return err
+		}
+		fc.dataKeys[row.ID] = key
+		fc.activeDataKey = row.ID
+	}
+	if fc.activeDataKey != "" {
+		return nil
+	}
+	_, err := fc.newDataKeyLocked(db)
+	return err
+}
+
+// unwrapLocked returns the data key stored in row. fc.mu must be held.
+func (fc *FieldCipher) unwrapLocked(row DataKey) ([]byte, error) {
+	master, ok := fc.masterKeys[row.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("data key %s is wrapped by unknown master key %s", row.ID, row.MasterKeyID)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(row.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := openAESGCM(master, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key %s: %v", row.ID, err)
+	}
+	return key, nil
+}
+
+// newDataKeyLocked creates, stores and activates a new data key. fc.mu must
+// be held.
+func (fc *FieldCipher) newDataKeyLocked(db *gorm.DB) (*DataKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := sealAESGCM(fc.masterKeys[fc.activeMaster], key)
+	if err != nil {
+		return nil, err
+	}
+	row := &DataKey{
+		ID:          uuid.New().String(),
+		MasterKeyID: fc.activeMaster,
+		WrappedKey:  base64.StdEncoding.EncodeToString(wrapped),
+		CreatedAt:   time.Now().UnixNano(),
+	}
+	if err := db.Create(row).Error; err != nil {
+		return nil, err
+	}
+	fc.dataKeys[row.ID] = key
+	fc.activeDataKey = row.ID
+	return row, nil
+}
+
+// Rotate rewraps every data key with the active master key, so retired master
+// keys can be removed from the configuration, and starts a new data key for
+// future writes. The stored rows are rewrapped, not the keys this instance
+// has loaded, so keys created by a rotation on another instance are included.
+func (fc *FieldCipher) Rotate(db *gorm.DB) (*DataKey, int, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	rewrapped := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var rows []DataKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("created_at").Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			key, err := fc.unwrapLocked(row)
+			if err != nil {
+				return err
+			}
+			wrapped, err := sealAESGCM(fc.masterKeys[fc.activeMaster], key)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&DataKey{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"master_key_id": fc.activeMaster,
+				"wrapped_key":   base64.StdEncoding.EncodeToString(wrapped),
+			}).Error; err != nil {
+				return err
+			}
+			fc.dataKeys[row.ID] = key
+			rewrapped++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	row, err := fc.newDataKeyLocked(db)
+	return row, rewrapped, err
+}
+
+// Encrypt returns the stored form of plaintext: enc:v1:<data key id>:<base64>
+func (fc *FieldCipher) Encrypt(plaintext string) (string, error) {
+	fc.mu.RLock()
+	id := fc.activeDataKey
+	key := fc.dataKeys[id]
+	fc.mu.RUnlock()
+
+	sealed, err := sealAESGCM(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt. Values without the prefix are returned unchanged
+// so rows written before encryption stay readable.
+func (fc *FieldCipher) Decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, encryptedPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	key, err := fc.dataKey(id)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openAESGCM(key, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// dataKey returns the data key id. A key this instance has not seen was
+// created by a rotation on another instance, so the keys are reloaded once
+// before giving up.
+func (fc *FieldCipher) dataKey(id string) ([]byte, error) {
+	fc.mu.RLock()
+	key, found := fc.dataKeys[id]
+	fc.mu.RUnlock()
+	if found {
+		return key, nil
+	}
+
+	var row DataKey
+	err := fc.db.Where("id = ?", id).Limit(1).Find(&row).Error
+	if err != nil {
+		return nil, err
+	}
+	if row.ID == "" {
+		return nil, fmt.Errorf("unknown data key %s", id)
+	}
+	if err := fc.loadDataKeys(fc.db); err != nil {
+		return nil, err
+	}
+
+	fc.mu.RLock()
+	key, found = fc.dataKeys[id]
+	fc.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown data key %s", id)
+	}
+	return key, nil
+}
+
+// BlindIndex returns a keyed hash of value that can be searched for equality
+// without revealing it
+func (fc *FieldCipher) BlindIndex(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, fc.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rotateKeysHandler handles POST /admin/keys/rotate
+func rotateKeysHandler(db *gorm.DB) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		row, rewrapped, err := fieldCipher.Rotate(db)
+		if err != nil {
+			return internalError(err)
+		}
+		return c.JSON(fiber.Map{
+			"activeDataKey": row.ID,
+			"masterKeyId":   row.MasterKeyID,
+			"rewrapped":     rewrapped,
+		})
+	}
+}
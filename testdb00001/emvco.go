@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/howeyc/crc16"
+)
+
+// Payment schemes of generated payloads. QRRequests without a scheme are
+// Thai PromptPay bill payments.
+const (
+	SchemePromptPay = "promptpay"
+	// SchemePayNow is Singapore PayNow, paid to a mobile number or UEN
+	SchemePayNow = "paynow"
+	// SchemeDuitNow is Malaysia DuitNow
+	SchemeDuitNow = "duitnow"
+	// SchemeEMVCo is any other EMVCo merchant-presented QR, configured
+	// entirely by the merchant's account
+	SchemeEMVCo = "emvco"
+)
+
+// QRAccount is a merchant's account in a payment scheme, kept in the
+// merchant settings. Which fields apply depends on the scheme.
+type QRAccount struct {
+	// ID is the biller ID (promptpay), proxy value (paynow) or merchant
+	// account ID (duitnow, emvco)
+	ID string `json:"id"`
+	// ProxyType is mobile or uen for PayNow
+	ProxyType string `json:"proxyType,omitempty"`
+	// Participant is the DuitNow participant code of the acquirer
+	Participant string `json:"participant,omitempty"`
+	// AID and Tag (26-51) place the account of the emvco scheme
+	AID string `json:"aid,omitempty"`
+	Tag string `json:"tag,omitempty"`
+	// Currency (ISO 4217 numeric) and Country (ISO 3166 alpha-2) are
+	// required by the emvco scheme, the others have their own
+	Currency     string `json:"currency,omitempty"`
+	Country      string `json:"country,omitempty"`
+	MerchantCity string `json:"merchantCity,omitempty"`
+	// MCC is the ISO 18245 merchant category code, 0000 when unset
+	MCC string `json:"mcc,omitempty"`
+}
+
+// QRScheme builds the payloads of one payment scheme
+type QRScheme interface {
+	// Validate reports the invalid fields of acct, named below field
+	Validate(acct QRAccount, field string) []FieldError
+	// Payload returns the payload paying qr to acct, or a validation error
+	// when a field of qr does not fit the scheme
+	Payload(acct QRAccount, qr *QRRequest) (string, error)
+}
+
+// qrSchemes holds every scheme by name
+var qrSchemes = map[string]QRScheme{
+	SchemePromptPay: promptPayScheme{},
+	SchemePayNow:    payNowScheme{},
+	SchemeDuitNow:   duitNowScheme{},
+	SchemeEMVCo:     emvcoScheme{},
+}
+
+// EMVCo limits of the fields QR requests fill in, in bytes. A field never
+// holds more than maxQRFieldLength, its length has two digits.
+const (
+	maxQRFieldLength   = 99
+	maxMerchantCity    = 15
+	maxAdditionalField = 25
+	// maxPromptPayReference is the BOT limit of the bill payment references
+	maxPromptPayReference = 20
+)
+
+// qrField is a sub-field of a template. name is the QRRequest field value
+// comes from, used in errors; empty for fields of the merchant's account.
+type qrField struct {
+	tag   string
+	value string
+	name  string
+	max   int
+}
+
+// merchantPresentedQR holds the top-level fields of an EMVCo QRCPS-MPM
+// payload. Empty fields are left out.
+type merchantPresentedQR struct {
+	onetime bool
+	// accountTag (26-51) holds the account template, the merchant account
+	// information
+	accountTag string
+	account    []qrField
+	mcc        string
+	currency   string
+	amount     float64
+	country    string
+	name       string
+	city       string
+	// additional is the template of tag 62
+	additional []qrField
+}
+
+// encode returns the payload, or a validation error naming the fields of
+// the QR request that are too long
+func (p merchantPresentedQR) encode() (string, error) {
+	var errs []FieldError
+	tooLong := func(name string, max int) {
+		if name == "" {
+			name = "scheme"
+		}
+		errs = append(errs, FieldError{Field: name, Code: ErrCodeFieldInvalid, Detail: fmt.Sprintf("at most %d bytes in this scheme", max)})
+	}
+	checked := func(name, value string, max int) string {
+		if max == 0 || max > maxQRFieldLength {
+			max = maxQRFieldLength
+		}
+		if len(value) > max {
+			tooLong(name, max)
+		}
+		return value
+	}
+	template := func(name string, fields []qrField) string {
+		var b strings.Builder
+		for _, f := range fields {
+			b.WriteString(formatQRField(f.tag, checked(f.name, f.value, f.max)))
+		}
+		if b.Len() > maxQRFieldLength {
+			tooLong(name, maxQRFieldLength)
+		}
+		return b.String()
+	}
+
+	initiation := "11"
+	if p.onetime {
+		initiation = "12"
+	}
+	account := template("", p.account)
+	additional := template("references", p.additional)
+	name := checked("merchantName", p.name, maxMerchantNameLength)
+	city := checked("", p.city, maxMerchantCity)
+	if len(errs) > 0 {
+		return "", validationError(errs...)
+	}
+
+	data := formatQRField("00", "01") +
+		formatQRField("01", initiation) +
+		formatQRField(p.accountTag, account) +
+		formatQRField("52", p.mcc) +
+		formatQRField("53", p.currency) +
+		formatReceiverIDForQR(fmt.Sprintf("%.2f", p.amount)) +
+		formatQRField("58", p.country) +
+		formatQRField("59", name) +
+		formatQRField("60", city) +
+		formatQRField("62", additional) +
+		"6304"
+	// Always 4 digits, readers reject a shorter checksum
+	return data + fmt.Sprintf("%04X", crc16.ChecksumCCITTFalse([]byte(data))), nil
+}
+
+var (
+	digitsPattern   = regexp.MustCompile(`^[0-9]+$`)
+	aidPattern      = regexp.MustCompile(`^[0-9A-F]{10,32}$`)
+	payNowMobile    = regexp.MustCompile(`^\+65[689][0-9]{7}$`)
+	payNowUEN       = regexp.MustCompile(`^[0-9]{8,9}[A-Z]$|^[STR][0-9]{2}[A-Z]{2}[0-9]{4}[A-Z]$`)
+	participantCode = regexp.MustCompile(`^[0-9A-Z]{6,11}$`)
+	countryPattern  = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// fieldCheck collects the field errors of a QRAccount
+type fieldCheck struct {
+	prefix string
+	errs   []FieldError
+}
+
+func (f *fieldCheck) require(name, value string) bool {
+	if value == "" {
+		f.errs = append(f.errs, FieldError{Field: f.prefix + "." + name, Code: ErrCodeFieldRequired})
+		return false
+	}
+	return true
+}
+
+func (f *fieldCheck) match(name, value string, re *regexp.Regexp, detail string) {
+	if value != "" && !re.MatchString(value) {
+		f.errs = append(f.errs, FieldError{Field: f.prefix + "." + name, Code: ErrCodeFieldInvalid, Detail: detail})
+	}
+}
+
+func (f *fieldCheck) maxLength(name, value string, n int) {
+	if len(value) > n {
+		f.errs = append(f.errs, FieldError{Field: f.prefix + "." + name, Code: ErrCodeFieldInvalid, Detail: fmt.Sprintf("at most %d characters", n)})
+	}
+}
+
+// checkMCC allows an unset MCC, which is encoded as 0000
+func (f *fieldCheck) checkMCC(mcc string) {
+	if mcc != "" && (len(mcc) != 4 || !digitsPattern.MatchString(mcc)) {
+		f.errs = append(f.errs, FieldError{Field: f.prefix + ".mcc", Code: ErrCodeFieldInvalid, Detail: "4 digits"})
+	}
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// promptPayScheme is the Thai PromptPay bill payment (BOT Tag 30)
+type promptPayScheme struct{}
+
+func (promptPayScheme) Validate(acct QRAccount, field string) []FieldError {
+	f := fieldCheck{prefix: field}
+	// Tag 30 sub-tag 00 carries the biller ID, which is always 15 digits
+	if f.require("id", acct.ID) && (len(acct.ID) != 15 || !digitsPattern.MatchString(acct.ID)) {
+		f.errs = append(f.errs, FieldError{Field: field + ".id", Code: ErrCodeFieldInvalid, Detail: "the 15-digit biller ID"})
+	}
+	return f.errs
+}
+
+func (promptPayScheme) Payload(acct QRAccount, qr *QRRequest) (string, error) {
+	return merchantPresentedQR{
+		onetime:    qr.Onetime,
+		accountTag: "30",
+		account: []qrField{
+			{tag: "00", value: "A000000677010112"},
+			{tag: "01", value: acct.ID},
+			{tag: "02", value: strings.ToUpper(qr.Reference1), name: "reference1", max: maxPromptPayReference},
+			{tag: "03", value: strings.ToUpper(qr.Reference2), name: "reference2", max: maxPromptPayReference},
+		},
+		currency: "764",
+		amount:   qr.Amount,
+		country:  "TH",
+		name:     qr.MerchantName,
+	}.encode()
+}
+
+// payNowScheme is Singapore PayNow. The amount is fixed and the QR stops
+// being payable at Expire, in Singapore time.
+type payNowScheme struct{}
+
+var singaporeTime = time.FixedZone("SGT", 8*60*60)
+
+func (payNowScheme) Validate(acct QRAccount, field string) []FieldError {
+	f := fieldCheck{prefix: field}
+	switch acct.ProxyType {
+	case "mobile":
+		f.match("id", acct.ID, payNowMobile, "a Singapore mobile number, e.g. +6591234567")
+	case "uen":
+		f.match("id", acct.ID, payNowUEN, "a UEN, e.g. 201403121W")
+	default:
+		f.errs = append(f.errs, FieldError{Field: field + ".proxyType", Code: ErrCodeFieldInvalid, Detail: "mobile or uen"})
+	}
+	f.require("id", acct.ID)
+	f.checkMCC(acct.MCC)
+	return f.errs
+}
+
+func (payNowScheme) Payload(acct QRAccount, qr *QRRequest) (string, error) {
+	proxyType := "0"
+	if acct.ProxyType == "uen" {
+		proxyType = "2"
+	}
+	account := []qrField{
+		{tag: "00", value: "SG.PAYNOW"},
+		{tag: "01", value: proxyType},
+		{tag: "02", value: acct.ID},
+		{tag: "03", value: "0"},
+	}
+	if qr.Expire > 0 {
+		account = append(account, qrField{tag: "04", value: time.Unix(qr.Expire, 0).In(singaporeTime).Format("20060102")})
+	}
+	return merchantPresentedQR{
+		onetime:    qr.Onetime,
+		accountTag: "26",
+		account:    account,
+		mcc:        orDefault(acct.MCC, "0000"),
+		currency:   "702",
+		amount:     qr.Amount,
+		country:    "SG",
+		name:       qr.MerchantName,
+		city:       orDefault(acct.MerchantCity, "Singapore"),
+		additional: []qrField{
+			{tag: "01", value: qr.Reference1, name: "reference1", max: maxAdditionalField},
+		},
+	}.encode()
+}
+
+// duitNowScheme is Malaysia DuitNow, with Reference1 as the bill number and
+// Reference2 as the reference label
+type duitNowScheme struct{}
+
+func (duitNowScheme) Validate(acct QRAccount, field string) []FieldError {
+	f := fieldCheck{prefix: field}
+	if f.require("participant", acct.Participant) {
+		f.match("participant", acct.Participant, participantCode, "the participant's BIC or 6-digit code")
+	}
+	if f.require("id", acct.ID) {
+		f.match("id", acct.ID, digitsPattern, "digits only")
+		f.maxLength("id", acct.ID, 25)
+	}
+	f.checkMCC(acct.MCC)
+	return f.errs
+}
+
+func (duitNowScheme) Payload(acct QRAccount, qr *QRRequest) (string, error) {
+	return merchantPresentedQR{
+		onetime:    qr.Onetime,
+		accountTag: "26",
+		account: []qrField{
+			{tag: "00", value: "A0000006150001"},
+			{tag: "01", value: acct.Participant},
+			{tag: "02", value: acct.ID},
+		},
+		mcc:      orDefault(acct.MCC, "0000"),
+		currency: "458",
+		amount:   qr.Amount,
+		country:  "MY",
+		name:     qr.MerchantName,
+		city:     orDefault(acct.MerchantCity, "Kuala Lumpur"),
+		additional: []qrField{
+			{tag: "01", value: qr.Reference1, name: "reference1", max: maxAdditionalField},
+			{tag: "05", value: qr.Reference2, name: "reference2", max: maxAdditionalField},
+		},
+	}.encode()
+}
+
+// emvcoScheme is a generic merchant-presented QR whose account template,
+// currency and country all come from the merchant's account
+type emvcoScheme struct{}
+
+func (emvcoScheme) Validate(acct QRAccount, field string) []FieldError {
+	f := fieldCheck{prefix: field}
+	if f.require("aid", acct.AID) {
+		f.match("aid", acct.AID, aidPattern, "5 to 16 bytes in upper-case hex")
+	}
+	if tag, err := strconv.Atoi(orDefault(acct.Tag, "26")); err != nil || tag < 26 || tag > 51 || len(orDefault(acct.Tag, "26")) != 2 {
+		f.errs = append(f.errs, FieldError{Field: field + ".tag", Code: ErrCodeFieldInvalid, Detail: "a merchant account tag from 26 to 51"})
+	}
+	if f.require("id", acct.ID) {
+		f.maxLength("id", acct.ID, 99-len(formatQRField("00", acct.AID))-4)
+	}
+	if f.require("currency", acct.Currency) && (len(acct.Currency) != 3 || !digitsPattern.MatchString(acct.Currency)) {
+		f.errs = append(f.errs, FieldError{Field: field + ".currency", Code: ErrCodeFieldInvalid, Detail: "the ISO 4217 numeric code, e.g. 764"})
+	}
+	if f.require("country", acct.Country) {
+		f.match("country", acct.Country, countryPattern, "the ISO 3166 alpha-2 code, e.g. TH")
+	}
+	if f.require("merchantCity", acct.MerchantCity) {
+		f.maxLength("merchantCity", acct.MerchantCity, 15)
+	}
+	f.checkMCC(acct.MCC)
+	return f.errs
+}
+
+func (emvcoScheme) Payload(acct QRAccount, qr *QRRequest) (string, error) {
+	return merchantPresentedQR{
+		onetime:    qr.Onetime,
+		accountTag: orDefault(acct.Tag, "26"),
+		account: []qrField{
+			{tag: "00", value: acct.AID},
+			{tag: "01", value: acct.ID},
+		},
+		mcc:      orDefault(acct.MCC, "0000"),
+		currency: acct.Currency,
+		amount:   qr.Amount,
+		country:  acct.Country,
+		name:     qr.MerchantName,
+		city:     acct.MerchantCity,
+		additional: []qrField{
+			{tag: "01", value: qr.Reference1, name: "reference1", max: maxAdditionalField},
+			{tag: "05", value: qr.Reference2, name: "reference2", max: maxAdditionalField},
+		},
+	}.encode()
+}
+
+// validateSchemeAccounts reports invalid scheme accounts of merchant's
+// settings. The PromptPay account is a biller ID, so it must be one the
+// merchant is allowed by its admin-set billerIds.
+func validateSchemeAccounts(accounts map[string]QRAccount, merchant *Merchant) error {
+	var fields []FieldError
+	for name, acct := range accounts {
+		field := "settings.schemes." + name
+		scheme, ok := qrSchemes[name]
+		if !ok {
+			fields = append(fields, FieldError{Field: field, Code: ErrCodeFieldInvalid, Detail: "unknown scheme"})
+			continue
+		}
+		fields = append(fields, scheme.Validate(acct, field)...)
+		if name == SchemePromptPay && acct.ID != "" && !merchant.AllowsBiller(acct.ID) {
+			fields = append(fields, FieldError{Field: field + ".id", Code: ErrCodeBillerNotAllowed, Detail: "not one of the merchant's billerIds"})
+		}
+	}
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+// merchantQRAccount returns the merchant's account in scheme. PromptPay
+// falls back to the merchant's first biller ID.
+func merchantQRAccount(merchant *Merchant, scheme string) (QRAccount, bool) {
+	if acct, ok := merchant.Settings.Schemes[scheme]; ok {
+		return acct, true
+	}
+	if ids := merchant.BillerIDList(); scheme == SchemePromptPay && len(ids) > 0 {
+		return QRAccount{ID: ids[0]}, true
+	}
+	return QRAccount{}, false
+}
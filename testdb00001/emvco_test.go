@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/howeyc/crc16"
+)
+
+// Golden payloads per scheme. Their tag-length-value structure and CRC were
+// checked independently of this package.
+var schemeVectors = []struct {
+	name   string
+	scheme QRScheme
+	acct   QRAccount
+	qr     QRRequest
+	want   string
+}{
+	{
+		name:   "promptpay bill payment",
+		scheme: promptPayScheme{},
+		acct:   QRAccount{ID: "010753600010286"},
+		qr:     QRRequest{MerchantName: "ENERSYS SHOP", Reference1: "inv0001", Reference2: "cust42", Amount: 1250.5, Onetime: true},
+		want:   "00020101021230600016A00000067701011201150107536000102860207INV00010306CUST42530376454071250.505802TH5912ENERSYS SHOP6304AC19",
+	},
+	{
+		name:   "paynow uen with expiry",
+		scheme: payNowScheme{},
+		acct:   QRAccount{ID: "201403121W", ProxyType: "uen"},
+		// 2025-12-31 23:59:59 UTC is 1 January in Singapore
+		qr:   QRRequest{MerchantName: "ENERSYS SG", Reference1: "INV0001", Amount: 12.3, Onetime: true, Expire: 1767225599},
+		want: "00020101021226490009SG.PAYNOW010120210201403121W03010040820260101520400005303702540512.305802SG5910ENERSYS SG6009Singapore62110107INV00016304D93A",
+	},
+	{
+		name:   "duitnow",
+		scheme: duitNowScheme{},
+		acct:   QRAccount{ID: "1234567890", Participant: "MBBEMYKL"},
+		qr:     QRRequest{MerchantName: "ENERSYS MY", Reference1: "INV0001", Reference2: "REF42", Amount: 99.9},
+		want:   "00020101021126440014A00000061500010108MBBEMYKL02101234567890520400005303458540599.905802MY5910ENERSYS MY6012Kuala Lumpur62200107INV00010505REF426304894D",
+	},
+	{
+		name:   "generic emvco",
+		scheme: emvcoScheme{},
+		acct:   QRAccount{AID: "A000000727", Tag: "38", ID: "970436123456789", Currency: "704", Country: "VN", MerchantCity: "HANOI", MCC: "5411"},
+		qr:     QRRequest{MerchantName: "ENERSYS VN", Reference1: "INV0001", Amount: 50000},
+		want:   "00020101021138330010A0000007270115970436123456789520454115303704540850000.005802VN5910ENERSYS VN6005HANOI62110107INV000163048B99",
+	},
+}
+
+func TestSchemePayloads(t *testing.T) {
+	for _, v := range schemeVectors {
+		t.Run(v.name, func(t *testing.T) {
+			if fields := v.scheme.Validate(v.acct, "account"); len(fields) > 0 {
+				t.Fatalf("account rejected: %+v", fields)
+			}
+			got, err := v.scheme.Payload(v.acct, &v.qr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != v.want {
+				t.Fatalf("payload\n got %s\nwant %s", got, v.want)
+			}
+			if err := checkCRC(got); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCRCCheckValue(t *testing.T) {
+	// The CRC-16/CCITT-FALSE check value of "123456789"
+	if got := crc16.ChecksumCCITTFalse([]byte("123456789")); got != 0x29B1 {
+		t.Fatalf("got %04X, want 29B1", got)
+	}
+}
+
+func TestSchemePayloadsRejectLongFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme QRScheme
+		acct   QRAccount
+		qr     QRRequest
+		field  string
+	}{
+		{"merchant name", promptPayScheme{}, schemeVectors[0].acct, QRRequest{MerchantName: strings.Repeat("A", 26), Amount: 1}, "merchantName"},
+		{"thai merchant name in bytes", promptPayScheme{}, schemeVectors[0].acct, QRRequest{MerchantName: "ร้านค้าทดสอบ", Amount: 1}, "merchantName"},
+		{"promptpay reference1", promptPayScheme{}, schemeVectors[0].acct, QRRequest{Reference1: strings.Repeat("1", 21), Amount: 1}, "reference1"},
+		{"promptpay reference2", promptPayScheme{}, schemeVectors[0].acct, QRRequest{Reference2: strings.Repeat("1", 21), Amount: 1}, "reference2"},
+		{"paynow reference", payNowScheme{}, schemeVectors[1].acct, QRRequest{Reference1: strings.Repeat("1", 26), Amount: 1}, "reference1"},
+		{"duitnow reference2", duitNowScheme{}, schemeVectors[2].acct, QRRequest{Reference2: strings.Repeat("1", 26), Amount: 1}, "reference2"},
+		{"emvco 100 byte reference", emvcoScheme{}, schemeVectors[3].acct, QRRequest{Reference1: strings.Repeat("1", 100), Amount: 1}, "reference1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := tt.scheme.Payload(tt.acct, &tt.qr)
+			var appErr *AppError
+			if !errors.As(err, &appErr) || appErr.Code != ErrCodeValidation {
+				t.Fatalf("want a validation error, got %q, %v", payload, err)
+			}
+			found := false
+			for _, f := range appErr.Fields {
+				found = found || f.Field == tt.field
+			}
+			if !found {
+				t.Fatalf("no error on %s: %+v", tt.field, appErr.Fields)
+			}
+		})
+	}
+}
+
+func TestSandboxPayloadIsNotPayable(t *testing.T) {
+	live := schemeVectors[0].want
+	sandbox := markSandboxPayload(live)
+	if err := checkCRC(sandbox); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sandbox, "A000000677010112") || !strings.Contains(sandbox, sandboxAID) {
+		t.Fatalf("sandbox payload keeps the PromptPay AID: %s", sandbox)
+	}
+	if !strings.Contains(sandbox, "59"+"17"+sandboxNamePrefix+"ENERSYS SHOP") {
+		t.Fatalf("sandbox payload without the TEST name: %s", sandbox)
+	}
+}
+
+func TestPromptPayAccountValidation(t *testing.T) {
+	merchant := &Merchant{BillerIDs: "010753600010286"}
+	tests := []struct {
+		name string
+		id   string
+		code string
+	}{
+		{"allowed biller", "010753600010286", ""},
+		{"14 digits", "01075360001028", ErrCodeFieldInvalid},
+		{"16 digits", "0107536000102861", ErrCodeFieldInvalid},
+		{"not digits", "01075360001028A", ErrCodeFieldInvalid},
+		{"other merchant's biller", "099400016550100", ErrCodeBillerNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSchemeAccounts(map[string]QRAccount{SchemePromptPay: {ID: tt.id}}, merchant)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var appErr *AppError
+			if !errors.As(err, &appErr) || len(appErr.Fields) == 0 || appErr.Fields[0].Code != tt.code {
+				t.Fatalf("want %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
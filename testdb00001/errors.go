@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Stable machine-readable codes returned in the "code" member of every error
+// response. Clients match on these, so never change an existing one.
+const (
+	ErrCodeInternal            = "INTERNAL_ERROR"
+	ErrCodeBadRequest          = "BAD_REQUEST"
+	ErrCodeValidation          = "VALIDATION_FAILED"
+	ErrCodeNotFound            = "NOT_FOUND"
+	ErrCodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	ErrCodePayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	ErrCodeUnauthorized        = "UNAUTHORIZED"
+	ErrCodeTokenInvalid        = "TOKEN_INVALID"
+	ErrCodeTokenNoMerchant     = "TOKEN_NO_MERCHANT"
+	ErrCodeAPIKeyInvalid       = "API_KEY_INVALID"
+	ErrCodeAdminSecretInvalid  = "ADMIN_SECRET_INVALID"
+	ErrCodeCredentialsRequired = "CREDENTIALS_REQUIRED"
+
+	ErrCodeFieldRequired   = "FIELD_REQUIRED"
+	ErrCodeFieldInvalid    = "FIELD_INVALID"
+	ErrCodeAmountInvalid   = "AMOUNT_INVALID"
+	ErrCodeAmountPrecision = "AMOUNT_PRECISION"
+	ErrCodeRoleInvalid     = "ROLE_INVALID"
+
+	ErrCodeQRNotFound       = "QR_NOT_FOUND"
+	ErrCodeQRNotPending     = "QR_NOT_PENDING"
+	ErrCodeQROnHold         = "QR_ON_LEGAL_HOLD"
+	ErrCodeMerchantNotFound = "MERCHANT_NOT_FOUND"
+	ErrCodeBillerNotAllowed = "BILLER_NOT_ALLOWED"
+	ErrCodeAPIKeyNotFound   = "API_KEY_NOT_FOUND"
+
+	ErrCodeSlipRequired       = "SLIP_REQUIRED"
+	ErrCodeSlipUnreadable     = "SLIP_UNREADABLE"
+	ErrCodeSlipInvalid        = "SLIP_INVALID"
+	ErrCodeSlipDuplicate      = "SLIP_DUPLICATE"
+	ErrCodeSlipNotFound       = "SLIP_NOT_FOUND"
+	ErrCodeSlipAmountMismatch = "SLIP_AMOUNT_MISMATCH"
+	// ErrCodeSlipReceiverMismatch means the transfer went to an account that
+	// is not the merchant's
+	ErrCodeSlipReceiverMismatch = "SLIP_RECEIVER_MISMATCH"
+	ErrCodeBankUnavailable      = "BANK_PROVIDER_UNAVAILABLE"
+)
+
+// errorMessages holds the human-readable title of every code per language
+var errorMessages = map[string]map[string]string{
+	ErrCodeInternal:            {"en": "An unexpected error occurred", "th": "เกิดข้อผิดพลาดที่ไม่คาดคิด"},
+	ErrCodeBadRequest:          {"en": "The request could not be read", "th": "ไม่สามารถอ่านคำขอได้"},
+	ErrCodeValidation:          {"en": "The request contains invalid fields", "th": "คำขอมีข้อมูลไม่ถูกต้อง"},
+	ErrCodeNotFound:            {"en": "The requested resource does not exist", "th": "ไม่พบข้อมูลที่ร้องขอ"},
+	ErrCodeMethodNotAllowed:    {"en": "The method is not allowed for this resource", "th": "ไม่อนุญาตให้ใช้เมธอดนี้"},
+	ErrCodePayloadTooLarge:     {"en": "The request body is too large", "th": "ข้อมูลคำขอมีขนาดใหญ่เกินไป"},
+	ErrCodeUnauthorized:        {"en": "Authentication is required", "th": "ต้องยืนยันตัวตนก่อน"},
+	ErrCodeTokenInvalid:        {"en": "The token is invalid or has expired", "th": "โทเคนไม่ถูกต้องหรือหมดอายุ"},
+	ErrCodeTokenNoMerchant:     {"en": "The token is not bound to a merchant", "th": "โทเคนไม่ได้ผูกกับร้านค้า"},
+	ErrCodeAPIKeyInvalid:       {"en": "The API key is invalid or revoked", "th": "API key ไม่ถูกต้องหรือถูกยกเลิกแล้ว"},
+	ErrCodeAdminSecretInvalid:  {"en": "The admin secret is invalid", "th": "รหัสผู้ดูแลระบบไม่ถูกต้อง"},
+	ErrCodeCredentialsRequired: {"en": "An API key or admin secret is required", "th": "ต้องระบุ API key หรือรหัสผู้ดูแลระบบ"},
+	ErrCodePermissionDenied:    {"en": "You do not have permission to do this", "th": "คุณไม่มีสิทธิ์ดำเนินการนี้"},
+
+	ErrCodeFieldRequired:   {"en": "This field is required", "th": "ต้องระบุข้อมูลนี้"},
+	ErrCodeFieldInvalid:    {"en": "This field is invalid", "th": "ข้อมูลนี้ไม่ถูกต้อง"},
+	ErrCodeAmountInvalid:   {"en": "Amount must be greater than 0 and at most 2,000,000,000,000,000", "th": "จำนวนเงินต้องมากกว่า 0 และไม่เกิน 2,000,000,000,000,000"},
+	ErrCodeAmountPrecision: {"en": "Amount must have at most two decimal places", "th": "จำนวนเงินต้องมีทศนิยมไม่เกินสองตำแหน่ง"},
+	ErrCodeRoleInvalid:     {"en": "Unknown role", "th": "ไม่รู้จักบทบาทนี้"},
+
+	ErrCodeQRNotFound:       {"en": "QR request not found", "th": "ไม่พบรายการ QR"},
+	ErrCodeQRNotPending:     {"en": "The QR request is no longer pending", "th": "รายการ QR นี้ไม่อยู่ในสถานะรอชำระแล้ว"},
+	ErrCodeQROnHold:         {"en": "The QR request is already on legal hold", "th": "รายการ QR นี้ถูกระงับตามกฎหมายอยู่แล้ว"},
+	ErrCodeMerchantNotFound: {"en": "Merchant not found", "th": "ไม่พบร้านค้า"},
+	ErrCodeBillerNotAllowed: {"en": "The biller ID does not belong to the merchant", "th": "Biller ID นี้ไม่ใช่ของร้านค้า"},
+	ErrCodeAPIKeyNotFound:   {"en": "API key not found", "th": "ไม่พบ API key"},
+	ErrCodeQRSandbox:        {"en": "Sandbox QR requests cannot be paid with real slips", "th": "QR ทดสอบไม่สามารถชำระด้วยสลิปจริงได้"},
+	ErrCodeQRNotSandbox:     {"en": "Only sandbox QR requests can be paid by simulation", "th": "จำลองการชำระเงินได้เฉพาะ QR ทดสอบเท่านั้น"},
+	ErrCodeInvoiceNotFound:  {"en": "Invoice not found", "th": "ไม่พบใบแจ้งหนี้"},
+	ErrCodeInvoiceNotDraft:  {"en": "The invoice has already been issued", "th": "ใบแจ้งหนี้นี้ออกไปแล้ว"},
+	ErrCodeDiscountTooLarge: {"en": "The discount is larger than the amount it applies to", "th": "ส่วนลดมากกว่ายอดที่ใช้ส่วนลด"},
+	ErrCodeQRNotPaid:        {"en": "The QR request has not been paid", "th": "รายการ QR นี้ยังไม่ได้ชำระเงิน"},
+
+	ErrCodeScheduleNotFound:   {"en": "Billing schedule not found", "th": "ไม่พบรอบการเรียกเก็บเงิน"},
+	ErrCodeScheduleNotActive:  {"en": "The billing schedule is no longer active", "th": "รอบการเรียกเก็บเงินนี้ไม่ได้ใช้งานแล้ว"},
+	ErrCodeReferenceExhausted: {"en": "The reference sequence has run out of numbers", "th": "เลขอ้างอิงตามรูปแบบนี้ถูกใช้หมดแล้ว"},
+	ErrCodeExportNotFound:     {"en": "Export not found", "th": "ไม่พบไฟล์ส่งออก"},
+	ErrCodeExportNotReady:     {"en": "The export is not ready yet", "th": "ไฟล์ส่งออกยังไม่พร้อม"},
+	ErrCodeExportExpired:      {"en": "The export has expired", "th": "ไฟล์ส่งออกหมดอายุแล้ว"},
+	ErrCodeExportMissing:      {"en": "The export file is not available on this server", "th": "ไม่พบไฟล์ส่งออกบนเซิร์ฟเวอร์นี้"},
+
+	ErrCodeSlipRequired:         {"en": "qrData or a slip image is required", "th": "ต้องระบุ qrData หรือรูปสลิป"},
+	ErrCodeSlipUnreadable:       {"en": "No QR code could be read from the slip image", "th": "ไม่สามารถอ่าน QR จากรูปสลิปได้"},
+	ErrCodeSlipInvalid:          {"en": "The slip QR code is invalid", "th": "QR บนสลิปไม่ถูกต้อง"},
+	ErrCodeSlipDuplicate:        {"en": "The slip has already been used", "th": "สลิปนี้ถูกใช้ไปแล้ว"},
+	ErrCodeSlipNotFound:         {"en": "The bank has no transaction for this slip", "th": "ไม่พบรายการโอนของสลิปนี้ที่ธนาคาร"},
+	ErrCodeSlipAmountMismatch:   {"en": "The slip amount does not match the requested amount", "th": "ยอดเงินในสลิปไม่ตรงกับยอดที่เรียกเก็บ"},
+	ErrCodeSlipReceiverMismatch: {"en": "The slip was not paid to this merchant", "th": "สลิปนี้ไม่ได้โอนเข้าบัญชีของร้านค้านี้"},
+	ErrCodeBankUnavailable:      {"en": "The bank could not be reached", "th": "ไม่สามารถติดต่อธนาคารได้"},
+}
+
+// supportedLanguages are offered to Accept-Language negotiation, the first
+// one is the fallback
+var supportedLanguages = []string{"en", "th"}
+
+// errorMessage returns the title of code in lang
+func errorMessage(code, lang string) string {
+	if messages, ok := errorMessages[code]; ok {
+		if msg, ok := messages[lang]; ok {
+			return msg
+		}
+		return messages[supportedLanguages[0]]
+	}
+	return code
+}
+
+// AppError is an error meant for the API client. It is rendered as an RFC
+// 7807 problem; the wrapped cause is only logged.
+type AppError struct {
+	Status int
+	Code   string
+	// Detail is an optional English explanation safe to show to clients
+	Detail string
+	Fields []FieldError
+	// Extra holds additional members of the problem document
+	Extra map[string]interface{}
+	Err   error
+}
+
+// FieldError describes one invalid field of a request. Detail is an
+// optional English explanation, e.g. the violated schema rule.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func (e *AppError) Error() string {
+	msg := e.Code
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// newAppError returns an error rendered with status and code
+func newAppError(status int, code string) *AppError {
+	return &AppError{Status: status, Code: code}
+}
+
+// withDetail sets the client-facing detail
+func (e *AppError) withDetail(format string, args ...interface{}) *AppError {
+	e.Detail = fmt.Sprintf(format, args...)
+	return e
+}
+
+// with adds a member to the problem document
+func (e *AppError) with(key string, value interface{}) *AppError {
+	if e.Extra == nil {
+		e.Extra = make(map[string]interface{})
+	}
+	e.Extra[key] = value
+	return e
+}
+
+// internalError hides err from the client, which only sees INTERNAL_ERROR
+func internalError(err error) *AppError {
+	return &AppError{Status: fiber.StatusInternalServerError, Code: ErrCodeInternal, Err: err}
+}
+
+// badRequestError reports a body that could not be parsed
+func badRequestError(err error) *AppError {
+	return &AppError{Status: fiber.StatusBadRequest, Code: ErrCodeBadRequest, Err: err}
+}
+
+// validationError reports invalid fields of a request
+func validationError(fields ...FieldError) *AppError {
+	return &AppError{Status: fiber.StatusBadRequest, Code: ErrCodeValidation, Fields: fields}
+}
+
+// invalidField reports a single invalid field
+func invalidField(field, code string) *AppError {
+	return validationError(FieldError{Field: field, Code: code})
+}
+
+// codeForStatus gives errors raised by fiber itself, e.g. unknown routes, a
+// code of their own
+func codeForStatus(status int) string {
+	switch status {
+	case fiber.StatusBadRequest:
+		return ErrCodeBadRequest
+	case fiber.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case fiber.StatusForbidden:
+		return ErrCodePermissionDenied
+	case fiber.StatusNotFound:
+		return ErrCodeNotFound
+	case fiber.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	case fiber.StatusRequestEntityTooLarge:
+		return ErrCodePayloadTooLarge
+	}
+	if status < 500 {
+		return ErrCodeBadRequest
+	}
+	return ErrCodeInternal
+}
+
+// asAppError converts any error returned by a handler to an AppError
+func asAppError(err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return &AppError{Status: fe.Code, Code: codeForStatus(fe.Code), Err: err}
+	}
+	return internalError(err)
+}
+
+// problemErrorHandler is the fiber ErrorHandler. It renders every error as
+// application/problem+json in the language chosen by Accept-Language.
+func problemErrorHandler(c *fiber.Ctx, err error) error {
+	appErr := asAppError(err)
+
+	lang := c.AcceptsLanguages(supportedLanguages...)
+	if lang == "" {
+		lang = supportedLanguages[0]
+	}
+
+	problem := fiber.Map{}
+	for k, v := range appErr.Extra {
+		problem[k] = v
+	}
+	problem["type"] = "urn:problem:" + appErr.Code
+	problem["title"] = errorMessage(appErr.Code, lang)
+	problem["status"] = appErr.Status
+	problem["code"] = appErr.Code
+	// The path only: query strings may carry PII such as recipientId
+	problem["instance"] = c.Path()
+	if appErr.Detail != "" {
+		problem["detail"] = appErr.Detail
+	}
+	if id, _ := c.Locals(localRequestID).(string); id != "" {
+		problem["requestId"] = id
+	}
+	if len(appErr.Fields) > 0 {
+		fields := make([]FieldError, len(appErr.Fields))
+		for i, f := range appErr.Fields {
+			f.Message = errorMessage(f.Code, lang)
+			fields[i] = f
+		}
+		problem["errors"] = fields
+	}
+
+	c.Set(fiber.HeaderContentLanguage, lang)
+	return c.Status(appErr.Status).JSON(problem, "application/problem+json")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// runExpiryWorker marks pending QRRequests whose Expire time has passed as
+// expired, every interval until ctx is cancelled
+func runExpiryWorker(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := expireQRRequests(ctx, db, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "expiry worker failed", "error", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "expired QR requests", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireQRRequests expires due QRRequests in batches and returns how many
+// were expired
+func expireQRRequests(ctx context.Context, db *gorm.DB, now time.Time) (int, error) {
+	expired := 0
+	for ctx.Err() == nil {
+		var batch []QRRequest
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND expire < ?", QRStatusPending, now).
+				Limit(200).Find(&batch).Error
+			if err != nil {
+				return err
+			}
+			for i := range batch {
+				before := batch[i]
+				batch[i].Status = QRStatusExpired
+				if err := tx.Save(&batch[i]).Error; err != nil {
+					return err
+				}
+				if err := appendAuditEvent(tx, systemActor("expiry"), AuditExpire, &before, &batch[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return expired, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for i := range batch {
+			observeQRStatus(&batch[i])
+		}
+		expired += len(batch)
+	}
+	return expired, nil
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	ExportXLSX   = "xlsx"
+)
+
+// Export job statuses. Files of done jobs are deleted once they expire.
+const (
+	ExportStatusQueued  = "queued"
+	ExportStatusRunning = "running"
+	ExportStatusDone    = "done"
+	ExportStatusFailed  = "failed"
+	ExportStatusExpired = "expired"
+)
+
+const (
+	ErrCodeExportNotFound = "EXPORT_NOT_FOUND"
+	ErrCodeExportNotReady = "EXPORT_NOT_READY"
+	ErrCodeExportExpired  = "EXPORT_EXPIRED"
+	// ErrCodeExportMissing means the file of a done job is not in EXPORT_DIR
+	// of the instance serving the download, see exportPath
+	ErrCodeExportMissing = "EXPORT_FILE_MISSING"
+
+	// exportFetchSize is how many rows every FETCH of the export cursor reads
+	exportFetchSize = "1000"
+	// exportJobTimeout fails jobs left running by a stopped instance
+	exportJobTimeout = time.Hour
+)
+
+var exportContentTypes = map[string]string{
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportNDJSON: "application/x-ndjson",
+	ExportXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// ExportFilter selects the QR requests of an export, like the listing
+// filters. From and To are dates in Bangkok time, both included.
+type ExportFilter struct {
+	Format      string `json:"format" query:"format"`
+	Status      string `json:"status,omitempty" query:"status"`
+	RecipientID string `json:"recipientId,omitempty" query:"recipientId"`
+	From        string `json:"from,omitempty" query:"from"`
+	To          string `json:"to,omitempty" query:"to"`
+	TestMode    bool   `json:"testMode,omitempty" query:"testMode"`
+}
+
+func (f ExportFilter) Value() (driver.Value, error) {
+	b, err := json.Marshal(f)
+	return string(b), err
+}
+
+func (f *ExportFilter) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*f = ExportFilter{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, f)
+	case string:
+		return json.Unmarshal([]byte(v), f)
+	}
+	return fmt.Errorf("cannot scan %T into ExportFilter", value)
+}
+
+// validate reports the invalid fields of f and defaults its format
+func (f *ExportFilter) validate() error {
+	if f.Format == "" {
+		f.Format = ExportCSV
+	}
+	var fields []FieldError
+	if _, ok := exportContentTypes[f.Format]; !ok {
+		fields = append(fields, FieldError{Field: "format", Code: ErrCodeFieldInvalid, Detail: "csv, ndjson or xlsx"})
+	}
+	switch f.Status {
+	case "", QRStatusPending, QRStatusPaid, QRStatusCancelled, QRStatusExpired:
+	default:
+		fields = append(fields, FieldError{Field: "status", Code: ErrCodeFieldInvalid})
+	}
+	for _, date := range []struct{ field, value string }{{"from", f.From}, {"to", f.To}} {
+		if _, err := time.Parse("2006-01-02", date.value); date.value != "" && err != nil {
+			fields = append(fields, FieldError{Field: date.field, Code: ErrCodeFieldInvalid, Detail: "a date, e.g. 2026-01-31"})
+		}
+	}
+	if from, to, err := createdRange(f.From, f.To); err == nil && from > 0 && to > 0 && to <= from {
+		fields = append(fields, FieldError{Field: "to", Code: ErrCodeFieldInvalid, Detail: "not before from"})
+	}
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+// createdRange returns the CreatedAt bounds of the dates from and to in
+// Bangkok time, to exclusive, 0 when open
+func createdRange(fromDate, toDate string) (from, to int64, err error) {
+	if fromDate != "" {
+		t, err := time.ParseInLocation("2006-01-02", fromDate, bangkokTime)
+		if err != nil {
+			return 0, 0, err
+		}
+		from = t.Unix()
+	}
+	if toDate != "" {
+		t, err := time.ParseInLocation("2006-01-02", toDate, bangkokTime)
+		if err != nil {
+			return 0, 0, err
+		}
+		to = t.AddDate(0, 0, 1).Unix()
+	}
+	return from, to, nil
+}
+
+// ExportJob writes an export to a file in the background, for ranges too
+// large to download in one request. The file can be downloaded until
+// ExpiresAt.
+type ExportJob struct {
+	ID         string `gorm:"primaryKey"`
+	MerchantID string `gorm:"index"`
+	TestMode   bool
+	// Filter is the requested filter without its recipientId, which is kept
+	// as RecipientIDIndex only
+	Filter           ExportFilter `gorm:"type:jsonb"`
+	RecipientIDIndex string       `json:"-"`
+	// Unmask is whether the requester may see recipient IDs in clear
+	Unmask   bool   `json:"-"`
+	Status   string `gorm:"index"`
+	Rows     int64
+	Size     int64
+	Checksum string // hex SHA-256 of the file
+	Error    string `json:",omitempty"`
+
+	CreatedAt   int64
+	StartedAt   int64
+	CompletedAt int64
+	ExpiresAt   int64 `gorm:"index"`
+}
+
+// newExportJob describes an export of the caller's QR requests
+func newExportJob(c *fiber.Ctx, filter ExportFilter) *ExportJob {
+	job := &ExportJob{
+		ID:         uuid.New().String(),
+		MerchantID: currentMerchantID(c),
+		// Live and sandbox requests are never exported together
+		TestMode:  isSandbox(c) || filter.TestMode,
+		Filter:    filter,
+		Unmask:    canUnmask(c),
+		Status:    ExportStatusQueued,
+		CreatedAt: time.Now().Unix(),
+	}
+	if filter.RecipientID != "" {
+		job.RecipientIDIndex = blindIndex(filter.RecipientID)
+		job.Filter.RecipientID = ""
+	}
+	return job
+}
+
+// filename is the name the export is downloaded as
+func (j *ExportJob) filename() string {
+	name := "qr-requests"
+	if j.Filter.From != "" {
+		name += "-" + j.Filter.From
+	}
+	if j.Filter.To != "" {
+		name += "-" + j.Filter.To
+	}
+	return name + "." + j.Filter.Format
+}
+
+// query selects the QR requests of j, oldest first
+func (j *ExportJob) query(tx *gorm.DB) *gorm.DB {
+	query := tx.Model(&QRRequest{}).Where("merchant_id = ? AND test_mode = ?", j.MerchantID, j.TestMode)
+	if j.RecipientIDIndex != "" {
+		query = query.Where("recipient_id_index = ?", j.RecipientIDIndex)
+	}
+	if j.Filter.Status != "" {
+		query = query.Where("status = ?", j.Filter.Status)
+	}
+	// Validated when the job was made
+	from, to, _ := createdRange(j.Filter.From, j.Filter.To)
+	if from > 0 {
+		query = query.Where("created_at >= ?", time.Unix(from, 0))
+	}
+	if to > 0 {
+		query = query.Where("created_at < ?", time.Unix(to, 0))
+	}
+	return query.Order("created_at, id")
+}
+
+// exportColumns are the columns of CSV and XLSX exports
+var exportColumns = []interface{}{
+	"id", "txId", "type", "scheme", "recipientId", "recipientType", "merchantName", "reference1", "reference2",
+	"amount", "status", "onetime", "remark", "createdAt", "expire", "testMode",
+}
+
+// exportRecord is one QR request of an export. Times are RFC 3339 in
+// Bangkok time.
+type exportRecord struct {
+	ID            string  `json:"id"`
+	TxID          string  `json:"txId"`
+	Type          string  `json:"type"`
+	Scheme        string  `json:"scheme"`
+	RecipientID   string  `json:"recipientId"`
+	RecipientType string  `json:"recipientType"`
+	MerchantName  string  `json:"merchantName"`
+	Reference1    string  `json:"reference1"`
+	Reference2    string  `json:"reference2"`
+	Amount        float64 `json:"amount"`
+	Status        string  `json:"status"`
+	Onetime       bool    `json:"onetime"`
+	Remark        string  `json:"remark"`
+	CreatedAt     string  `json:"createdAt"`
+	Expire        string  `json:"expire"`
+	TestMode      bool    `json:"testMode"`
+}
+
+func newExportRecord(qr *QRRequest) exportRecord {
+	rfc3339 := func(unix int64) string {
+		if unix == 0 {
+			return ""
+		}
+		return time.Unix(unix, 0).In(bangkokTime).Format(time.RFC3339)
+	}
+	scheme := qr.Scheme
+	if scheme == "" {
+		scheme = SchemePromptPay
+	}
+	return exportRecord{
+		ID:            qr.ID,
+		TxID:          qr.TxID,
+		Type:          qr.Type,
+		Scheme:        scheme,
+		RecipientID:   string(qr.RecipientID),
+		RecipientType: qr.RecipientType,
+		MerchantName:  qr.MerchantName,
+		Reference1:    qr.Reference1,
+		Reference2:    qr.Reference2,
+		Amount:        qr.Amount,
+		Status:        qr.Status,
+		Onetime:       qr.Onetime,
+		Remark:        qr.Remark,
+		CreatedAt:     rfc3339(qr.CreatedAt),
+		Expire:        rfc3339(qr.Expire),
+		TestMode:      qr.TestMode,
+	}
+}
+
+// cells returns r in the order of exportColumns
+func (r exportRecord) cells() []interface{} {
+	return []interface{}{
+		r.ID, r.TxID, r.Type, r.Scheme, r.RecipientID, r.RecipientType, r.MerchantName, r.Reference1, r.Reference2,
+		r.Amount, r.Status, strconv.FormatBool(r.Onetime), r.Remark, r.CreatedAt, r.Expire, strconv.FormatBool(r.TestMode),
+	}
+}
+
+// recordWriter writes export records in one format
+type recordWriter interface {
+	Write(r exportRecord) error
+	Close() error
+}
+
+type csvRecordWriter struct{ w *csv.Writer }
+
+func (cw csvRecordWriter) Write(r exportRecord) error {
+	row := make([]string, 0, len(exportColumns))
+	for _, cell := range r.cells() {
+		switch v := cell.(type) {
+		case float64:
+			row = append(row, strconv.FormatFloat(v, 'f', 2, 64))
+		default:
+			row = append(row, csvText(v.(string)))
+		}
+	}
+	return cw.w.Write(row)
+}
+
+// csvText keeps spreadsheets from evaluating s as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (cw csvRecordWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonRecordWriter struct{ enc *json.Encoder }
+
+func (nw ndjsonRecordWriter) Write(r exportRecord) error { return nw.enc.Encode(r) }
+func (nw ndjsonRecordWriter) Close() error               { return nil }
+
+type xlsxRecordWriter struct{ x *xlsxWriter }
+
+func (xw xlsxRecordWriter) Write(r exportRecord) error { return xw.x.WriteRow(r.cells()...) }
+func (xw xlsxRecordWriter) Close() error               { return xw.x.Close() }
+
+// newRecordWriter starts an export in format on w, writing the header
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	switch format {
+	case ExportNDJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return ndjsonRecordWriter{enc}, nil
+	case ExportXLSX:
+		x, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return xlsxRecordWriter{x}, x.WriteRow(exportColumns...)
+	}
+	// The byte order mark makes Excel read Thai text as UTF-8
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	cw := csvRecordWriter{csv.NewWriter(w)}
+	header := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		header[i] = col.(string)
+	}
+	return cw, cw.w.Write(header)
+}
+
+// writeExport writes the QR requests of j to w through a server-side
+// cursor, so only one batch of rows is in memory at a time. flush is called
+// after every batch. It returns the number of rows written.
+func writeExport(ctx context.Context, db *gorm.DB, j *ExportJob, w io.Writer, flush func() error) (int64, error) {
+	var rows int64
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DECLARE qr_export NO SCROLL CURSOR FOR ?", j.query(tx)).Error; err != nil {
+			return err
+		}
+		rw, err := newRecordWriter(j.Filter.Format, w)
+		if err != nil {
+			return err
+		}
+		for {
+			var batch []QRRequest
+			if err := tx.Raw("FETCH " + exportFetchSize + " FROM qr_export").Scan(&batch).Error; err != nil {
+				return err
+			}
+			for i := range batch {
+				qr := &batch[i]
+				if !j.Unmask {
+					qr = maskQRRequest(qr)
+				}
+				if err := rw.Write(newExportRecord(qr)); err != nil {
+					return err
+				}
+			}
+			rows += int64(len(batch))
+			if len(batch) == 0 {
+				break
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if err := rw.Close(); err != nil {
+			return err
+		}
+		return flush()
+	}, &sql.TxOptions{ReadOnly: true})
+	return rows, err
+}
+
+// exportQRRequests handles GET /exports/qr. The file is streamed while it
+// is read from the database; a failure midway ends the download early, so
+// very large ranges are better exported with a job.
+func (h *Handler) exportQRRequests(c *fiber.Ctx) error {
+	var filter ExportFilter
+	if err := c.QueryParser(&filter); err != nil {
+		return badRequestError(err)
+	}
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	job := newExportJob(c, filter)
+
+	ctx := context.WithoutCancel(c.UserContext())
+	c.Set(fiber.HeaderContentType, exportContentTypes[filter.Format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, job.filename()))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		rows, err := writeExport(ctx, h.db, job, w, w.Flush)
+		if err != nil {
+			slog.ErrorContext(ctx, "export failed", "format", filter.Format, "rows", rows, "error", err)
+			return
+		}
+		slog.InfoContext(ctx, "export streamed", "format", filter.Format, "rows", rows)
+	})
+	return nil
+}
+
+// exportError maps errors of loading an ExportJob
+func exportError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newAppError(fiber.StatusNotFound, ErrCodeExportNotFound)
+	}
+	return internalError(err)
+}
+
+// getCallerExportJob loads an export job of the authenticated merchant.
+// Sandbox callers cannot see live exports.
+func getCallerExportJob(db *gorm.DB, c *fiber.Ctx, id string) (*ExportJob, error) {
+	var job ExportJob
+	if err := db.First(&job, "id = ? AND merchant_id = ?", id, currentMerchantID(c)).Error; err != nil {
+		return nil, err
+	}
+	if isSandbox(c) && !job.TestMode {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &job, nil
+}
+
+// createExportJob handles POST /exports/qr/jobs
+func (h *Handler) createExportJob(c *fiber.Ctx) error {
+	var filter ExportFilter
+	if err := c.BodyParser(&filter); err != nil {
+		return badRequestError(err)
+	}
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	job := newExportJob(c, filter)
+	if err := requestDB(c, h.db).Create(job).Error; err != nil {
+		return internalError(err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// getExportJob handles GET /exports/jobs/:id
+func (h *Handler) getExportJob(c *fiber.Ctx) error {
+	job, err := getCallerExportJob(requestDB(c, h.db), c, c.Params("id"))
+	if err != nil {
+		return exportError(err)
+	}
+	return c.JSON(job)
+}
+
+// downloadExportJob handles GET /exports/jobs/:id/file. The Digest header
+// carries the checksum of the file.
+func (h *Handler) downloadExportJob(c *fiber.Ctx) error {
+	job, err := getCallerExportJob(requestDB(c, h.db), c, c.Params("id"))
+	if err != nil {
+		return exportError(err)
+	}
+	switch {
+	case job.Status == ExportStatusExpired || job.Status == ExportStatusDone && job.ExpiresAt <= time.Now().Unix():
+		return newAppError(fiber.StatusGone, ErrCodeExportExpired)
+	case job.Status != ExportStatusDone:
+		return newAppError(fiber.StatusConflict, ErrCodeExportNotReady).with("status", job.Status)
+	}
+
+	f, err := os.Open(h.exportPath(job))
+	if errors.Is(err, os.ErrNotExist) {
+		slog.ErrorContext(c.UserContext(), "export file missing, EXPORT_DIR must be shared by all instances",
+			"job", job.ID, "dir", h.exportDir)
+		return &AppError{Status: fiber.StatusServiceUnavailable, Code: ErrCodeExportMissing, Err: err}
+	} else if err != nil {
+		return internalError(err)
+	}
+	sum, _ := hex.DecodeString(job.Checksum)
+	c.Set(fiber.HeaderContentType, exportContentTypes[job.Filter.Format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, job.filename()))
+	c.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	return c.SendStream(f, int(job.Size))
+}
+
+// exportPath is where the file of job is written. Any instance may run a
+// job and any instance may serve its download or delete it, so with several
+// instances EXPORT_DIR must be a volume they all mount.
+func (h *Handler) exportPath(job *ExportJob) string {
+	return filepath.Join(h.exportDir, job.ID+"."+job.Filter.Format)
+}
+
+// runExportWorker runs queued export jobs and deletes expired files every
+// interval until ctx is cancelled
+func runExportWorker(ctx context.Context, h *Handler, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.expireExports(ctx, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "export cleanup failed", "error", err)
+		}
+		for ctx.Err() == nil {
+			job, err := h.claimExportJob(ctx, time.Now())
+			if err != nil {
+				slog.ErrorContext(ctx, "export worker failed", "error", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			h.runExportJob(ctx, job, ttl)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimExportJob marks the oldest queued job as running and returns it, or
+// nil when there is none
+func (h *Handler) claimExportJob(ctx context.Context, now time.Time) (*ExportJob, error) {
+	var jobs []ExportJob
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ?", ExportStatusQueued).Order("created_at").Limit(1).Find(&jobs).Error
+		if err != nil || len(jobs) == 0 {
+			return err
+		}
+		jobs[0].Status = ExportStatusRunning
+		jobs[0].StartedAt = now.Unix()
+		return tx.Save(&jobs[0]).Error
+	})
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+// runExportJob writes the file of job and records the outcome
+func (h *Handler) runExportJob(ctx context.Context, job *ExportJob, ttl time.Duration) {
+	log := slog.With("export_id", job.ID, "format", job.Filter.Format)
+	runCtx, cancel := context.WithTimeout(ctx, exportJobTimeout)
+	defer cancel()
+
+	size, sum, err := writeExportFile(runCtx, h.db, job, h.exportPath(job))
+	now := time.Now()
+	job.CompletedAt = now.Unix()
+	if err != nil {
+		log.ErrorContext(ctx, "export job failed", "error", err)
+		job.Status = ExportStatusFailed
+		job.Error = "the export could not be written"
+	} else {
+		log.InfoContext(ctx, "export job done", "rows", job.Rows, "size", size)
+		job.Status = ExportStatusDone
+		job.Size = size
+		job.Checksum = hex.EncodeToString(sum.Sum(nil))
+		job.ExpiresAt = now.Add(ttl).Unix()
+	}
+	// Record the outcome even when ctx was cancelled midway
+	if err := h.db.WithContext(context.WithoutCancel(ctx)).Save(job).Error; err != nil {
+		log.ErrorContext(ctx, "failed to save export job", "error", err)
+	}
+}
+
+// writeExportFile writes job to path through a temporary file and returns
+// its size and checksum
+func writeExportFile(ctx context.Context, db *gorm.DB, job *ExportJob, path string) (int64, hash.Hash, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(tmp)
+
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, sum)}
+	buf := bufio.NewWriter(counter)
+	job.Rows, err = writeExport(ctx, db, job, buf, buf.Flush)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return counter.n, sum, os.Rename(tmp, path)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// expireExports deletes the files of expired jobs and fails jobs left
+// running by a stopped instance
+func (h *Handler) expireExports(ctx context.Context, now time.Time) error {
+	db := h.db.WithContext(ctx)
+	var expired []ExportJob
+	err := db.Where("status = ? AND expires_at <= ?", ExportStatusDone, now.Unix()).Limit(100).Find(&expired).Error
+	if err != nil {
+		return err
+	}
+	for i := range expired {
+		if err := os.Remove(h.exportPath(&expired[i])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := db.Model(&expired[i]).Update("status", ExportStatusExpired).Error; err != nil {
+			return err
+		}
+	}
+
+	return db.Model(&ExportJob{}).
+		Where("status = ? AND started_at < ?", ExportStatusRunning, now.Add(-exportJobTimeout).Unix()).
+		Updates(map[string]interface{}{
+			"status":       ExportStatusFailed,
+			"error":        "the export was interrupted",
+			"completed_at": now.Unix(),
+		}).Error
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"mime"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// fakeSMTPServer accepts email on a local port and only logs it, so the
+// email channel can be tried in development without a relay. It speaks just
+// enough SMTP for net/smtp.
+type fakeSMTPServer struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	received []fakeEmail
+}
+
+// fakeEmail is an email received by a fakeSMTPServer
+type fakeEmail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// maxFakeEmails bounds the emails a fakeSMTPServer keeps
+const maxFakeEmails = 100
+
+func startFakeSMTPServer(addr string) (*fakeSMTPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeSMTPServer{ln: ln}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops accepting email and waits for open sessions
+func (s *fakeSMTPServer) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Received returns the emails received so far, oldest first
+func (s *fakeSMTPServer) Received() []fakeEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeEmail(nil), s.received...)
+}
+
+func (s *fakeSMTPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.session(textproto.NewConn(conn))
+		}()
+	}
+}
+
+func (s *fakeSMTPServer) session(conn *textproto.Conn) {
+	reply := func(code int, msg string) bool {
+		return conn.PrintfLine("%d %s", code, msg) == nil
+	}
+	if !reply(220, "fake SMTP ready") {
+		return
+	}
+
+	var email fakeEmail
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply(250, "localhost")
+		case "MAIL":
+			email = fakeEmail{From: smtpPath(arg)}
+			reply(250, "OK")
+		case "RCPT":
+			email.To = append(email.To, smtpPath(arg))
+			reply(250, "OK")
+		case "DATA":
+			if len(email.To) == 0 {
+				reply(503, "RCPT first")
+				continue
+			}
+			reply(354, "End data with <CR><LF>.<CR><LF>")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			email.Data = string(data)
+			s.store(email)
+			reply(250, "OK")
+		case "RSET":
+			email = fakeEmail{}
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) store(email fakeEmail) {
+	header, _ := textproto.NewReader(bufio.NewReader(strings.NewReader(email.Data))).ReadMIMEHeader()
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+	slog.Info("fake SMTP received email", "from", email.From, "to", email.To, "subject", subject)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, email)
+	if len(s.received) > maxFakeEmails {
+		s.received = s.received[1:]
+	}
+}
+
+// smtpPath extracts the address of "FROM:<a@b>" or "TO:<a@b>"
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path, _, _ = strings.Cut(strings.TrimSpace(path), " ")
+	return strings.Trim(path, "<>")
+}
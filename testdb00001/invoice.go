@@ -0,0 +1,596 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Money is an amount in satang, 1/100 baht. Invoices compute in satang so
+// totals are exact; it is rendered in JSON as a baht number with 2 decimals.
+type Money int64
+
+// Quantity is a quantity in thousandths of a unit
+type Quantity int64
+
+// maxMoney matches the amount limit of validateAmount
+const maxMoney Money = 2000000000000000 * 100
+
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Baht converts m for QRRequest.Amount
+func (m Money) Baht() float64 {
+	f, _ := strconv.ParseFloat(m.String(), 64)
+	return f
+}
+
+func (q Quantity) MarshalJSON() ([]byte, error) {
+	s := fmt.Sprintf("%d.%03d", q/1000, q%1000)
+	return []byte(strings.TrimRight(strings.TrimRight(s, "0"), ".")), nil
+}
+
+// Invoice VAT modes
+const (
+	// VATExclusive adds VAT on top of the prices
+	VATExclusive = "exclusive"
+	// VATInclusive treats the prices as including VAT
+	VATInclusive = "inclusive"
+	VATNone      = "none"
+)
+
+// thaiVATRate is 7% in basis points
+const thaiVATRate = 700
+
+// Invoice statuses. An issued invoice has a number and a QRRequest; whether
+// it has been paid is the status of that QRRequest.
+const (
+	InvoiceStatusDraft  = "draft"
+	InvoiceStatusIssued = "issued"
+)
+
+// Errors of invoices
+const (
+	ErrCodeInvoiceNotFound  = "INVOICE_NOT_FOUND"
+	ErrCodeInvoiceNotDraft  = "INVOICE_NOT_DRAFT"
+	ErrCodeDiscountTooLarge = "DISCOUNT_TOO_LARGE"
+)
+
+// Invoice structure. Amounts are computed from the lines by computeTotals.
+type Invoice struct {
+	ID              string `gorm:"primaryKey"`
+	MerchantID      string `gorm:"index;uniqueIndex:idx_invoice_number,priority:1,where:number <> ''"`
+	Number          string `gorm:"uniqueIndex:idx_invoice_number,priority:2,where:number <> ''"`
+	Status          string `gorm:"index"`
+	CustomerName    string
+	CustomerTaxID   EncryptedString
+	CustomerEmail   EncryptedString
+	CustomerAddress EncryptedString
+	Lines           []InvoiceLine `gorm:"foreignKey:InvoiceID"`
+	VATMode         string
+	VATRate         int // basis points
+	Subtotal        Money
+	Discount        Money
+	VATAmount       Money
+	Total           Money
+	DueDate         int64
+	BillerID        string
+	MerchantName    string
+	Reference2      string
+	Remark          string
+	TestMode        bool `gorm:"index"`
+	QRRequestID     string
+	CreatedAt       int64
+	IssuedAt        int64
+
+	// QRRequest is the bill-payment request of an issued invoice
+	QRRequest *QRRequest `gorm:"-"`
+}
+
+// InvoiceLine structure. Amount is the line total after its discount.
+type InvoiceLine struct {
+	ID          uint   `gorm:"primaryKey"`
+	InvoiceID   string `gorm:"index"`
+	Position    int
+	Description string
+	Quantity    Quantity
+	UnitPrice   Money
+	Discount    Money
+	Amount      Money
+}
+
+// InvoiceSequence hands out invoice numbers per merchant without gaps. Sandbox
+// invoices are numbered on their own so they leave no holes in the live
+// numbers.
+type InvoiceSequence struct {
+	MerchantID string `gorm:"primaryKey"`
+	TestMode   bool   `gorm:"primaryKey"`
+	Last       int64
+}
+
+// setupInvoiceSequences moves invoice_sequences written before sandbox
+// invoices were numbered on their own to the (merchant_id, test_mode) key.
+// The existing counters carry on for live invoices.
+func setupInvoiceSequences(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&InvoiceSequence{}) || migrator.HasColumn(&InvoiceSequence{}, "TestMode") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			`ALTER TABLE invoice_sequences ADD COLUMN test_mode boolean NOT NULL DEFAULT false`,
+			`ALTER TABLE invoice_sequences DROP CONSTRAINT invoice_sequences_pkey`,
+			`ALTER TABLE invoice_sequences ADD PRIMARY KEY (merchant_id, test_mode)`,
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mulDivRound returns a*b/d rounded half up, exactly
+func mulDivRound(a, b, d int64) (int64, error) {
+	n := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	n.Add(n, big.NewInt(d/2))
+	n.Quo(n, big.NewInt(d))
+	if !n.IsInt64() {
+		return 0, fmt.Errorf("amount overflows")
+	}
+	return n.Int64(), nil
+}
+
+// computeTotals fills in the line amounts and the totals of inv. Discounts
+// are applied before VAT, VAT is rounded half up to the satang.
+func (inv *Invoice) computeTotals() error {
+	inv.VATRate = thaiVATRate
+	if inv.VATMode == VATNone {
+		inv.VATRate = 0
+	}
+
+	var subtotal Money
+	for i := range inv.Lines {
+		line := &inv.Lines[i]
+		gross, err := mulDivRound(int64(line.Quantity), int64(line.UnitPrice), 1000)
+		if err != nil || Money(gross) > maxMoney {
+			return invalidField(fmt.Sprintf("lines.%d", i), ErrCodeAmountInvalid)
+		}
+		if line.Discount > Money(gross) {
+			return invalidField(fmt.Sprintf("lines.%d.discount", i), ErrCodeDiscountTooLarge)
+		}
+		line.Amount = Money(gross) - line.Discount
+		subtotal += line.Amount
+		if subtotal > maxMoney {
+			return invalidField("lines", ErrCodeAmountInvalid)
+		}
+	}
+	inv.Subtotal = subtotal
+	if inv.Discount > subtotal {
+		return invalidField("discount", ErrCodeDiscountTooLarge)
+	}
+	net := subtotal - inv.Discount
+
+	switch inv.VATMode {
+	case VATExclusive:
+		vat, err := mulDivRound(int64(net), thaiVATRate, 10000)
+		if err != nil {
+			return invalidField("lines", ErrCodeAmountInvalid)
+		}
+		inv.VATAmount = Money(vat)
+		inv.Total = net + inv.VATAmount
+	case VATInclusive:
+		vat, err := mulDivRound(int64(net), thaiVATRate, 10000+thaiVATRate)
+		if err != nil {
+			return invalidField("lines", ErrCodeAmountInvalid)
+		}
+		inv.VATAmount = Money(vat)
+		inv.Total = net
+	default:
+		inv.VATAmount = 0
+		inv.Total = net
+	}
+
+	if inv.Total <= 0 || inv.Total > maxMoney {
+		return invalidField("total", ErrCodeAmountInvalid)
+	}
+	return nil
+}
+
+// parseDecimal parses a non-negative decimal with at most places decimals
+// into an integer of that scale, e.g. "12.5" with 2 places is 1250
+func parseDecimal(n json.Number, places int) (int64, error) {
+	s := string(n)
+	if s == "" {
+		return 0, nil
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > places {
+		return 0, errTooManyDecimals
+	}
+	if whole == "" || strings.ContainsAny(s, "-+eE") {
+		return 0, fmt.Errorf("invalid decimal %q", s)
+	}
+	v, err := strconv.ParseInt(whole+frac+strings.Repeat("0", places-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid decimal %q", s)
+	}
+	return v, nil
+}
+
+var errTooManyDecimals = errors.New("too many decimal places")
+
+// parseMoney parses field as a baht amount
+func parseMoney(field string, n json.Number) (Money, error) {
+	v, err := parseDecimal(n, 2)
+	if errors.Is(err, errTooManyDecimals) {
+		return 0, invalidField(field, ErrCodeAmountPrecision)
+	} else if err != nil || Money(v) > maxMoney {
+		return 0, invalidField(field, ErrCodeAmountInvalid)
+	}
+	return Money(v), nil
+}
+
+type invoiceLineInput struct {
+	Description string      `json:"description"`
+	Quantity    json.Number `json:"quantity"`
+	UnitPrice   json.Number `json:"unitPrice"`
+	Discount    json.Number `json:"discount"`
+}
+
+type invoiceInput struct {
+	CustomerName    string             `json:"customerName"`
+	CustomerTaxID   string             `json:"customerTaxId"`
+	CustomerEmail   string             `json:"customerEmail"`
+	CustomerAddress string             `json:"customerAddress"`
+	Lines           []invoiceLineInput `json:"lines"`
+	VATMode         string             `json:"vatMode"`
+	Discount        json.Number        `json:"discount"`
+	DueDate         int64              `json:"dueDate"`
+	BillerID        string             `json:"billerId"`
+	MerchantName    string             `json:"merchantName"`
+	Reference2      string             `json:"reference2"`
+	Remark          string             `json:"remark"`
+	TestMode        bool               `json:"testMode"`
+	// Finalize issues the invoice right away
+	Finalize bool `json:"finalize"`
+}
+
+// toInvoice validates in and returns the draft invoice it describes
+func (in *invoiceInput) toInvoice() (*Invoice, error) {
+	inv := &Invoice{
+		ID:              uuid.New().String(),
+		Status:          InvoiceStatusDraft,
+		CustomerName:    in.CustomerName,
+		CustomerTaxID:   EncryptedString(in.CustomerTaxID),
+		CustomerEmail:   EncryptedString(in.CustomerEmail),
+		CustomerAddress: EncryptedString(in.CustomerAddress),
+		VATMode:         in.VATMode,
+		DueDate:         in.DueDate,
+		BillerID:        in.BillerID,
+		MerchantName:    in.MerchantName,
+		Reference2:      strings.ToUpper(in.Reference2),
+		Remark:          in.Remark,
+		TestMode:        in.TestMode,
+		CreatedAt:       time.Now().Unix(),
+	}
+	if inv.VATMode == "" {
+		inv.VATMode = VATExclusive
+	}
+
+	var fields []FieldError
+	addErr := func(err error) {
+		var appErr *AppError
+		if errors.As(err, &appErr) {
+			fields = append(fields, appErr.Fields...)
+		}
+	}
+	if in.CustomerName == "" {
+		fields = append(fields, FieldError{Field: "customerName", Code: ErrCodeFieldRequired})
+	}
+	if len(in.Lines) == 0 {
+		fields = append(fields, FieldError{Field: "lines", Code: ErrCodeFieldRequired})
+	}
+
+	var err error
+	if inv.Discount, err = parseMoney("discount", in.Discount); err != nil {
+		addErr(err)
+	}
+	for i, l := range in.Lines {
+		line := InvoiceLine{Position: i + 1, Description: l.Description}
+		prefix := fmt.Sprintf("lines.%d.", i)
+		if l.Description == "" {
+			fields = append(fields, FieldError{Field: prefix + "description", Code: ErrCodeFieldRequired})
+		}
+		if q, err := parseDecimal(l.Quantity, 3); err != nil || q <= 0 {
+			fields = append(fields, FieldError{Field: prefix + "quantity", Code: ErrCodeFieldInvalid, Detail: "a positive number with at most 3 decimals"})
+		} else {
+			line.Quantity = Quantity(q)
+		}
+		if line.UnitPrice, err = parseMoney(prefix+"unitPrice", l.UnitPrice); err != nil {
+			addErr(err)
+		}
+		if line.Discount, err = parseMoney(prefix+"discount", l.Discount); err != nil {
+			addErr(err)
+		}
+		inv.Lines = append(inv.Lines, line)
+	}
+	if len(fields) > 0 {
+		return nil, validationError(fields...)
+	}
+
+	if err := inv.computeTotals(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// nextInvoiceNumber allocates the merchant's next live or sandbox invoice
+// number. The sequence row stays locked until tx ends, so numbers have no
+// gaps.
+func nextInvoiceNumber(tx *gorm.DB, merchantID string, testMode bool) (string, error) {
+	seq := InvoiceSequence{MerchantID: merchantID, TestMode: testMode}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&seq).Error; err != nil {
+		return "", err
+	}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Take(&seq, "merchant_id = ? AND test_mode = ?", merchantID, testMode).Error
+	if err != nil {
+		return "", err
+	}
+	seq.Last++
+	// Updated by its full key, Save would drop test_mode = false from the
+	// WHERE clause as a zero value
+	if err := tx.Model(&InvoiceSequence{}).Where("merchant_id = ? AND test_mode = ?", merchantID, testMode).
+		Update("last", seq.Last).Error; err != nil {
+		return "", err
+	}
+	// Used as Reference1 of the QR, which only allows A-Z and 0-9. Sandbox
+	// numbers are told apart by their prefix.
+	if testMode {
+		return fmt.Sprintf("TESTINV%06d", seq.Last), nil
+	}
+	return fmt.Sprintf("INV%06d", seq.Last), nil
+}
+
+// finalizeInvoice numbers a draft invoice and creates its bill-payment
+// QRRequest
+func finalizeInvoice(tx *gorm.DB, c *fiber.Ctx, inv *Invoice) error {
+	merchant, err := GetMerchant(tx, inv.MerchantID)
+	if err != nil {
+		return merchantError(err)
+	}
+	if inv.BillerID == "" {
+		if ids := merchant.BillerIDList(); len(ids) > 0 {
+			inv.BillerID = ids[0]
+		} else {
+			return invalidField("billerId", ErrCodeFieldRequired)
+		}
+	}
+	if !merchant.AllowsBiller(inv.BillerID) {
+		return newAppError(fiber.StatusForbidden, ErrCodeBillerNotAllowed)
+	}
+	if inv.MerchantName == "" {
+		inv.MerchantName = merchant.DefaultMerchantName
+	}
+
+	now := time.Now()
+	if inv.DueDate > 0 && inv.DueDate <= now.Unix() {
+		return validationError(FieldError{Field: "dueDate", Code: ErrCodeFieldInvalid, Detail: "the due date has passed"})
+	}
+	if inv.Number, err = nextInvoiceNumber(tx, inv.MerchantID, inv.TestMode); err != nil {
+		return err
+	}
+
+	qr := &QRRequest{
+		ID:           newQRRequestID(now),
+		MerchantID:   inv.MerchantID,
+		TxID:         inv.Number,
+		Type:         "billpayment",
+		MerchantName: inv.MerchantName,
+		Reference1:   inv.Number,
+		Reference2:   inv.Reference2,
+		Amount:       inv.Total.Baht(),
+		Onetime:      true,
+		Remark:       inv.Remark,
+		Expire:       inv.DueDate,
+		CreatedAt:    now.Unix(),
+		Status:       QRStatusPending,
+		TestMode:     inv.TestMode,
+	}
+	qr.QRCode, err = GenerateBillPaymentQRCode(qr.ID, inv.BillerID, qr.MerchantName, qr.Reference1, qr.Reference2, qr.Amount, qr.Onetime)
+	if err != nil {
+		return err
+	}
+	if qr.TestMode {
+		qr.QRCode = markSandboxPayload(qr.QRCode)
+	}
+	if err := CreateQRRequestAudited(tx, c, qr); err != nil {
+		return err
+	}
+
+	inv.Status = InvoiceStatusIssued
+	inv.IssuedAt = now.Unix()
+	inv.QRRequestID = qr.ID
+	inv.QRRequest = qr
+	return tx.Omit(clause.Associations).Save(inv).Error
+}
+
+// invoiceError maps errors of loading or changing an Invoice
+func invoiceError(err error) error {
+	var appErr *AppError
+	switch {
+	case errors.As(err, &appErr):
+		return appErr
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return newAppError(fiber.StatusNotFound, ErrCodeInvoiceNotFound)
+	}
+	return internalError(err)
+}
+
+// getCallerInvoice loads an invoice of the authenticated merchant with its
+// lines. Sandbox callers cannot see live invoices.
+func getCallerInvoice(db *gorm.DB, c *fiber.Ctx, id string) (*Invoice, error) {
+	var inv Invoice
+	err := db.Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		First(&inv, "id = ? AND merchant_id = ?", id, currentMerchantID(c)).Error
+	if err != nil {
+		return nil, err
+	}
+	if isSandbox(c) && !inv.TestMode {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &inv, nil
+}
+
+// presentInvoice attaches the invoice's QRRequest, masked for the caller.
+// A QRRequest removed by the retention rules is left out.
+func presentInvoice(c *fiber.Ctx, db *gorm.DB, inv *Invoice) (*Invoice, error) {
+	if inv.QRRequestID != "" && inv.QRRequest == nil {
+		qr, err := GetQRRequest(db, inv.MerchantID, inv.QRRequestID)
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+		case err != nil:
+			return nil, err
+		default:
+			inv.QRRequest = qr
+		}
+	}
+	if inv.QRRequest != nil {
+		inv.QRRequest = presentQRRequest(c, inv.QRRequest)
+	}
+	if !canUnmask(c) {
+		inv = maskInvoice(inv)
+	}
+	return inv, nil
+}
+
+// maskInvoice returns a copy of inv with the customer's sensitive values
+// masked
+func maskInvoice(inv *Invoice) *Invoice {
+	masked := *inv
+	masked.CustomerTaxID = EncryptedString(maskPII(string(inv.CustomerTaxID)))
+	masked.CustomerEmail = EncryptedString(maskPII(string(inv.CustomerEmail)))
+	masked.CustomerAddress = EncryptedString(maskPII(string(inv.CustomerAddress)))
+	return &masked
+}
+
+// createInvoice handles POST /invoices
+func (h *Handler) createInvoice(c *fiber.Ctx) error {
+	in := new(invoiceInput)
+	if err := c.BodyParser(in); err != nil {
+		return badRequestError(err)
+	}
+	inv, err := in.toInvoice()
+	if err != nil {
+		return err
+	}
+	inv.MerchantID = currentMerchantID(c)
+	// Sandbox credentials can only create test invoices
+	inv.TestMode = inv.TestMode || isSandbox(c)
+
+	db := requestDB(c, h.db)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(inv).Error; err != nil {
+			return err
+		}
+		if in.Finalize {
+			return finalizeInvoice(tx, c, inv)
+		}
+		return nil
+	})
+	if err != nil {
+		return invoiceError(err)
+	}
+	if inv.QRRequest != nil {
+		observeQRCreated(inv.QRRequest)
+	}
+
+	if inv, err = presentInvoice(c, db, inv); err != nil {
+		return internalError(err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(inv)
+}
+
+// finalizeInvoiceHandler handles POST /invoices/:id/finalize
+func (h *Handler) finalizeInvoiceHandler(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	var inv *Invoice
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		inv, err = getCallerInvoice(tx.Clauses(clause.Locking{Strength: "UPDATE"}), c, c.Params("id"))
+		if err != nil {
+			return err
+		}
+		if inv.Status != InvoiceStatusDraft {
+			return newAppError(fiber.StatusConflict, ErrCodeInvoiceNotDraft)
+		}
+		return finalizeInvoice(tx, c, inv)
+	})
+	if err != nil {
+		return invoiceError(err)
+	}
+	observeQRCreated(inv.QRRequest)
+
+	if inv, err = presentInvoice(c, db, inv); err != nil {
+		return internalError(err)
+	}
+	return c.JSON(inv)
+}
+
+// getInvoice handles GET /invoices/:id
+func (h *Handler) getInvoice(c *fiber.Ctx) error {
+	db := requestDB(c, h.db)
+	inv, err := getCallerInvoice(db, c, c.Params("id"))
+	if err != nil {
+		return invoiceError(err)
+	}
+	if inv, err = presentInvoice(c, db, inv); err != nil {
+		return internalError(err)
+	}
+	return c.JSON(inv)
+}
+
+// listInvoices handles GET /invoices, newest first. Lines are left out.
+func (h *Handler) listInvoices(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	testMode := isSandbox(c) || c.QueryBool("testMode")
+	query := requestDB(c, h.db).Where("merchant_id = ? AND test_mode = ?", currentMerchantID(c), testMode)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var invoices []Invoice
+	if err := query.Order("created_at DESC").Limit(limit).Offset(c.QueryInt("offset")).Find(&invoices).Error; err != nil {
+		return internalError(err)
+	}
+	if !canUnmask(c) {
+		for i := range invoices {
+			invoices[i] = *maskInvoice(&invoices[i])
+		}
+	}
+	return c.JSON(invoices)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestComputeTotals(t *testing.T) {
+	tests := []struct {
+		name     string
+		vatMode  string
+		lines    []InvoiceLine
+		discount Money
+		vat      Money
+		total    Money
+	}{
+		{"exclusive", VATExclusive, []InvoiceLine{{Quantity: 1000, UnitPrice: 10000}}, 0, 700, 10700},
+		{"inclusive", VATInclusive, []InvoiceLine{{Quantity: 1000, UnitPrice: 10700}}, 0, 700, 10700},
+		{"none", VATNone, []InvoiceLine{{Quantity: 1000, UnitPrice: 10000}}, 0, 0, 10000},
+		// 73.5 satang of VAT rounds up
+		{"exclusive half up", VATExclusive, []InvoiceLine{{Quantity: 1000, UnitPrice: 1050}}, 0, 74, 1124},
+		// 6.54 satang of VAT rounds down
+		{"inclusive rounding", VATInclusive, []InvoiceLine{{Quantity: 1000, UnitPrice: 100}}, 0, 7, 100},
+		// 1.5 x 3.33 is 4.995 baht
+		{"fractional quantity", VATNone, []InvoiceLine{{Quantity: 1500, UnitPrice: 333}}, 0, 0, 500},
+		{"discounts before VAT", VATExclusive, []InvoiceLine{
+			{Quantity: 2000, UnitPrice: 5000, Discount: 1000},
+			{Quantity: 1000, UnitPrice: 1500},
+		}, 500, 700, 10700},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := &Invoice{VATMode: tt.vatMode, Lines: tt.lines, Discount: tt.discount}
+			if err := inv.computeTotals(); err != nil {
+				t.Fatal(err)
+			}
+			if inv.VATAmount != tt.vat || inv.Total != tt.total {
+				t.Errorf("VAT %s, total %s, want %s and %s", inv.VATAmount, inv.Total, tt.vat, tt.total)
+			}
+		})
+	}
+}
+
+func TestComputeTotalsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []InvoiceLine
+		discount Money
+		field    string
+	}{
+		{"line discount above the line", []InvoiceLine{{Quantity: 1000, UnitPrice: 100, Discount: 101}}, 0, "lines.0.discount"},
+		{"discount above the subtotal", []InvoiceLine{{Quantity: 1000, UnitPrice: 100}}, 101, "discount"},
+		{"nothing to pay", []InvoiceLine{{Quantity: 1000, UnitPrice: 100}}, 100, "total"},
+		{"line too large", []InvoiceLine{{Quantity: 1000000, UnitPrice: maxMoney}}, 0, "lines.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := &Invoice{VATMode: VATExclusive, Lines: tt.lines, Discount: tt.discount}
+			var appErr *AppError
+			if err := inv.computeTotals(); !errors.As(err, &appErr) || len(appErr.Fields) != 1 || appErr.Fields[0].Field != tt.field {
+				t.Errorf("computeTotals() = %v, want an error for %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestMulDivRound(t *testing.T) {
+	tests := []struct {
+		a, b, d int64
+		want    int64
+	}{
+		{1050, 700, 10000, 74},
+		{1049, 700, 10000, 73},
+		{1500, 333, 1000, 500},
+		{10700, 700, 10700, 700},
+		{0, 700, 10000, 0},
+	}
+	for _, tt := range tests {
+		got, err := mulDivRound(tt.a, tt.b, tt.d)
+		if err != nil || got != tt.want {
+			t.Errorf("mulDivRound(%d, %d, %d) = %d, %v, want %d", tt.a, tt.b, tt.d, got, err, tt.want)
+		}
+	}
+	if _, err := mulDivRound(1<<62, 4, 1); err == nil {
+		t.Error("mulDivRound did not report the overflow")
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		code string
+	}{
+		{"", 0, ""},
+		{"12", 1200, ""},
+		{"12.5", 1250, ""},
+		{"12.50", 1250, ""},
+		{"0.01", 1, ""},
+		{"12.345", 0, ErrCodeAmountPrecision},
+		{"-1", 0, ErrCodeAmountInvalid},
+		{"1e3", 0, ErrCodeAmountInvalid},
+		{".5", 0, ErrCodeAmountInvalid},
+		{"2000000000000000.01", 0, ErrCodeAmountInvalid},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney("amount", json.Number(tt.in))
+		code := ""
+		var appErr *AppError
+		if errors.As(err, &appErr) && len(appErr.Fields) == 1 {
+			code = appErr.Fields[0].Code
+		}
+		if got != tt.want || code != tt.code || (err != nil) != (tt.code != "") {
+			t.Errorf("parseMoney(%q) = %s, %v, want %s, %q", tt.in, got, err, tt.want, tt.code)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Lifecycle owns the background workers of the service and the hooks that
+// have to run when it stops
+type Lifecycle struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	workers  sync.WaitGroup
+	draining atomic.Bool
+
+	mu      sync.Mutex
+	hooks   []shutdownHook
+	running map[string]bool
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{ctx: ctx, cancel: cancel, running: make(map[string]bool)}
+}
+
+// Go runs a background worker. Its context is cancelled at shutdown and the
+// worker is expected to return promptly after that.
+func (l *Lifecycle) Go(name string, fn func(ctx context.Context)) {
+	l.mu.Lock()
+	l.running[name] = true
+	l.mu.Unlock()
+
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		defer func() {
+			l.mu.Lock()
+			l.running[name] = false
+			l.mu.Unlock()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("worker panicked", "worker", name, "panic", fmt.Sprint(r))
+			}
+		}()
+		fn(l.ctx)
+	}()
+}
+
+// OnShutdown registers a hook that runs after the HTTP server and the
+// workers have stopped, e.g. to flush pending webhooks or logs. Hooks run in
+// registration order.
+func (l *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// Workers reports for every started worker whether it is still running. A
+// worker that stopped before shutdown makes the service unready.
+func (l *Lifecycle) Workers() map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	workers := make(map[string]bool, len(l.running))
+	for name, running := range l.running {
+		workers[name] = running
+	}
+	return workers
+}
+
+// waitContext blocks until wg is done or ctx ends, for shutdown hooks that
+// flush work in flight
+func waitContext(ctx context.Context, wg *sync.WaitGroup, what string) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s still in flight: %w", what, ctx.Err())
+	}
+}
+
+// Draining reports whether shutdown has started; readiness must be false then
+func (l *Lifecycle) Draining() bool {
+	return l.draining.Load()
+}
+
+// Shutdown drains the service: readiness turns false, after delay the server
+// stops accepting requests and waits for in-flight ones, workers are stopped
+// and the shutdown hooks run. Everything has to finish before ctx expires.
+func (l *Lifecycle) Shutdown(ctx context.Context, app *fiber.App, delay time.Duration) error {
+	l.draining.Store(true)
+
+	// Give load balancers time to notice the failing readiness probe
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	var errs []error
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+	}
+
+	l.cancel()
+	done := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, errors.New("background workers did not stop in time"))
+	}
+
+	l.mu.Lock()
+	hooks := append([]shutdownHook(nil), l.hooks...)
+	l.mu.Unlock()
+	for _, hook := range hooks {
+		if err := hook.fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hook.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const (
+	headerRequestID = "X-Request-ID"
+	// localRequestID is also the key used by fiber's requestid middleware
+	localRequestID = "requestid"
+)
+
+type requestIDKey struct{}
+
+// validRequestID limits the request IDs accepted from clients so they cannot
+// inject arbitrary text into logs and outbound headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID returns ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID carried by ctx, if any
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware accepts the caller's X-Request-ID or generates one,
+// echoes it in the response and puts it in the user context so log lines,
+// gorm queries and outbound calls made for the request carry it
+func requestIDMiddleware(c *fiber.Ctx) error {
+	id := c.Get(headerRequestID)
+	if !validRequestID.MatchString(id) {
+		id = uuid.New().String()
+	}
+	c.Set(headerRequestID, id)
+	c.Locals(localRequestID, id)
+	c.SetUserContext(withRequestID(c.UserContext(), id))
+	return c.Next()
+}
+
+// requestDB binds db to the request context so gorm logs carry the request ID
+func requestDB(c *fiber.Ctx, db *gorm.DB) *gorm.DB {
+	return db.WithContext(c.UserContext())
+}
+
+// newLogger builds the JSON logger configured by cfg
+func newLogger(cfg *Config) *slog.Logger {
+	var level slog.Level
+	// Validate has already rejected unknown levels
+	_ = level.UnmarshalText([]byte(cfg.LogLevel))
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: scrubAttr,
+	})
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request ID and trace of the context to every
+// record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// scrubAttr keeps credentials and PII out of the logs whatever the caller
+// passes: secrets are replaced, recipient IDs are masked
+func scrubAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(a.Key))
+	switch key {
+	case "authorization", "xapikey", "apikey", "password", "secret", "adminsecret", "token":
+		return slog.String(a.Key, "[REDACTED]")
+	case "recipientid":
+		return slog.String(a.Key, maskPII(a.Value.String()))
+	}
+	return a
+}
+
+// accessLogMiddleware logs one line per request. Failed requests are always
+// logged, successful ones only for the sampled fraction of sampleRate.
+func accessLogMiddleware(sampleRate float64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		status := responseStatus(c, err)
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		case sampleRate < 1 && rand.Float64() >= sampleRate:
+			return err
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Method()),
+			slog.String("route", c.Route().Path),
+			slog.String("path", c.Path()),
+			slog.Int("status", status),
+			slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+			slog.String("ip", c.IP()),
+		}
+		if merchantID := currentMerchantID(c); merchantID != "" {
+			attrs = append(attrs, slog.String("merchant_id", merchantID), slog.String("actor", currentActor(c)))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		slog.LogAttrs(c.UserContext(), level, "request", attrs...)
+		return err
+	}
+}
+
+// responseStatus returns the status the response will have once fiber's
+// error handler has turned err into a response
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	return asAppError(err).Status
+}
+
+// gormLogger sends gorm's logs to slog. Statements are logged without their
+// bound values so no PII or key material reaches the logs.
+type gormLogger struct {
+	logger        *slog.Logger
+	level         gormlogger.LogLevel
+	slowThreshold time.Duration
+}
+
+func newGormLogger(logger *slog.Logger, slowThreshold time.Duration) *gormLogger {
+	return &gormLogger{logger: logger, level: gormlogger.Info, slowThreshold: slowThreshold}
+}
+
+func (l *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	out := *l
+	out.level = level
+	return &out
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= gormlogger.Info {
+		l.logger.InfoContext(ctx, "gorm", "message", msg, "data", data)
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		l.logger.WarnContext(ctx, "gorm", "message", msg, "data", data)
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= gormlogger.Error {
+		l.logger.ErrorContext(ctx, "gorm", "message", msg, "data", data)
+	}
+}
+
+// Trace logs failed statements as errors, slow ones as warnings and all
+// others at debug level
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+
+	level := slog.LevelDebug
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		level = slog.LevelError
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold && l.level >= gormlogger.Warn:
+		level = slog.LevelWarn
+	}
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	sql, rows := fc()
+	attrs := []slog.Attr{
+		slog.String("sql", sql),
+		slog.Int64("rows", rows),
+		slog.Float64("elapsed_ms", float64(elapsed.Microseconds())/1000),
+	}
+	if level == slog.LevelError {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	l.logger.LogAttrs(ctx, level, "db query", attrs...)
+}
+
+// ParamsFilter drops the bound values from logged statements
+func (l *gormLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
+// newOutboundClient returns the HTTP client for calls to other services,
+// e.g. webhooks and bank providers. Every call carries the request ID of its
+// context and its trace, and is logged.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return newOutboundClientWith(timeout, http.DefaultTransport)
+}
+
+// newOutboundClientWith is newOutboundClient sending through transport
+func newOutboundClientWith(timeout time.Duration, transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &requestIDTransport{next: &tracingTransport{next: transport}},
+	}
+}
+
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if id := requestIDFromContext(ctx); id != "" && req.Header.Get(headerRequestID) == "" {
+		req = req.Clone(ctx)
+		req.Header.Set(headerRequestID, id)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("host", req.URL.Host),
+		slog.String("path", req.URL.Path),
+		slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+	}
+	switch {
+	case err != nil:
+		slog.LogAttrs(ctx, slog.LevelWarn, "outbound request", append(attrs, slog.String("error", err.Error()))...)
+	case resp.StatusCode >= 400:
+		slog.LogAttrs(ctx, slog.LevelWarn, "outbound request", append(attrs, slog.Int("status", resp.StatusCode))...)
+	default:
+		slog.LogAttrs(ctx, slog.LevelDebug, "outbound request", append(attrs, slog.Int("status", resp.StatusCode))...)
+	}
+	return resp, err
+}
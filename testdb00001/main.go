@@ -1,30 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
-	jwtware "github.com/gofiber/jwt/v3"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	"github.com/howeyc/crc16"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // QRRequest structure
 type QRRequest struct {
 	ID            string `gorm:"primaryKey"`
+	MerchantID    string `gorm:"index:idx_qr_merchant_created,priority:1"`
 	TxID          string
 	Type          string
-	RecipientID   string
+	RecipientID   EncryptedString
 	RecipientType string
 	MerchantName  string
 	Reference1    string
@@ -32,97 +41,315 @@ type QRRequest struct {
 	Amount        float64
 	Onetime       bool
 	Remark        string
-	CreatedAt     int64
 	QRCode        string
-	Expire        int64
-}
+	Expire        int64  `gorm:"serializer:timestamptz;type:timestamptz"`
+	Status        string `gorm:"index"`
 
-// Config structure
-type Config struct {
-	DBHost     string
-	DBName     string
-	DBPort     string
-	DBUser     string
-	DBPassword string
-	ServerPort string
-}
+	// CreatedAt partitions qr_requests by month, see partitions.go. The API
+	// keeps Unix seconds; the columns are timestamptz.
+	CreatedAt int64 `gorm:"primaryKey;index;index:idx_qr_merchant_created,priority:2;serializer:timestamptz;type:timestamptz"`
 
-// LoadConfig function
-func LoadConfig() (*Config, error) {
-	config := &Config{
-		DBHost:     os.Getenv("DB_HOST"),
-		DBName:     os.Getenv("DB_NAME"),
-		DBPort:     os.Getenv("DB_PORT"),
-		DBUser:     os.Getenv("DB_USER"),
-		DBPassword: os.Getenv("DB_PASSWORD"),
-		ServerPort: os.Getenv("SERVER_PORT"),
-	}
+	// RecipientIDIndex is the blind index used to look up RecipientID
+	RecipientIDIndex string `gorm:"index" json:"-"`
+
+	// TestMode marks sandbox requests, see sandbox.go
+	TestMode bool `gorm:"index"`
+
+	// Scheme is the payment scheme of a generated payload, see emvco.go.
+	// Amount is in the scheme's currency.
+	Scheme string
+
+	// IdempotencyKey is the Idempotency-Key header the request was created
+	// with; a retried create returns the original instead of a duplicate.
+	// QRIdempotencyKey keeps it unique.
+	IdempotencyKey string `json:"-"`
 
-	return config, nil
+	// LegalHold keeps the request from being purged or archived by the
+	// retention rules, see retention.go
+	LegalHold       bool `gorm:"index"`
+	LegalHoldReason string
 }
 
-var jwtSecretKey = []byte("3ab92c27e5d24fe682e73b3a9d9c2a62")
+// QRRequest statuses
+const (
+	QRStatusPending   = "pending"
+	QRStatusPaid      = "paid"
+	QRStatusCancelled = "cancelled"
+	QRStatusExpired   = "expired"
+)
 
-func login(c *fiber.Ctx) error {
+// jwtSecretKey signs and verifies tokens, set from Config.JWTSecret
+var jwtSecretKey []byte
 
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["name"] = "enersys"
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+// loginHandler issues a JWT. A caller presenting a merchant API key gets a
+// token for that merchant and the key's role, a caller sending the configured
+// admin secret gets an admin token. Anonymous logins are only allowed in dev
+// mode and get a merchant token for the default merchant.
+func loginHandler(cfg *Config, db *gorm.DB) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		req := struct {
+			AdminSecret string `json:"adminSecret"`
+		}{}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return badRequestError(err)
+			}
+		}
 
-	t, err := token.SignedString(jwtSecretKey)
-	if err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
-	}
+		name := "enersys"
+		merchantID := defaultMerchantID
+		role := RoleMerchant
+		sandbox := false
+		switch key := apiKeyFromRequest(c); {
+		case key != "":
+			apiKey, err := authenticateAPIKey(db, key)
+			if err != nil {
+				return newAppError(fiber.StatusUnauthorized, ErrCodeAPIKeyInvalid)
+			}
+			name = apiKey.Prefix
+			merchantID = apiKey.MerchantID
+			role = apiKey.Role
+			sandbox = apiKey.Sandbox
+		case req.AdminSecret != "" && cfg.AdminSecret != "":
+			if subtle.ConstantTimeCompare([]byte(req.AdminSecret), []byte(cfg.AdminSecret)) != 1 {
+				return newAppError(fiber.StatusUnauthorized, ErrCodeAdminSecretInvalid)
+			}
+			name = "admin"
+			role = RoleAdmin
+		case !cfg.DevMode:
+			return newAppError(fiber.StatusUnauthorized, ErrCodeCredentialsRequired)
+		}
+
+		token := jwt.New(jwt.SigningMethodHS256)
+		claims := token.Claims.(jwt.MapClaims)
+		claims["name"] = name
+		claims["merchant_id"] = merchantID
+		claims["role"] = role
+		if sandbox {
+			claims["sandbox"] = true
+		}
+		claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+
+		t, err := token.SignedString(jwtSecretKey)
+		if err != nil {
+			return internalError(err)
+		}
 
-	return c.JSON(fiber.Map{"token": t})
+		return c.JSON(fiber.Map{"token": t})
+	}
 }
 
 // setupDatabaseConnection function
 func setupDatabaseConnection(cfg *Config) (*gorm.DB, error) {
-	dsn := "host=" + cfg.DBHost + " user=" + cfg.DBUser + " password=" + cfg.DBPassword + " dbname=" + cfg.DBName + " port=" + cfg.DBPort + " sslmode=disable TimeZone=Asia/Bangkok"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{
+		Logger: newGormLogger(slog.Default(), cfg.DBSlowQuery),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
+	sqlDB.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
 
-	db.AutoMigrate(&QRRequest{})
+	if err := registerDBMetrics(db); err != nil {
+		return nil, err
+	}
+	if err := db.Use(&gormTracingPlugin{}); err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
+	if err := setupFieldEncryption(cfg, db); err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
 
+// migrate brings the schema and rows written by older versions up to date
+func migrate(db *gorm.DB) error {
+	if err := setupPartitionedQRRequests(db); err != nil {
+		return err
+	}
+	if err := setupInvoiceSequences(db); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&QRRequest{}, &QRIdempotencyKey{}, &Payment{}, &UsedSlip{}, &Merchant{}, &APIKey{}, &AuditEvent{}, &DataKey{},
+		&Invoice{}, &InvoiceLine{}, &InvoiceSequence{}, &BillingSchedule{}, &BillingRun{},
+		&ReferenceSequence{}, &QRRollup{}, &RollupCursor{}, &ExportJob{}, &SchemaVersion{}, &DataMigration{}, &QRView{}); err != nil {
+		return err
+	}
+	if err := ensureDefaultMerchant(db); err != nil {
+		return err
+	}
+	if err := db.Model(&QRRequest{}).Where("status = '' OR status IS NULL").
+		Update("status", QRStatusPending).Error; err != nil {
+		return err
+	}
+	if err := setupAuditTrail(db); err != nil {
+		return err
+	}
+	if err := setupArchiveTable(db); err != nil {
+		return err
+	}
+	return recordSchemaVersion(db)
+}
+
 // CRUD functions
 func CreateQRRequest(db *gorm.DB, qr *QRRequest) error {
-	return db.Create(qr).Error
+	if qr.IdempotencyKey == "" {
+		return db.Create(qr).Error
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(qr).Error; err != nil {
+			return err
+		}
+		return tx.Create(&QRIdempotencyKey{
+			MerchantID: qr.MerchantID, IdempotencyKey: qr.IdempotencyKey, QRRequestID: qr.ID, CreatedAt: qr.CreatedAt,
+		}).Error
+	})
 }
 
-func GetQRRequest(db *gorm.DB, id string) (*QRRequest, error) {
+func GetQRRequest(db *gorm.DB, merchantID, id string) (*QRRequest, error) {
 	var qr QRRequest
-	result := db.First(&qr, "id = ?", id)
+	result := whereQRRequestID(db, id).First(&qr, "merchant_id = ?", merchantID)
 	return &qr, result.Error
 }
 
+const headerIdempotencyKey = "Idempotency-Key"
+
+// findIdempotentQRRequest returns the QRRequest the merchant created with key
+func findIdempotentQRRequest(db *gorm.DB, merchantID, key string) (*QRRequest, error) {
+	var idempotency QRIdempotencyKey
+	if err := db.First(&idempotency, "merchant_id = ? AND idempotency_key = ?", merchantID, key).Error; err != nil {
+		return nil, err
+	}
+	return GetQRRequest(db, merchantID, idempotency.QRRequestID)
+}
+
+// CreateQRRequestAudited creates qr and its audit event in one transaction
+func CreateQRRequestAudited(db *gorm.DB, c *fiber.Ctx, qr *QRRequest) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := CreateQRRequest(tx, qr); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, AuditCreate, nil, qr)
+	})
+}
+
 // ... additional CRUD functions for Update and Delete ...
 
 // Route handlers
+// createQRRequestData is the body of POST /generateqr. Fields the server
+// owns, such as the status, the payload and the legal hold, are not in it.
+type createQRRequestData struct {
+	TxID          string  `json:"txId"`
+	Type          string  `json:"type"`
+	RecipientID   string  `json:"recipientId"`
+	RecipientType string  `json:"recipientType"`
+	MerchantName  string  `json:"merchantName"`
+	Reference1    string  `json:"reference1"`
+	Reference2    string  `json:"reference2"`
+	Amount        float64 `json:"amount"`
+	Onetime       bool    `json:"onetime"`
+	Remark        string  `json:"remark"`
+	Expire        int64   `json:"expire"`
+	TestMode      bool    `json:"testMode"`
+	Scheme        string  `json:"scheme"`
+}
+
 func createQRRequestHandler(db *gorm.DB) func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		qr := new(QRRequest)
-		if err := c.BodyParser(qr); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		db := requestDB(c, db)
+		data := new(createQRRequestData)
+		if err := c.BodyParser(data); err != nil {
+			return badRequestError(err)
+		}
+		qr := &QRRequest{
+			TxID:          data.TxID,
+			Type:          data.Type,
+			RecipientID:   EncryptedString(data.RecipientID),
+			RecipientType: data.RecipientType,
+			MerchantName:  data.MerchantName,
+			Reference1:    data.Reference1,
+			Reference2:    data.Reference2,
+			Amount:        data.Amount,
+			Onetime:       data.Onetime,
+			Remark:        data.Remark,
+			Expire:        data.Expire,
+			TestMode:      data.TestMode,
+			Scheme:        data.Scheme,
 		}
 
 		// Validate the amount
 		if err := validateAmount(qr.Amount); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			return err
+		}
+
+		// The request always belongs to the authenticated merchant
+		qr.MerchantID = currentMerchantID(c)
+		qr.Status = QRStatusPending
+		now := time.Now()
+		qr.CreatedAt = now.Unix()
+		// IDs are always generated: the primary key of the partitioned table
+		// includes created_at and so cannot keep a client's ID unique
+		qr.ID = newQRRequestID(now)
+
+		// Sandbox credentials can only create test requests
+		qr.TestMode = qr.TestMode || isSandbox(c)
+
+		if qr.Scheme == "" {
+			qr.Scheme = SchemePromptPay
+		} else if _, ok := qrSchemes[qr.Scheme]; !ok {
+			return invalidField("scheme", ErrCodeFieldInvalid)
+		}
+
+		// A retry with the same Idempotency-Key gets the original back
+		qr.IdempotencyKey = c.Get(headerIdempotencyKey)
+		if qr.IdempotencyKey != "" {
+			existing, err := findIdempotentQRRequest(db, qr.MerchantID, qr.IdempotencyKey)
+			if err == nil {
+				return c.JSON(presentQRRequest(c, existing))
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return internalError(err)
+			}
 		}
 
 		// Proceed with creating the QR request
-		if err := CreateQRRequest(db, qr); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := completeQRRequest(tx, qr); err != nil {
+				return err
+			}
+			if qr.TestMode {
+				qr.QRCode = markSandboxPayload(qr.QRCode)
+			}
+			return CreateQRRequestAudited(tx, c, qr)
+		})
+		if err != nil {
+			var appErr *AppError
+			if errors.As(err, &appErr) {
+				return appErr
+			}
+			// A concurrent retry may have won the race on the unique index
+			if qr.IdempotencyKey != "" {
+				if existing, findErr := findIdempotentQRRequest(db, qr.MerchantID, qr.IdempotencyKey); findErr == nil {
+					return c.JSON(presentQRRequest(c, existing))
+				}
+			}
+			return internalError(err)
 		}
+		observeQRCreated(qr)
 
-		return c.JSON(qr)
+		return c.JSON(presentQRRequest(c, qr))
 	}
 }
 
@@ -144,51 +371,304 @@ func createQRRequestHandler(db *gorm.DB) func(*fiber.Ctx) error {
 
 func getQRRequestHandler(db *gorm.DB) func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
+		db := requestDB(c, db)
 		id := c.Params("id")
-		qr, err := GetQRRequest(db, id)
+		qr, err := getCallerQRRequest(db, c, id)
 		if err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "QRRequest not found"})
+			return qrRequestError(err)
 		}
 
-		return c.JSON(qr)
+		if err := recordView(db, c, qr); err != nil {
+			return internalError(err)
+		}
+
+		return c.JSON(presentQRRequest(c, qr))
 	}
 }
 
+// listQRRequestsHandler lists the merchant's QRRequests, newest first. The
+// recipientId filter is matched through its blind index.
+func listQRRequestsHandler(db *gorm.DB) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db := requestDB(c, db)
+		limit := c.QueryInt("limit", 50)
+		if limit <= 0 || limit > 500 {
+			limit = 50
+		}
+
+		// Live and sandbox requests are never listed together
+		testMode := isSandbox(c) || c.QueryBool("testMode")
+		query := db.Where("merchant_id = ? AND test_mode = ?", currentMerchantID(c), testMode)
+		if recipientID := c.Query("recipientId"); recipientID != "" {
+			query = query.Where("recipient_id_index = ?", blindIndex(recipientID))
+		}
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		// A creation date range limits the partitions searched
+		from, to, err := createdRange(c.Query("from"), c.Query("to"))
+		if err != nil {
+			return badRequestError(err)
+		}
+		if from > 0 {
+			query = query.Where("created_at >= ?", time.Unix(from, 0))
+		}
+		if to > 0 {
+			query = query.Where("created_at < ?", time.Unix(to, 0))
+		}
+
+		var qrs []QRRequest
+		if err := query.Order("created_at DESC").Limit(limit).Offset(c.QueryInt("offset")).Find(&qrs).Error; err != nil {
+			return internalError(err)
+		}
+
+		return c.JSON(presentQRRequests(c, qrs))
+	}
+}
+
+type updateQRRequestData struct {
+	Remark *string `json:"remark"`
+	Expire *int64  `json:"expire"`
+}
+
+// updateQRRequestHandler edits the descriptive fields of a pending QRRequest
+func updateQRRequestHandler(db *gorm.DB) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db := requestDB(c, db)
+		data := new(updateQRRequestData)
+		if err := c.BodyParser(data); err != nil {
+			return badRequestError(err)
+		}
+
+		var qr *QRRequest
+		err := db.Transaction(func(tx *gorm.DB) error {
+			before, err := getCallerQRRequest(tx.Clauses(clause.Locking{Strength: "UPDATE"}), c, c.Params("id"))
+			if err != nil {
+				return err
+			}
+			if before.Status != QRStatusPending {
+				return errQRNotPending
+			}
+
+			after := *before
+			if data.Remark != nil {
+				after.Remark = *data.Remark
+			}
+			if data.Expire != nil {
+				after.Expire = *data.Expire
+			}
+			if err := tx.Save(&after).Error; err != nil {
+				return err
+			}
+			qr = &after
+			return recordAudit(tx, c, AuditUpdate, before, &after)
+		})
+		if err != nil {
+			return qrRequestError(err)
+		}
+
+		return c.JSON(presentQRRequest(c, qr))
+	}
+}
+
+// cancelQRRequestHandler cancels a pending QRRequest
+func cancelQRRequestHandler(db *gorm.DB) func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db := requestDB(c, db)
+		var qr *QRRequest
+		err := db.Transaction(func(tx *gorm.DB) error {
+			before, err := getCallerQRRequest(tx.Clauses(clause.Locking{Strength: "UPDATE"}), c, c.Params("id"))
+			if err != nil {
+				return err
+			}
+			if before.Status != QRStatusPending {
+				return errQRNotPending
+			}
+
+			after := *before
+			after.Status = QRStatusCancelled
+			if err := tx.Save(&after).Error; err != nil {
+				return err
+			}
+			qr = &after
+			return recordAudit(tx, c, AuditCancel, before, &after)
+		})
+		if err != nil {
+			return qrRequestError(err)
+		}
+		observeQRStatus(qr)
+
+		return c.JSON(presentQRRequest(c, qr))
+	}
+}
+
+var (
+	errQRNotPending = errors.New("QRRequest is no longer pending")
+	errQROnHold     = errors.New("QRRequest is already on legal hold")
+)
+
+// qrRequestError maps errors of loading or changing a QRRequest
+func qrRequestError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return newAppError(fiber.StatusNotFound, ErrCodeQRNotFound)
+	case errors.Is(err, errQRNotPending):
+		return newAppError(fiber.StatusConflict, ErrCodeQRNotPending)
+	case errors.Is(err, errQROnHold):
+		return newAppError(fiber.StatusConflict, ErrCodeQROnHold)
+	}
+	return internalError(err)
+}
+
 // ... additional handlers for Update and Delete ...
 func main() {
-	cfg, err := LoadConfig()
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	flag.Parse()
+
+	cfg, err := LoadConfigFile(*configFile)
+	if flag.Arg(0) == "config" {
+		os.Exit(runConfigCommand(flag.Args()[1:], cfg, err, os.Stdout, os.Stderr))
+	}
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	slog.SetDefault(newLogger(cfg))
+	jwtSecretKey = []byte(cfg.JWTSecret)
+	if len(jwtSecretKey) == 0 {
+		// Only reachable in DEV_MODE, Validate requires JWT_SECRET otherwise
+		slog.Warn("JWT_SECRET not set, tokens are signed with a random key and end with the process")
+		jwtSecretKey = []byte(uuid.NewString())
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg)
+	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
 
 	db, err := setupDatabaseConnection(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
+		slog.Error("failed to connect to the database", "error", err)
+		os.Exit(1)
 	}
-	defer closeDatabaseConnection(db)
 
-	app := fiber.New()
+	lifecycle := NewLifecycle()
+	lifecycle.OnShutdown("tracing", shutdownTracing)
+	if cfg.ExpirePending {
+		lifecycle.Go("expiry", func(ctx context.Context) {
+			runExpiryWorker(ctx, db, cfg.ExpiryInterval)
+		})
+	}
+	lifecycle.Go("rollups", func(ctx context.Context) {
+		runRollupWorker(ctx, db, cfg.ReportInterval)
+	})
+	lifecycle.Go("partitions", func(ctx context.Context) {
+		runPartitionWorker(ctx, db, cfg.PartitionPremake, cfg.PartitionDetachAfter, cfg.PartitionInterval)
+	})
+	lifecycle.Go("encryption", func(ctx context.Context) {
+		runEncryptionWorker(ctx, db, cfg.EncryptInterval)
+	})
+
+	app := fiber.New(fiber.Config{ErrorHandler: problemErrorHandler})
 
 	// Configure global middleware here (if any)
+	app.Use(requestIDMiddleware)
+	app.Use(tracingMiddleware)
+	app.Use(accessLogMiddleware(cfg.LogSampleRate))
+	app.Use(metricsMiddleware)
+
+	allowPrivateTargets = cfg.DevMode
+	handler := NewHandler(db, lifecycle)
+	handler.slipProvider = setupSlipProvider(cfg)
+	lifecycle.OnShutdown("callbacks", handler.waitCallbacks)
+	if handler.notifications, err = setupNotifications(cfg, lifecycle); err != nil {
+		slog.Error("failed to set up notifications", "error", err)
+		os.Exit(1)
+	}
+	lifecycle.Go("billing", func(ctx context.Context) {
+		runBillingWorker(ctx, handler, cfg.BillingInterval)
+	})
+	if err := os.MkdirAll(cfg.ExportDir, 0o700); err != nil {
+		slog.Error("failed to create the export directory", "error", err)
+		os.Exit(1)
+	}
+	handler.exportDir = cfg.ExportDir
+	lifecycle.Go("exports", func(ctx context.Context) {
+		runExportWorker(ctx, handler, cfg.ExportTTL, cfg.ExportInterval)
+	})
+	retention, err := setupRetention(cfg, db)
+	if err != nil {
+		slog.Error("failed to set up retention", "error", err)
+		os.Exit(1)
+	}
+	lifecycle.Go("retention", func(ctx context.Context) {
+		runRetentionWorker(ctx, retention, cfg.RetentionInterval)
+	})
+	if handler.slipRenderer, err = loadSlipRenderer(cfg); err != nil {
+		slog.Error("failed to load the PDF fonts", "error", err)
+		os.Exit(1)
+	}
+	openAPI, err := loadOpenAPI()
+	if err != nil {
+		slog.Error("failed to load the API document", "error", err)
+		os.Exit(1)
+	}
+	setupRoutes(app, cfg, db, handler, openAPI)
+	if err := openAPI.checkRoutes(app.GetRoutes(), cfg.DevMode); err != nil {
+		slog.Error("routes and openapi.yaml disagree", "error", err)
+		os.Exit(1)
+	}
 
-	handler := NewHandler(db)
-	setupRoutes(app, db, handler)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	listenErr := make(chan error, 2)
+	go func() {
+		slog.Info("starting server", "port", cfg.ServerPort)
+		listenErr <- app.Listen(":" + cfg.ServerPort)
+	}()
+	if cfg.MetricsPort != "" {
+		metricsApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+		metricsApp.Get("/metrics", metricsHandler())
+		lifecycle.OnShutdown("metrics server", func(ctx context.Context) error {
+			return metricsApp.ShutdownWithContext(ctx)
+		})
+		go func() {
+			slog.Info("starting metrics server", "port", cfg.MetricsPort)
+			listenErr <- metricsApp.Listen(":" + cfg.MetricsPort)
+		}()
+	}
+
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		slog.Info("shutting down", "signal", sig.String())
+	case err := <-listenErr:
+		slog.Error("failed to start server", "error", err)
+		exitCode = 1
+	}
 
-	log.Printf("Starting server on port %s", cfg.ServerPort)
-	if err := app.Listen(":" + cfg.ServerPort); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if err := lifecycle.Shutdown(ctx, app, cfg.ShutdownDelay); err != nil {
+		slog.Error("shutdown incomplete", "error", err)
+		exitCode = 1
 	}
+	cancel()
+
+	closeDatabaseConnection(db)
+	slog.Info("server stopped")
+	os.Exit(exitCode)
 }
 
 func MockupDB(db *gorm.DB) error {
-	return db.AutoMigrate(&QRRequest{})
+	return migrate(db)
 }
 
 func InjectTestData(db *gorm.DB) error {
 	testData := []QRRequest{
 		// Populate with test data
 		{
-			TxID: "InjectTestData-TestTx1", Type: "InjectTestData-TestType1", RecipientID: "InjectTestData-TestRec1", /* other fields */
+			ID: newQRRequestID(time.Now()), MerchantID: defaultMerchantID, CreatedAt: time.Now().Unix(), TxID: "InjectTestData-TestTx1", Type: "InjectTestData-TestType1", RecipientID: "InjectTestData-TestRec1", /* other fields */
 		},
 		// Add more test data as needed
 	}
@@ -204,9 +684,9 @@ func InjectTestData(db *gorm.DB) error {
 func closeDatabaseConnection(db *gorm.DB) {
 	sqlDB, err := db.DB()
 	if err != nil {
-		log.Printf("Error closing database: %v", err)
-	} else {
-		sqlDB.Close()
+		slog.Error("error closing database", "error", err)
+	} else if err := sqlDB.Close(); err != nil {
+		slog.Error("error closing database", "error", err)
 	}
 }
 
@@ -235,83 +715,132 @@ func closeDatabaseConnection(db *gorm.DB) {
 // 	// ... additional routes for Update, Delete, etc.
 // }
 
-func setupRoutes(app *fiber.App, db *gorm.DB, handler *Handler) {
+func setupRoutes(app *fiber.App, cfg *Config, db *gorm.DB, handler *Handler, openAPI *OpenAPI) {
 	// Existing routes...
 	//app.Post("/generateqr", jwtware.New(jwtware.Config{SigningKey: jwtSecretKey}), handler.generateQR)
 	//app.Post("/generateqr", createQRRequestHandler(db))
-	app.Post("/generateqr", jwtware.New(jwtware.Config{SigningKey: jwtSecretKey}), createQRRequestHandler(db))
-	// ...
 
-	// Route to set up the database schema
-	app.Post("/mockupdb", func(c *fiber.Ctx) error {
-		if err := MockupDB(db); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-		}
-		return c.SendString("Database schema setup completed.")
-	})
+	// The public API lives under /v1 and every route must be documented in
+	// openapi.yaml, which requests are validated against
+	v1 := app.Group(apiPrefix)
+	v1.Get("/openapi.json", openAPI.specHandler)
+	v1.Get("/docs", swaggerUIHandler)
+	api := v1.Group("")
+
+	// Requests are validated once the caller is known, so unauthenticated
+	// and unauthorised callers get 401 and 403 rather than a 400
+	auth := handler.authRequired()
+	validate := openAPI.validateRequest
+	api.Post("/generateqr", auth, requirePermission(PermQRCreate), validate, createQRRequestHandler(db))
+	api.Get("/qr", auth, requirePermission(PermQRRead), validate, listQRRequestsHandler(db))
+	api.Get("/qr/:id", auth, requirePermission(PermQRRead), validate, getQRRequestHandler(db))
+	api.Put("/qr/:id", auth, requirePermission(PermQRUpdate), validate, updateQRRequestHandler(db))
+	api.Post("/qr/:id/cancel", auth, requirePermission(PermQRCancel), validate, cancelQRRequestHandler(db))
+	api.Put("/qr/:id/hold", auth, requirePermission(PermLegalHold), validate, setLegalHold(db, true))
+	api.Delete("/qr/:id/hold", auth, requirePermission(PermLegalHold), validate, setLegalHold(db, false))
+	api.Get("/qr/:id/slip.pdf", auth, requirePermission(PermQRRead), validate, handler.slipPDFHandler(slipKindPayment))
+	api.Get("/qr/:id/receipt.pdf", auth, requirePermission(PermQRRead), validate, handler.slipPDFHandler(slipKindReceipt))
+	api.Get("/qr/:id/audit", auth, requirePermission(PermAuditRead), validate, getQRAuditHandler(db))
+	api.Post("/slips/verify", auth, requirePermission(PermSlipVerify), validate, handler.verifySlip)
+	api.Post("/sandbox/qr/:id/simulate-payment", auth, requirePermission(PermSandboxPay), validate, handler.simulatePayment)
+
+	// Invoices issue bill-payment QRs for their total
+	api.Post("/invoices", auth, requirePermission(PermInvoiceWrite), validate, handler.createInvoice)
+	api.Get("/invoices", auth, requirePermission(PermInvoiceRead), validate, handler.listInvoices)
+	api.Get("/invoices/:id", auth, requirePermission(PermInvoiceRead), validate, handler.getInvoice)
+	api.Post("/invoices/:id/finalize", auth, requirePermission(PermInvoiceWrite), validate, handler.finalizeInvoiceHandler)
+
+	// Billing schedules issue a bill-payment QR every cycle
+	api.Post("/billing/schedules", auth, requirePermission(PermBillingWrite), validate, handler.createBillingSchedule)
+	api.Get("/billing/schedules", auth, requirePermission(PermBillingRead), validate, handler.listBillingSchedules)
+	api.Get("/billing/schedules/:id", auth, requirePermission(PermBillingRead), validate, handler.getBillingSchedule)
+	api.Post("/billing/schedules/:id/cancel", auth, requirePermission(PermBillingWrite), validate, handler.cancelBillingSchedule)
+	api.Get("/billing/schedules/:id/runs", auth, requirePermission(PermBillingRead), validate, handler.listBillingRuns)
+
+	// Exports of QR requests, streamed or written by a job
+	api.Get("/exports/qr", auth, requirePermission(PermQRRead), validate, handler.exportQRRequests)
+	api.Post("/exports/qr/jobs", auth, requirePermission(PermQRRead), validate, handler.createExportJob)
+	api.Get("/exports/jobs/:id", auth, requirePermission(PermQRRead), validate, handler.getExportJob)
+	api.Get("/exports/jobs/:id/file", auth, requirePermission(PermQRRead), validate, handler.downloadExportJob)
+
+	// Payment volume reports
+	api.Get("/reports/summary", auth, requirePermission(PermReportRead), validate, handler.reportSummary)
+
+	// References for merchants that build their own payloads
+	api.Post("/references", auth, requirePermission(PermQRCreate), validate, handler.issueReference)
+
+	// Merchant and API key management
+	api.Post("/merchants", auth, requirePermission(PermMerchantCreate), validate, handler.createMerchant)
+	api.Post("/merchants/:id/apikeys", auth, requirePermission(PermMerchantCreate), validate, handler.createMerchantAPIKey)
+	api.Get("/merchant", auth, requirePermission(PermMerchantRead), validate, handler.getCurrentMerchant)
+	api.Put("/merchant", auth, requirePermission(PermMerchantUpdate), validate, handler.updateCurrentMerchant)
+	api.Post("/merchant/notifications/test", auth, requirePermission(PermMerchantUpdate), validate, handler.testNotifications)
+	api.Post("/merchant/apikeys", auth, requirePermission(PermAPIKeyManage), validate, handler.createAPIKey)
+	api.Get("/merchant/apikeys", auth, requirePermission(PermAPIKeyManage), validate, handler.listAPIKeys)
+	api.Delete("/merchant/apikeys/:id", auth, requirePermission(PermAPIKeyManage), validate, handler.revokeAPIKey)
+
+	// Field encryption key rotation
+	api.Post("/admin/keys/rotate", auth, requirePermission(PermKeyRotate), validate, rotateKeysHandler(db))
+	// ...
 
-	// Route to inject test data into the database
-	app.Post("/injecttestdata", func(c *fiber.Ctx) error {
-		if err := InjectTestData(db); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-		}
-		return c.SendString("Test data injection completed.")
-	})
+	// The test-data routes can rewrite the database, so they only exist in
+	// dev mode and even then require an admin
+	if cfg.DevMode {
+		// Route to set up the database schema
+		api.Post("/mockupdb", auth, requirePermission(PermTestData), validate, func(c *fiber.Ctx) error {
+			if err := MockupDB(db); err != nil {
+				return internalError(err)
+			}
+			return c.SendString("Database schema setup completed.")
+		})
+
+		// Route to inject test data into the database
+		api.Post("/injecttestdata", auth, requirePermission(PermTestData), validate, func(c *fiber.Ctx) error {
+			if err := InjectTestData(db); err != nil {
+				return internalError(err)
+			}
+			return c.SendString("Test data injection completed.")
+		})
+	}
 
 	// Other routes...
-	app.Post("/login", login)
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "ok"})
-	})
+	api.Post("/login", validate, loginHandler(cfg, db))
+
+	// Operational endpoints stay unversioned
+	readiness := NewReadiness(db, handler.lifecycle, cfg.ReadinessTimeout, cfg.ReadinessCacheTTL)
+	if cfg.MetricsPort == "" {
+		// Metrics carry per-merchant revenue
+		app.Get("/metrics", auth, requirePermission(PermMetricsRead), metricsHandler())
+	}
+	app.Get("/livez", livezHandler)
+	app.Get("/readyz", readyzHandler(readiness))
+	// Kept for clients of the old health check
+	app.Get("/health", readyzHandler(readiness))
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("QR generator service up!")
 	})
 	// ...
 }
 
-func (h *Handler) generateQR(c *fiber.Ctx) error {
-	data := new(RequestData)
-	if err := c.BodyParser(data); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
-	}
-
-	// Generate QR code data
-	qrCodeData := GenerateBillPaymentQRCode(uuid.New().String(), data.BillerId, data.MerchantName, data.Reference1, data.Reference2, data.Amount, data.Onetime)
-
-	// Create and populate a new QRRequest instance
-	qrRequest := &QRRequest{
-		// Assign appropriate values to each field
-		ID:            uuid.New().String(),
-		TxID:          data.TxId,
-		Type:          "promptpay",
-		RecipientID:   data.RecipientId,
-		RecipientType: data.RecipientType,
-		MerchantName:  data.MerchantName,
-		Reference1:    data.Reference1,
-		Reference2:    data.Reference2,
-		Amount:        data.Amount,
-		Onetime:       data.Onetime,
-		Remark:        data.Remark,
-		CreatedAt:     time.Now().Unix(),
-		QRCode:        qrCodeData,
-		Expire:        data.Expire,
-		// ... other necessary fields ...
-	}
-
-	// Save the QRRequest to the database
-	if err := CreateQRRequest(h.db, qrRequest); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-	}
-
-	return c.JSON(qrRequest)
-}
-
 type Handler struct {
-	db *gorm.DB
+	db             *gorm.DB
+	lifecycle      *Lifecycle
+	slipProvider   SlipProvider
+	callbackClient *http.Client
+	callbacks      sync.WaitGroup
+	slipRenderer   *SlipRenderer
+	notifications  *Notifications
+	exportDir      string
 }
 
-func NewHandler(db *gorm.DB) *Handler {
-	return &Handler{db: db}
+func NewHandler(db *gorm.DB, lifecycle *Lifecycle) *Handler {
+	return &Handler{
+		db:             db,
+		lifecycle:      lifecycle,
+		callbackClient: newWebhookClient(callbackTimeout),
+		slipRenderer:   &SlipRenderer{},
+		notifications:  NewNotifications(),
+	}
 }
 
 func (h *Handler) ExecuteJob(args ...interface{}) (interface{}, error) {
@@ -319,20 +848,6 @@ func (h *Handler) ExecuteJob(args ...interface{}) (interface{}, error) {
 	return nil, nil
 }
 
-type RequestData struct {
-	BillerId      string  `json:"billerId"`
-	MerchantName  string  `json:"merchantName"`
-	Reference1    string  `json:"reference1"`
-	Reference2    string  `json:"reference2"`
-	Amount        float64 `json:"amount"`
-	Onetime       bool    `json:"onetime"`
-	TxId          string  `json:"txId"`          // Transaction ID
-	RecipientId   string  `json:"recipientId"`   // Recipient ID
-	RecipientType string  `json:"recipientType"` // Recipient Type
-	Remark        string  `json:"remark"`        // Additional Remark
-	Expire        int64   `json:"expire"`        // Expiration time
-}
-
 // type RequestData struct {
 // 	BillerId     string  `json:"billerId"`
 // 	MerchantName string  `json:"merchantName"`
@@ -346,6 +861,9 @@ func formatAmountForQR(amount float64) string {
 	return fmt.Sprintf("%.2f", amount) // Format as a string with two decimal places
 }
 
+// formatQRField encodes one EMVCo field. The length has two digits, so
+// value must hold at most maxQRFieldLength bytes; merchantPresentedQR.encode
+// checks the fields QR requests fill in.
 func formatQRField(prefix, value string) string {
 	if len(value) != 0 {
 		if len(value) < 10 {
@@ -401,60 +919,22 @@ func trimFirstRune(s string) string {
 	return s[i:]
 }
 
-func GenerateBillPaymentQRCode(qrID, billerId, merchantName, reference1, reference2 string, amount float64, onetime bool) string {
-	amountStr := formatReceiverIDForQR(fmt.Sprintf("%.2f", amount)) // Convert amount to string in QR format
-
-	reference1 = strings.ToUpper(reference1)
-	reference2 = strings.ToUpper(reference2)
-
-	PFI := formatQRField("00", "01")
-
-	var pim_val string
-	if onetime {
-		pim_val = "12"
-	} else {
-		pim_val = "11"
-	}
-	PIM := formatQRField("01", pim_val)
-
-	/** Merchant Identifier */
-	AID := formatQRField("00", "A000000677010112")
-	billerId = formatQRField("01", billerId)
-	reference1 = formatQRField("02", reference1)
-	reference2 = formatQRField("03", reference2)
-
-	merchantSum := AID + billerId + reference1 + reference2
-	merchantIdentifier := formatQRField("30", merchantSum)
-	/* */
-
-	Currency := formatQRField("53", "764")
-
-	CountryCode := formatQRField("58", "TH")
-
-	merchantName = formatQRField("59", merchantName)
-
-	TerminalID := formatQRField("07", "")
-
-	crc := "6304"
-
-	data := PFI + PIM + merchantIdentifier + Currency + amountStr + CountryCode + merchantName + TerminalID + crc
-	dataBuffer := []byte(data)
-	crcResult := crc16.ChecksumCCITTFalse(dataBuffer)
-
-	data += strings.ToUpper(strconv.FormatInt(int64(crcResult), 16))
-
-	return data
+// GenerateBillPaymentQRCode returns the Thai PromptPay bill-payment payload,
+// see promptPayScheme
+func GenerateBillPaymentQRCode(qrID, billerId, merchantName, reference1, reference2 string, amount float64, onetime bool) (string, error) {
+	qr := &QRRequest{ID: qrID, MerchantName: merchantName, Reference1: reference1, Reference2: reference2, Amount: amount, Onetime: onetime}
+	return promptPayScheme{}.Payload(QRAccount{ID: billerId}, qr)
 }
 
 func validateAmount(amount float64) error {
 	// Check if the amount is within the desired range
 	if amount <= 0 || amount > 2000000000000000 {
-		return fmt.Errorf("amount must be greater than 0 and less than or equal to 2,000,000,000,000,000")
+		return invalidField("amount", ErrCodeAmountInvalid)
 	}
 
 	// Check if the amount has two decimal places
 	if amount != math.Floor(amount*100)/100 {
-		return fmt.Errorf("amount must have two decimal places")
+		return invalidField("amount", ErrCodeAmountPrecision)
 	}
 
 	return nil
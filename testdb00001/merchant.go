@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// defaultMerchantID owns every QRRequest created before merchants existed
+const defaultMerchantID = "default"
+
+// Merchant structure
+type Merchant struct {
+	ID                  string `gorm:"primaryKey"`
+	Name                string
+	BillerIDs           string // comma separated list of biller IDs the merchant may use
+	DefaultMerchantName string
+	Settings            MerchantSettings `gorm:"type:jsonb"`
+	CreatedAt           int64
+}
+
+// MerchantSettings holds per-merchant options stored as JSON
+type MerchantSettings struct {
+	DefaultExpireSeconds int64  `json:"defaultExpireSeconds,omitempty"`
+	Onetime              bool   `json:"onetime,omitempty"`
+	CallbackURL          string `json:"callbackUrl,omitempty"`
+	// Slip customizes the PDF payment slips and receipts
+	Slip *SlipTemplate `json:"slip,omitempty"`
+	// References generates the references /generateqr requests leave out
+	References *ReferencePatterns `json:"references,omitempty"`
+	// Schemes holds the merchant's accounts by payment scheme
+	Schemes map[string]QRAccount `json:"schemes,omitempty"`
+	// Notifications sends payment and billing events to email, chat and SMS
+	Notifications *NotificationSettings `json:"notifications,omitempty"`
+	// Retention overrides the default retention rules per status
+	Retention []RetentionRule `json:"retention,omitempty"`
+}
+
+func (s MerchantSettings) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func (s *MerchantSettings) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*s = MerchantSettings{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("cannot scan %T into MerchantSettings", value)
+}
+
+// BillerIDList returns the configured biller IDs
+func (m *Merchant) BillerIDList() []string {
+	var ids []string
+	for _, id := range strings.Split(m.BillerIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// AllowsBiller reports whether billerId belongs to the merchant. A merchant
+// without configured biller IDs may use any.
+func (m *Merchant) AllowsBiller(billerId string) bool {
+	ids := m.BillerIDList()
+	if len(ids) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		if id == billerId {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey structure. Only the SHA-256 hash of the key is stored; the prefix is
+// kept in clear so a key can be found and shown to its owner.
+type APIKey struct {
+	ID         string `gorm:"primaryKey"`
+	MerchantID string `gorm:"index"`
+	Name       string
+	Role       string
+	Prefix     string `gorm:"uniqueIndex"`
+	KeyHash    string `json:"-"`
+	CreatedAt  int64
+	LastUsedAt int64
+	RevokedAt  int64
+	// Sandbox keys only create and see test QRRequests
+	Sandbox bool
+}
+
+const apiKeyPrefix = "qrk_"
+
+// generateAPIKey returns a new key in the form qrk_<prefix>_<secret> along
+// with its public prefix and hash
+func generateAPIKey() (key, prefix, hash string, err error) {
+	idPart := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err = rand.Read(idPart); err != nil {
+		return
+	}
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	prefix = apiKeyPrefix + hex.EncodeToString(idPart)
+	key = prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	hash = hashAPIKey(key)
+	return
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+var errInvalidAPIKey = errors.New("invalid or revoked API key")
+
+// authenticateAPIKey resolves a presented API key to its active record
+func authenticateAPIKey(db *gorm.DB, key string) (*APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, errInvalidAPIKey
+	}
+	i := strings.LastIndex(key, "_")
+	if i <= len(apiKeyPrefix) {
+		return nil, errInvalidAPIKey
+	}
+
+	var apiKey APIKey
+	if err := db.First(&apiKey, "prefix = ?", key[:i]).Error; err != nil {
+		return nil, errInvalidAPIKey
+	}
+	if apiKey.RevokedAt != 0 {
+		return nil, errInvalidAPIKey
+	}
+	if apiKey.Role == "" {
+		// Keys issued before roles existed were all merchant keys
+		apiKey.Role = RoleMerchant
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashAPIKey(key))) != 1 {
+		return nil, errInvalidAPIKey
+	}
+
+	db.Model(&apiKey).Update("last_used_at", time.Now().Unix())
+	return &apiKey, nil
+}
+
+// ensureDefaultMerchant creates the default merchant and assigns it every
+// QRRequest that does not belong to a merchant yet
+func ensureDefaultMerchant(db *gorm.DB) error {
+	merchant := Merchant{ID: defaultMerchantID, Name: "Default", CreatedAt: time.Now().Unix()}
+	if err := db.Where(Merchant{ID: defaultMerchantID}).FirstOrCreate(&merchant).Error; err != nil {
+		return err
+	}
+	return db.Model(&QRRequest{}).Where("merchant_id = '' OR merchant_id IS NULL").
+		Update("merchant_id", defaultMerchantID).Error
+}
+
+func GetMerchant(db *gorm.DB, id string) (*Merchant, error) {
+	var m Merchant
+	result := db.First(&m, "id = ?", id)
+	return &m, result.Error
+}
+
+// merchantError maps errors of loading a Merchant
+func merchantError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return newAppError(fiber.StatusNotFound, ErrCodeMerchantNotFound)
+	}
+	return internalError(err)
+}
+
+// validate checks every part of the settings of merchant
+func (s *MerchantSettings) validate(merchant *Merchant) error {
+	if s.CallbackURL != "" {
+		if err := validateWebhookURL(s.CallbackURL); err != nil {
+			return validationError(FieldError{Field: "settings.callbackUrl", Code: ErrCodeFieldInvalid, Detail: err.Error()})
+		}
+	}
+	if err := s.References.validate(); err != nil {
+		return err
+	}
+	if err := validateSchemeAccounts(s.Schemes, merchant); err != nil {
+		return err
+	}
+	if err := s.Notifications.validate(); err != nil {
+		return err
+	}
+	if fields := validateRetentionRules(s.Retention, "settings.retention"); len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+// patch returns the settings with every key of patch replacing the setting
+// of the same name; a null removes it. Settings patch leaves out are kept.
+func (s MerchantSettings) patch(patch map[string]json.RawMessage) (MerchantSettings, error) {
+	current, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(current, &fields); err != nil {
+		return s, err
+	}
+	for name, value := range patch {
+		if string(value) == "null" {
+			delete(fields, name)
+		} else {
+			fields[name] = value
+		}
+	}
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return s, err
+	}
+	var out MerchantSettings
+	return out, json.Unmarshal(merged, &out)
+}
+
+// validateDefaultMerchantName checks that the name fits tag 59 of payloads
+func validateDefaultMerchantName(name string) error {
+	if len(name) > maxMerchantNameLength {
+		return validationError(FieldError{Field: "defaultMerchantName", Code: ErrCodeFieldInvalid, Detail: fmt.Sprintf("at most %d bytes", maxMerchantNameLength)})
+	}
+	return nil
+}
+
+type merchantRequest struct {
+	Name                string           `json:"name"`
+	BillerIDs           []string         `json:"billerIds"`
+	DefaultMerchantName string           `json:"defaultMerchantName"`
+	Settings            MerchantSettings `json:"settings"`
+}
+
+// merchantUpdate is the body of PUT /merchant. Fields left out keep their
+// value, and so do the settings left out of settings.
+type merchantUpdate struct {
+	Name                *string                    `json:"name"`
+	BillerIDs           *[]string                  `json:"billerIds"`
+	DefaultMerchantName *string                    `json:"defaultMerchantName"`
+	Settings            map[string]json.RawMessage `json:"settings"`
+}
+
+func (h *Handler) createMerchant(c *fiber.Ctx) error {
+	req := new(merchantRequest)
+	if err := c.BodyParser(req); err != nil {
+		return badRequestError(err)
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return invalidField("name", ErrCodeFieldRequired)
+	}
+	if err := validateDefaultMerchantName(req.DefaultMerchantName); err != nil {
+		return err
+	}
+
+	merchant := &Merchant{
+		ID:                  uuid.New().String(),
+		Name:                req.Name,
+		BillerIDs:           strings.Join(req.BillerIDs, ","),
+		DefaultMerchantName: req.DefaultMerchantName,
+		Settings:            req.Settings,
+		CreatedAt:           time.Now().Unix(),
+	}
+	if err := merchant.Settings.validate(merchant); err != nil {
+		return err
+	}
+	if err := requestDB(c, h.db).Create(merchant).Error; err != nil {
+		return internalError(err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(merchant)
+}
+
+func (h *Handler) getCurrentMerchant(c *fiber.Ctx) error {
+	merchant, err := GetMerchant(requestDB(c, h.db), currentMerchantID(c))
+	if err != nil {
+		return merchantError(err)
+	}
+	return c.JSON(merchant)
+}
+
+func (h *Handler) updateCurrentMerchant(c *fiber.Ctx) error {
+	merchant, err := GetMerchant(requestDB(c, h.db), currentMerchantID(c))
+	if err != nil {
+		return merchantError(err)
+	}
+
+	req := new(merchantUpdate)
+	if err := c.BodyParser(req); err != nil {
+		return badRequestError(err)
+	}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			return invalidField("name", ErrCodeFieldRequired)
+		}
+		merchant.Name = *req.Name
+	}
+	if req.BillerIDs != nil {
+		// The biller IDs limit which billers the merchant may be paid
+		// through, so the merchant cannot set them itself
+		if currentRole(c) != RoleAdmin {
+			return newAppError(fiber.StatusForbidden, ErrCodePermissionDenied).withDetail("only admins can change billerIds")
+		}
+		merchant.BillerIDs = strings.Join(*req.BillerIDs, ",")
+	}
+	if req.DefaultMerchantName != nil {
+		if err := validateDefaultMerchantName(*req.DefaultMerchantName); err != nil {
+			return err
+		}
+		merchant.DefaultMerchantName = *req.DefaultMerchantName
+	}
+	if req.Settings != nil {
+		settings, err := merchant.Settings.patch(req.Settings)
+		if err != nil {
+			return badRequestError(err)
+		}
+		if err := settings.validate(merchant); err != nil {
+			return err
+		}
+		merchant.Settings = settings
+	}
+
+	if err := requestDB(c, h.db).Save(merchant).Error; err != nil {
+		return internalError(err)
+	}
+	return c.JSON(merchant)
+}
+
+func (h *Handler) createAPIKey(c *fiber.Ctx) error {
+	return h.issueAPIKey(c, currentMerchantID(c))
+}
+
+// createMerchantAPIKey issues a key for the merchant in the path, so an
+// admin can hand the first key to a merchant created with POST /merchants
+func (h *Handler) createMerchantAPIKey(c *fiber.Ctx) error {
+	merchant, err := GetMerchant(requestDB(c, h.db), c.Params("id"))
+	if err != nil {
+		return merchantError(err)
+	}
+	return h.issueAPIKey(c, merchant.ID)
+}
+
+// issueAPIKey creates an API key of merchantID as described by the body
+func (h *Handler) issueAPIKey(c *fiber.Ctx, merchantID string) error {
+	req := struct {
+		Name    string `json:"name"`
+		Role    string `json:"role"`
+		Sandbox bool   `json:"sandbox"`
+	}{}
+	if err := c.BodyParser(&req); err != nil {
+		return badRequestError(err)
+	}
+	if req.Role == "" {
+		req.Role = RoleMerchant
+	}
+	if !isValidRole(req.Role) {
+		return invalidField("role", ErrCodeRoleInvalid)
+	}
+	// Nobody can hand out more than they have, e.g. a merchant cannot issue
+	// itself a compliance key to lift its own legal holds
+	if !roleWithin(req.Role, currentRole(c)) {
+		return newAppError(fiber.StatusForbidden, ErrCodePermissionDenied).
+			withDetail("the %s role has permissions you do not have", req.Role)
+	}
+
+	key, prefix, hash, err := generateAPIKey()
+	if err != nil {
+		return internalError(err)
+	}
+
+	apiKey := &APIKey{
+		ID:         uuid.New().String(),
+		MerchantID: merchantID,
+		Name:       req.Name,
+		Role:       req.Role,
+		Prefix:     prefix,
+		KeyHash:    hash,
+		CreatedAt:  time.Now().Unix(),
+		// A sandbox caller cannot issue live keys
+		Sandbox: req.Sandbox || isSandbox(c),
+	}
+	if err := requestDB(c, h.db).Create(apiKey).Error; err != nil {
+		return internalError(err)
+	}
+
+	// The full key is only ever returned here
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"apiKey": apiKey, "key": key})
+}
+
+func (h *Handler) listAPIKeys(c *fiber.Ctx) error {
+	var keys []APIKey
+	if err := requestDB(c, h.db).Where("merchant_id = ?", currentMerchantID(c)).Order("created_at").Find(&keys).Error; err != nil {
+		return internalError(err)
+	}
+	return c.JSON(keys)
+}
+
+func (h *Handler) revokeAPIKey(c *fiber.Ctx) error {
+	result := requestDB(c, h.db).Model(&APIKey{}).
+		Where("id = ? AND merchant_id = ? AND revoked_at = 0", c.Params("id"), currentMerchantID(c)).
+		Update("revoked_at", time.Now().Unix())
+	if result.Error != nil {
+		return internalError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return newAppError(fiber.StatusNotFound, ErrCodeAPIKeyNotFound)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
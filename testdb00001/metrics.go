@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// metricsRegistry holds every metric exposed on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route template, method and status class.",
+	}, []string{"method", "route", "status_class"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	qrGeneratedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_generated_total",
+		Help: "QR requests created by type and merchant.",
+	}, []string{"type", "merchant"})
+
+	qrAmountBahtTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_amount_baht_total",
+		Help: "Sum of the amounts of created QR requests in baht.",
+	}, []string{"type", "merchant"})
+
+	qrAmountBaht = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qr_amount_baht",
+		Help:    "Distribution of QR request amounts in baht.",
+		Buckets: []float64{10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000, 1000000},
+	}, []string{"type"})
+
+	qrStatusTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_status_transitions_total",
+		Help: "QR requests that became paid, expired or cancelled, by merchant.",
+	}, []string{"status", "merchant"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "gorm statement latency by operation and table.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal, httpRequestDuration,
+		qrGeneratedTotal, qrAmountBahtTotal, qrAmountBaht, qrStatusTotal,
+		dbQueryDuration,
+	)
+}
+
+// metricsMiddleware records request count and latency labelled with the
+// matched route template, never the raw path
+func metricsMiddleware(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	method := c.Method()
+	route := c.Route().Path
+	status := responseStatus(c, err)
+	// The router's own 404: only middleware matched this path
+	var fe *fiber.Error
+	if errors.As(err, &fe) && fe.Code == fiber.StatusNotFound && strings.HasPrefix(fe.Message, "Cannot "+method+" ") {
+		route = "unmatched"
+	}
+
+	httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(status/100)+"xx").Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// metricsHandler serves the Prometheus exposition format
+func metricsHandler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// observeQRCreated records a newly created QRRequest. Sandbox requests are
+// not counted.
+func observeQRCreated(qr *QRRequest) {
+	if qr.TestMode {
+		return
+	}
+	qrGeneratedTotal.WithLabelValues(qr.Type, qr.MerchantID).Inc()
+	qrAmountBahtTotal.WithLabelValues(qr.Type, qr.MerchantID).Add(qr.Amount)
+	qrAmountBaht.WithLabelValues(qr.Type).Observe(qr.Amount)
+}
+
+// observeQRStatus records a QRRequest reaching a final status
+func observeQRStatus(qr *QRRequest) {
+	if qr.TestMode {
+		return
+	}
+	qrStatusTotal.WithLabelValues(qr.Status, qr.MerchantID).Inc()
+}
+
+// registerDBMetrics adds the pool statistics of db and a gorm plugin timing
+// every statement
+func registerDBMetrics(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := metricsRegistry.Register(collectors.NewDBStatsCollector(sqlDB, "qr")); err != nil {
+		return err
+	}
+	return db.Use(&gormMetricsPlugin{})
+}
+
+// gormMetricsPlugin times every gorm statement via callbacks
+type gormMetricsPlugin struct{}
+
+const gormMetricsStartKey = "metrics:start"
+
+func (p *gormMetricsPlugin) Name() string {
+	return "metrics"
+}
+
+func (p *gormMetricsPlugin) Initialize(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(gormMetricsStartKey, time.Now())
+	}
+	after := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			v, ok := tx.InstanceGet(gormMetricsStartKey)
+			if !ok {
+				return
+			}
+			table := tx.Statement.Table
+			if table == "" {
+				table = "raw"
+			}
+			dbQueryDuration.WithLabelValues(operation, table).Observe(time.Since(v.(time.Time)).Seconds())
+		}
+	}
+
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("metrics:before_create", before),
+		cb.Create().After("gorm:create").Register("metrics:after_create", after("create")),
+		cb.Query().Before("gorm:query").Register("metrics:before_query", before),
+		cb.Query().After("gorm:query").Register("metrics:after_query", after("query")),
+		cb.Update().Before("gorm:update").Register("metrics:before_update", before),
+		cb.Update().After("gorm:update").Register("metrics:after_update", after("update")),
+		cb.Delete().Before("gorm:delete").Register("metrics:before_delete", before),
+		cb.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete")),
+		cb.Row().Before("gorm:row").Register("metrics:before_row", before),
+		cb.Row().After("gorm:row").Register("metrics:after_row", after("row")),
+		cb.Raw().Before("gorm:raw").Register("metrics:before_raw", before),
+		cb.Raw().After("gorm:raw").Register("metrics:after_raw", after("raw")),
+	)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// smtpTimeout bounds a whole SMTP delivery
+const smtpTimeout = 30 * time.Second
+
+// SMTPNotifier sends email through an SMTP relay, upgrading to TLS with
+// STARTTLS when the server offers it
+type SMTPNotifier struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (n *SMTPNotifier) Send(ctx context.Context, msg Message) error {
+	// Settings saved before addresses were normalized may hold a display
+	// name; only the bare address goes into RCPT and the header
+	addr, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return permanentError{err}
+	}
+	msg.To = addr.Address
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(n.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return permanentError{err}
+		}
+	}
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return permanentError{err}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.format(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// format renders msg as a UTF-8 plain text email
+func (n *SMTPNotifier) format(msg Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	body := base64.StdEncoding.EncodeToString([]byte(msg.Body))
+	for len(body) > 76 {
+		b.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	b.WriteString(body + "\r\n")
+	return b.Bytes()
+}
+
+// ChatNotifier posts {"text": ...} to the webhook URL of the message, which
+// Slack, Google Chat, Mattermost and Microsoft Teams all accept
+type ChatNotifier struct {
+	Client *http.Client
+}
+
+func (n *ChatNotifier) Send(ctx context.Context, msg Message) error {
+	text := msg.Body
+	if msg.Subject != "" {
+		text = "*" + msg.Subject + "*\n" + msg.Body
+	}
+	return postJSON(ctx, n.Client, msg.To, "", map[string]string{"text": text})
+}
+
+// SMSNotifier posts {"to": ..., "message": ...} to an SMS gateway
+type SMSNotifier struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (n *SMSNotifier) Send(ctx context.Context, msg Message) error {
+	return postJSON(ctx, n.Client, n.URL, n.Token, map[string]string{"to": msg.To, "message": msg.Body})
+}
+
+// postJSON posts body as JSON. Client errors other than 429 are permanent.
+func postJSON(ctx context.Context, client *http.Client, url, token string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)}
+	}
+	return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+}
+
+// FileNotifier writes every message as a JSON line to a file, or to stdout
+// for "-". It replaces the real channels when testing without network.
+type FileNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+func NewFileNotifier(path string) (*FileNotifier, error) {
+	if path == "-" {
+		return &FileNotifier{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("NOTIFY_FILE: %w", err)
+	}
+	return &FileNotifier{w: f, f: f}, nil
+}
+
+func (n *FileNotifier) Send(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(struct {
+		Time string `json:"time"`
+		Message
+	}{time.Now().Format(time.RFC3339), msg})
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.w.Write(append(line, '\n'))
+	return err
+}
+
+func (n *FileNotifier) Close() error {
+	if n.f == nil {
+		return nil
+	}
+	return n.f.Close()
+}
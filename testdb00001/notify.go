@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/mail"
+	"regexp"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Events merchants can be notified of
+const (
+	EventQRPaid     = "qr.paid"
+	EventBillIssued = "bill.issued"
+)
+
+// Notification channel types
+const (
+	ChannelEmail = "email"
+	// ChannelChat posts {"text": ...} to a chat webhook (Slack, Google Chat,
+	// Mattermost, ...)
+	ChannelChat = "chat"
+	ChannelSMS  = "sms"
+)
+
+// Message is a rendered notification for one recipient
+type Message struct {
+	Channel string `json:"channel"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages of one channel type
+type Notifier interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// NotificationSettings are the merchant's notification channels and their
+// message templates
+type NotificationSettings struct {
+	Channels []NotificationChannel `json:"channels,omitempty"`
+	// Templates override the default messages by event and language
+	Templates map[string]map[string]NotificationTemplate `json:"templates,omitempty"`
+}
+
+// NotificationChannel sends the merchant's events to one recipient
+type NotificationChannel struct {
+	Type string `json:"type"`
+	// To is an email address, a phone number (+66...) or a webhook URL
+	To string `json:"to"`
+	// Events defaults to all events
+	Events []string `json:"events,omitempty"`
+	// Language is th (default) or en
+	Language string `json:"language,omitempty"`
+}
+
+// NotificationTemplate is a text/template pair rendered with a
+// NotificationData. Chat and SMS messages only use the body.
+type NotificationTemplate struct {
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body"`
+}
+
+// NotificationData is what templates can refer to
+type NotificationData struct {
+	Event        string
+	MerchantName string
+	QRRequestID  string
+	TxID         string
+	Reference1   string
+	Reference2   string
+	// Amount is formatted with thousands separators, AmountText spells it
+	// out in Thai
+	Amount     string
+	AmountText string
+	TransRef   string
+	// PaidAt and Expire are in Bangkok time, empty when unknown
+	PaidAt   string
+	Expire   string
+	TestMode bool
+}
+
+var defaultTemplates = map[string]map[string]NotificationTemplate{
+	EventQRPaid: {
+		"th": {
+			Subject: "ได้รับชำระเงิน {{.Amount}} บาท",
+			Body:    "{{.MerchantName}} ได้รับชำระเงิน {{.Amount}} บาท ({{.AmountText}})\nอ้างอิง {{.Reference1}}{{if .Reference2}} / {{.Reference2}}{{end}}\nเลขที่รายการ {{.TransRef}} เวลา {{.PaidAt}}",
+		},
+		"en": {
+			Subject: "Payment received: {{.Amount}} THB",
+			Body:    "{{.MerchantName}} received {{.Amount}} THB\nReference {{.Reference1}}{{if .Reference2}} / {{.Reference2}}{{end}}\nTransaction {{.TransRef}} at {{.PaidAt}}",
+		},
+	},
+	EventBillIssued: {
+		"th": {
+			Subject: "ออกใบแจ้งชำระเงิน {{.Reference1}}",
+			Body:    "{{.MerchantName}} ออกใบแจ้งชำระเงิน {{.Reference1}} จำนวน {{.Amount}} บาท{{if .Expire}} ชำระภายใน {{.Expire}}{{end}}",
+		},
+		"en": {
+			Subject: "Bill {{.Reference1}} issued",
+			Body:    "{{.MerchantName}} issued bill {{.Reference1}} for {{.Amount}} THB{{if .Expire}}, due {{.Expire}}{{end}}",
+		},
+	},
+}
+
+var (
+	phonePattern = regexp.MustCompile(`^\+?[0-9]{8,15}$`)
+	languages    = []string{"th", "en"}
+)
+
+// validate reports invalid channels and templates of merchant settings
+func (s *NotificationSettings) validate() error {
+	if s == nil {
+		return nil
+	}
+	var fields []FieldError
+	invalid := func(field, detail string) {
+		fields = append(fields, FieldError{Field: field, Code: ErrCodeFieldInvalid, Detail: detail})
+	}
+	for i, ch := range s.Channels {
+		prefix := fmt.Sprintf("settings.notifications.channels.%d.", i)
+		switch ch.Type {
+		case ChannelEmail:
+			// Keep the bare address, it goes into SMTP RCPT as is
+			if addr, err := mail.ParseAddress(ch.To); err != nil {
+				invalid(prefix+"to", "an email address")
+			} else {
+				s.Channels[i].To = addr.Address
+			}
+		case ChannelSMS:
+			if !phonePattern.MatchString(ch.To) {
+				invalid(prefix+"to", "a phone number, e.g. +66812345678")
+			}
+		case ChannelChat:
+			if err := validateWebhookURL(ch.To); err != nil {
+				invalid(prefix+"to", "a webhook URL: "+err.Error())
+			}
+		default:
+			invalid(prefix+"type", "email, chat or sms")
+		}
+		for j, event := range ch.Events {
+			if _, ok := defaultTemplates[event]; !ok {
+				invalid(fmt.Sprintf("%sevents.%d", prefix, j), "qr.paid or bill.issued")
+			}
+		}
+		if ch.Language != "" && ch.Language != "th" && ch.Language != "en" {
+			invalid(prefix+"language", "th or en")
+		}
+	}
+	for event, byLang := range s.Templates {
+		if _, ok := defaultTemplates[event]; !ok {
+			invalid("settings.notifications.templates."+event, "qr.paid or bill.issued")
+			continue
+		}
+		for lang, tpl := range byLang {
+			field := "settings.notifications.templates." + event + "." + lang
+			if lang != "th" && lang != "en" {
+				invalid(field, "th or en")
+				continue
+			}
+			if _, err := template.New("").Parse(tpl.Subject); err != nil {
+				invalid(field+".subject", err.Error())
+			}
+			if _, err := template.New("").Parse(tpl.Body); err != nil {
+				invalid(field+".body", err.Error())
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+// wants reports whether ch is subscribed to event
+func (ch NotificationChannel) wants(event string) bool {
+	if len(ch.Events) == 0 {
+		return true
+	}
+	for _, e := range ch.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// render fills the merchant's template, or the default one, for ch
+func (s *NotificationSettings) render(ch NotificationChannel, data NotificationData) (Message, error) {
+	lang := ch.Language
+	if lang == "" {
+		lang = languages[0]
+	}
+	tpl := defaultTemplates[data.Event][lang]
+	if custom, ok := s.Templates[data.Event][lang]; ok {
+		tpl = custom
+	}
+
+	msg := Message{Channel: ch.Type, To: ch.To}
+	for _, part := range []struct {
+		text string
+		out  *string
+	}{{tpl.Subject, &msg.Subject}, {tpl.Body, &msg.Body}} {
+		t, err := template.New("").Parse(part.text)
+		if err != nil {
+			return msg, err
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return msg, err
+		}
+		*part.out = buf.String()
+	}
+	if data.TestMode {
+		msg.Subject = "[TEST] " + msg.Subject
+		msg.Body = "[TEST] " + msg.Body
+	}
+	return msg, nil
+}
+
+// newNotificationData describes an event of qr
+func newNotificationData(event string, qr *QRRequest) NotificationData {
+	amount := Money(math.Round(qr.Amount * 100))
+	return NotificationData{
+		Event:        event,
+		MerchantName: qr.MerchantName,
+		QRRequestID:  qr.ID,
+		TxID:         qr.TxID,
+		Reference1:   qr.Reference1,
+		Reference2:   qr.Reference2,
+		Amount:       formatBaht(amount),
+		AmountText:   bahtText(amount),
+		Expire:       formatSlipTime(qr.Expire),
+		TestMode:     qr.TestMode,
+	}
+}
+
+// Notifications delivers merchant notifications in the background, rate
+// limited per merchant and retried with backoff
+type Notifications struct {
+	notifiers map[string]Notifier
+	// override, when set, receives every message instead, see NOTIFY_FILE
+	override  Notifier
+	rateLimit int
+	retries   int
+	retryWait time.Duration
+
+	mu     sync.Mutex
+	window time.Time
+	sent   map[string]int
+
+	inflight sync.WaitGroup
+}
+
+// NewNotifications returns a dispatcher without channels; messages are
+// dropped until notifiers are registered
+func NewNotifications() *Notifications {
+	return &Notifications{
+		notifiers: make(map[string]Notifier),
+		rateLimit: 60,
+		retries:   3,
+		retryWait: time.Second,
+		sent:      make(map[string]int),
+	}
+}
+
+// setupNotifications registers the notifiers configured by cfg
+func setupNotifications(cfg *Config, lifecycle *Lifecycle) (*Notifications, error) {
+	n := NewNotifications()
+	n.rateLimit = cfg.NotifyRateLimit
+	n.retries = cfg.NotifyRetries
+
+	smtpAddr := ""
+	if cfg.SMTPHost != "" {
+		smtpAddr = cfg.SMTPHost + ":" + cfg.SMTPPort
+	}
+	if cfg.SMTPFake {
+		server, err := startFakeSMTPServer("127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("fake SMTP server: %w", err)
+		}
+		lifecycle.OnShutdown("fake smtp", func(context.Context) error { return server.Close() })
+		smtpAddr = server.Addr()
+		slog.Info("fake SMTP server started, emails are only logged", "addr", smtpAddr)
+	}
+	if smtpAddr != "" {
+		n.notifiers[ChannelEmail] = &SMTPNotifier{
+			Addr:     smtpAddr,
+			From:     cfg.SMTPFrom,
+			Username: cfg.SMTPUser,
+			Password: cfg.SMTPPassword,
+		}
+	}
+
+	// Chat webhooks are chosen by merchants, the SMS gateway by the operator
+	n.notifiers[ChannelChat] = &ChatNotifier{Client: newWebhookClient(callbackTimeout)}
+	if cfg.SMSGatewayURL != "" {
+		n.notifiers[ChannelSMS] = &SMSNotifier{URL: cfg.SMSGatewayURL, Token: cfg.SMSGatewayToken, Client: newOutboundClient(callbackTimeout)}
+	}
+
+	if cfg.NotifyFile != "" {
+		file, err := NewFileNotifier(cfg.NotifyFile)
+		if err != nil {
+			return nil, err
+		}
+		lifecycle.OnShutdown("notify file", func(context.Context) error { return file.Close() })
+		n.override = file
+	}
+
+	lifecycle.OnShutdown("notifications", n.Wait)
+	return n, nil
+}
+
+// notifier returns the notifier of a channel type
+func (n *Notifications) notifier(channel string) (Notifier, bool) {
+	if n.override != nil {
+		return n.override, true
+	}
+	notifier, ok := n.notifiers[channel]
+	return notifier, ok
+}
+
+// allow counts a message of merchantID against the per-minute rate limit
+func (n *Notifications) allow(merchantID string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if window := now.Truncate(time.Minute); !window.Equal(n.window) {
+		n.window = window
+		n.sent = make(map[string]int)
+	}
+	if n.rateLimit > 0 && n.sent[merchantID] >= n.rateLimit {
+		return false
+	}
+	n.sent[merchantID]++
+	return true
+}
+
+// Notify sends data to every channel of the merchant subscribed to its
+// event. Delivery happens in the background and failures are logged.
+func (n *Notifications) Notify(ctx context.Context, merchant *Merchant, data NotificationData) {
+	settings := merchant.Settings.Notifications
+	if settings == nil {
+		return
+	}
+	if data.MerchantName == "" {
+		data.MerchantName = merchant.Name
+	}
+	for _, ch := range settings.Channels {
+		if !ch.wants(data.Event) {
+			continue
+		}
+		log := slog.With("merchant_id", merchant.ID, "event", data.Event, "channel", ch.Type)
+		notifier, ok := n.notifier(ch.Type)
+		if !ok {
+			log.DebugContext(ctx, "notification channel not configured")
+			continue
+		}
+		msg, err := settings.render(ch, data)
+		if err != nil {
+			log.WarnContext(ctx, "notification template failed", "error", err)
+			continue
+		}
+		if !n.allow(merchant.ID, time.Now()) {
+			log.WarnContext(ctx, "notification rate limit exceeded, message dropped")
+			continue
+		}
+
+		n.inflight.Add(1)
+		go func() {
+			defer n.inflight.Done()
+			if err := n.deliver(ctx, notifier, msg); err != nil {
+				log.WarnContext(ctx, "notification failed", "error", err)
+			}
+		}()
+	}
+}
+
+// deliver sends msg, retrying failures that are not permanent
+func (n *Notifications) deliver(ctx context.Context, notifier Notifier, msg Message) error {
+	wait := n.retryWait
+	for attempt := 0; ; attempt++ {
+		err := notifier.Send(ctx, msg)
+		var permanent permanentError
+		if err == nil || attempt >= n.retries || errors.As(err, &permanent) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// Wait blocks until messages in flight are delivered or ctx ends
+func (n *Notifications) Wait(ctx context.Context) error {
+	return waitContext(ctx, &n.inflight, "notifications")
+}
+
+// testNotifications handles POST /merchant/notifications/test. It sends a
+// sample event to every subscribed channel right away, without retries, and
+// reports the result per channel. Test messages count against the rate
+// limit, and delivery errors are logged rather than returned since they can
+// describe hosts the caller should not learn about.
+func (h *Handler) testNotifications(c *fiber.Ctx) error {
+	req := struct {
+		Event string `json:"event"`
+	}{Event: EventQRPaid}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return badRequestError(err)
+		}
+	}
+	if _, ok := defaultTemplates[req.Event]; !ok {
+		return invalidField("event", ErrCodeFieldInvalid)
+	}
+
+	merchant, err := GetMerchant(requestDB(c, h.db), currentMerchantID(c))
+	if err != nil {
+		return merchantError(err)
+	}
+	sample := &QRRequest{
+		ID:           "00000000-0000-0000-0000-000000000000",
+		MerchantName: merchant.DefaultMerchantName,
+		Reference1:   "TEST0001",
+		Amount:       1250.50,
+		Expire:       time.Now().Add(24 * time.Hour).Unix(),
+		TestMode:     true,
+	}
+	data := newNotificationData(req.Event, sample)
+	data.TransRef = "TEST0000000001"
+	data.PaidAt = formatSlipTime(time.Now().Unix())
+	if data.MerchantName == "" {
+		data.MerchantName = merchant.Name
+	}
+
+	type result struct {
+		Channel string `json:"channel"`
+		To      string `json:"to"`
+		Sent    bool   `json:"sent"`
+		Error   string `json:"error,omitempty"`
+	}
+	results := []result{}
+	settings := merchant.Settings.Notifications
+	if settings == nil {
+		settings = &NotificationSettings{}
+	}
+	for _, ch := range settings.Channels {
+		if !ch.wants(req.Event) {
+			continue
+		}
+		r := result{Channel: ch.Type, To: ch.To}
+		if notifier, ok := h.notifications.notifier(ch.Type); !ok {
+			r.Error = "channel not configured on the server"
+		} else if msg, err := settings.render(ch, data); err != nil {
+			r.Error = err.Error()
+		} else if !h.notifications.allow(merchant.ID, time.Now()) {
+			r.Error = "rate limit exceeded"
+		} else if err := notifier.Send(c.UserContext(), msg); err != nil {
+			slog.WarnContext(c.UserContext(), "test notification failed", "merchant_id", merchant.ID, "channel", ch.Type, "error", err)
+			r.Error = "delivery failed"
+		} else {
+			r.Sent = true
+		}
+		results = append(results, r)
+	}
+	return c.JSON(fiber.Map{"results": results})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// apiPrefix is where the public API is mounted, matching the server URL of
+// openapi.yaml
+const apiPrefix = "/v1"
+
+// openAPISpec is the hand-maintained contract of the public API
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// OpenAPI serves the API document and validates requests against it
+type OpenAPI struct {
+	doc    *openapi3.T
+	router routers.Router
+	json   []byte
+}
+
+// loadOpenAPI parses and validates the embedded document
+func loadOpenAPI() (*OpenAPI, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("openapi.yaml: %v", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("openapi.yaml: %v", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("openapi.yaml: %v", err)
+	}
+	data, err := doc.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAPI{doc: doc, router: router, json: data}, nil
+}
+
+// specHandler serves the document as JSON
+func (o *OpenAPI) specHandler(c *fiber.Ctx) error {
+	c.Type("json")
+	return c.Send(o.json)
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at the document
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>QR generator API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>`
+
+func swaggerUIHandler(c *fiber.Ctx) error {
+	c.Type("html")
+	return c.SendString(swaggerUIPage)
+}
+
+// validateRequest rejects requests whose parameters or body do not match the
+// document. Authentication is left to the route handlers.
+func (o *OpenAPI) validateRequest(c *fiber.Ctx) error {
+	req, err := adaptor.ConvertRequest(c, false)
+	if err != nil {
+		return badRequestError(err)
+	}
+	route, pathParams, err := o.router.FindRoute(req)
+	if err != nil {
+		// Not part of the API; the router answers 404 or 405. checkRoutes
+		// makes sure every mounted route is documented.
+		return c.Next()
+	}
+
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			MultiError:         true,
+		},
+	}
+	if err := openapi3filter.ValidateRequest(c.UserContext(), input); err != nil {
+		return openAPIValidationError(err)
+	}
+	return c.Next()
+}
+
+// openAPIValidationError turns the validator's errors into field errors
+func openAPIValidationError(err error) error {
+	errs := []error{err}
+	var multi openapi3.MultiError
+	if errors.As(err, &multi) {
+		errs = multi
+	}
+
+	var fields []FieldError
+	for _, e := range errs {
+		var reqErr *openapi3filter.RequestError
+		if !errors.As(e, &reqErr) {
+			continue
+		}
+		field := FieldError{Field: "body", Code: ErrCodeFieldInvalid, Detail: reqErr.Reason}
+		if reqErr.Parameter != nil {
+			field.Field = reqErr.Parameter.Name
+		}
+
+		var schemaErr *openapi3.SchemaError
+		if errors.As(reqErr.Err, &schemaErr) {
+			if path := schemaErr.JSONPointer(); len(path) > 0 {
+				field.Field = strings.Join(path, ".")
+			}
+			field.Detail = schemaErr.Reason
+			if schemaErr.SchemaField == "required" {
+				field.Code = ErrCodeFieldRequired
+			}
+		} else if field.Detail == "" && reqErr.Err != nil {
+			field.Detail = reqErr.Err.Error()
+		}
+		fields = append(fields, field)
+	}
+
+	if len(fields) == 0 {
+		return badRequestError(err)
+	}
+	return validationError(fields...)
+}
+
+var fiberParam = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+// checkRoutes fails when a route mounted under apiPrefix is missing from the
+// document or a documented operation is not mounted, so the two cannot
+// drift. Operations marked x-dev-only are only mounted in dev mode.
+func (o *OpenAPI) checkRoutes(routes []fiber.Route, devMode bool) error {
+	mounted := make(map[string]bool)
+	var errs []error
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Path, apiPrefix+"/") || r.Method == fiber.MethodHead {
+			continue
+		}
+		path := fiberParam.ReplaceAllString(strings.TrimPrefix(r.Path, apiPrefix), "{$1}")
+		if path == "/openapi.json" || path == "/docs" {
+			continue
+		}
+		key := r.Method + " " + path
+		if mounted[key] {
+			continue
+		}
+		mounted[key] = true
+
+		item := o.doc.Paths.Find(path)
+		if item == nil || item.GetOperation(r.Method) == nil {
+			errs = append(errs, fmt.Errorf("route %s %s is not documented in openapi.yaml", r.Method, r.Path))
+		}
+	}
+
+	for path, item := range o.doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			if devOnly, _ := op.Extensions["x-dev-only"].(bool); devOnly && !devMode {
+				continue
+			}
+			if !mounted[method+" "+path] {
+				errs = append(errs, fmt.Errorf("openapi.yaml documents %s %s%s which is not mounted", method, apiPrefix, path))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
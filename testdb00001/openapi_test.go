@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// An invalid body from an unauthenticated caller is answered with 401, not
+// with the validation errors of the API document
+func TestValidationRunsAfterAuth(t *testing.T) {
+	srv := newTestServer(t, nil)
+
+	resp, err := http.Post(srv.URL+apiPrefix+"/generateqr", "application/json", strings.NewReader(`{"amount": "lots"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
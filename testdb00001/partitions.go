@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// qr_requests is range partitioned by the month of created_at, in UTC.
+// Partitions are named qr_requests_YYYYMM; the partition worker creates
+// them ahead of time and detaches old ones, which are kept as plain tables.
+
+const (
+	qrRequestsTable = "qr_requests"
+	// qrIDSlack bounds how far the time in a QRRequest ID may be from its
+	// CreatedAt
+	qrIDSlack = time.Hour
+)
+
+func init() {
+	schema.RegisterSerializer("timestamptz", timestamptzSerializer{})
+}
+
+// timestamptzSerializer keeps int64 Unix seconds in a timestamptz column,
+// with zero stored as NULL
+type timestamptzSerializer struct{}
+
+func (timestamptzSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var t sql.NullTime
+	if err := t.Scan(dbValue); err != nil {
+		return err
+	}
+	var unix int64
+	if t.Valid {
+		unix = t.Time.Unix()
+	}
+	return field.Set(ctx, dst, unix)
+}
+
+func (timestamptzSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	unix, ok := fieldValue.(int64)
+	if !ok {
+		return nil, fmt.Errorf("cannot store %T in timestamptz", fieldValue)
+	}
+	if unix == 0 {
+		return nil, nil
+	}
+	return time.Unix(unix, 0).UTC(), nil
+}
+
+// newQRRequestID returns a time-ordered UUID (version 7) carrying
+// createdAt, so lookups by ID only search the partitions around it
+func newQRRequestID(createdAt time.Time) string {
+	id := uuid.New()
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(createdAt.UnixMilli()))
+	copy(id[:6], ms[2:])
+	id[6] = id[6]&0x0f | 0x70
+	return id.String()
+}
+
+// qrIDTime returns the creation time carried by a version 7 ID
+func qrIDTime(id string) (time.Time, bool) {
+	u, err := uuid.Parse(id)
+	if err != nil || u.Version() != 7 {
+		return time.Time{}, false
+	}
+	var ms [8]byte
+	copy(ms[2:], u[:6])
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(ms[:]))), true
+}
+
+// whereQRRequestID selects the QRRequest id. IDs made by newQRRequestID
+// also bound created_at, which limits the lookup to one or two partitions.
+func whereQRRequestID(db *gorm.DB, id string) *gorm.DB {
+	db = db.Where("id = ?", id)
+	if t, ok := qrIDTime(id); ok {
+		db = db.Where("created_at >= ? AND created_at < ?", t.Add(-qrIDSlack), t.Add(qrIDSlack))
+	}
+	return db
+}
+
+// QRIdempotencyKey enforces that an Idempotency-Key is used once per
+// merchant. A unique index on the partitioned qr_requests would have to
+// include created_at and so could not.
+type QRIdempotencyKey struct {
+	MerchantID     string `gorm:"primaryKey"`
+	IdempotencyKey string `gorm:"primaryKey"`
+	QRRequestID    string `gorm:"index"`
+	CreatedAt      int64
+}
+
+// monthStart returns the first instant of the UTC month of t
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func partitionName(table string, month time.Time) string {
+	return table + "_" + month.Format("200601")
+}
+
+// ensurePartitions creates the monthly partitions of table holding months
+func ensurePartitions(tx *gorm.DB, table string, months []time.Time) error {
+	if len(months) == 0 {
+		return nil
+	}
+	// Serialise instances creating the same partition
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "partitions:"+table).Error; err != nil {
+		return err
+	}
+	for _, month := range months {
+		start := monthStart(month)
+		err := tx.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			partitionName(table, start), table, start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339))).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relationKind returns the pg_class relkind of table, "r" for a plain and
+// "p" for a partitioned table, or "" when it does not exist
+func relationKind(db *gorm.DB, table string) (string, error) {
+	var kind string
+	err := db.Raw("SELECT COALESCE((SELECT relkind::text FROM pg_class WHERE oid = to_regclass(?)), '')", table).Scan(&kind).Error
+	return kind, err
+}
+
+// setupPartitionedQRRequests creates qr_requests partitioned by month, or
+// converts the unpartitioned table of earlier versions. The conversion
+// copies every row in one transaction with the table locked, so writers
+// wait until it is done.
+func setupPartitionedQRRequests(db *gorm.DB) error {
+	kind, err := relationKind(db, qrRequestsTable)
+	if err != nil || kind == "p" {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&QRIdempotencyKey{}); err != nil {
+			return err
+		}
+		if kind == "" {
+			if err := createPartitionedQRRequests(tx); err != nil {
+				return err
+			}
+			return ensurePartitions(tx, qrRequestsTable, []time.Time{time.Now()})
+		}
+
+		slog.Warn("partitioning qr_requests, writers wait until all rows are copied")
+		if err := tx.Exec("LOCK TABLE " + qrRequestsTable + " IN ACCESS EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		legacy, err := renameToLegacy(tx, qrRequestsTable)
+		if err != nil {
+			return err
+		}
+		if err := createPartitionedQRRequests(tx); err != nil {
+			return err
+		}
+		if err := copyLegacyRows(tx, legacy, qrRequestsTable); err != nil {
+			return err
+		}
+		err = tx.Exec(`INSERT INTO qr_idempotency_keys (merchant_id, idempotency_key, qr_request_id, created_at)
+SELECT merchant_id, idempotency_key, id, extract(epoch FROM created_at)::bigint FROM ` + qrRequestsTable + `
+WHERE idempotency_key <> '' ON CONFLICT DO NOTHING`).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("DROP TABLE " + legacy).Error
+	})
+}
+
+func createPartitionedQRRequests(tx *gorm.DB) error {
+	return tx.Set("gorm:table_options", "PARTITION BY RANGE (created_at)").Migrator().CreateTable(&QRRequest{})
+}
+
+// renameToLegacy moves table, its indexes and its partitions out of the way
+// of a new table of the same name, and returns the new name of table
+func renameToLegacy(tx *gorm.DB, table string) (string, error) {
+	var relations []struct {
+		Name string
+		Kind string
+	}
+	err := tx.Raw(`SELECT c.relname AS name, c.relkind::text AS kind FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+WHERE i.indrelid = to_regclass(?)
+UNION ALL
+SELECT c.relname, c.relkind::text FROM pg_inherits h JOIN pg_class c ON c.oid = h.inhrelid
+WHERE h.inhparent = to_regclass(?)`, table, table).Scan(&relations).Error
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range relations {
+		statement := "ALTER TABLE %s RENAME TO %s"
+		if rel.Kind == "i" || rel.Kind == "I" {
+			statement = "ALTER INDEX %s RENAME TO %s"
+		}
+		if err := tx.Exec(fmt.Sprintf(statement, rel.Name, rel.Name+"_legacy")).Error; err != nil {
+			return "", err
+		}
+	}
+	legacy := table + "_legacy"
+	return legacy, tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", table, legacy)).Error
+}
+
+// copyLegacyRows copies the rows of from into the partitioned table to,
+// creating the partitions they need. Unix second columns of from become
+// timestamptz where to has them so; zero becomes NULL except in
+// created_at.
+func copyLegacyRows(tx *gorm.DB, from, to string) error {
+	columnTypes := func(table string) (map[string]string, error) {
+		var columns []struct {
+			ColumnName string
+			DataType   string
+		}
+		err := tx.Raw(`SELECT column_name, data_type FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name = ?`, table).Scan(&columns).Error
+		types := make(map[string]string, len(columns))
+		for _, c := range columns {
+			types[c.ColumnName] = c.DataType
+		}
+		return types, err
+	}
+	source, err := columnTypes(from)
+	if err != nil {
+		return err
+	}
+	target, err := columnTypes(to)
+	if err != nil {
+		return err
+	}
+
+	var names, values []string
+	createdAt := "created_at"
+	for name, dataType := range target {
+		sourceType, ok := source[name]
+		if !ok {
+			continue
+		}
+		value := name
+		if dataType == "timestamp with time zone" && (sourceType == "bigint" || sourceType == "integer") {
+			value = fmt.Sprintf("to_timestamp(NULLIF(%s, 0))", name)
+			if name == "created_at" {
+				value = "to_timestamp(created_at)"
+			}
+		}
+		if name == "created_at" {
+			createdAt = value
+		}
+		names = append(names, name)
+		values = append(values, value)
+	}
+
+	var months []time.Time
+	err = tx.Raw(fmt.Sprintf("SELECT DISTINCT date_trunc('month', %s AT TIME ZONE 'UTC') FROM %s", createdAt, from)).
+		Scan(&months).Error
+	if err != nil {
+		return err
+	}
+	if err := ensurePartitions(tx, to, months); err != nil {
+		return err
+	}
+	return tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s",
+		to, strings.Join(names, ", "), strings.Join(values, ", "), from)).Error
+}
+
+// runPartitionWorker keeps the partitions of qr_requests ahead of time and
+// detaches old ones every interval until ctx is cancelled
+func runPartitionWorker(ctx context.Context, db *gorm.DB, premake, detachAfter int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := maintainPartitions(ctx, db, time.Now(), premake, detachAfter); err != nil {
+			slog.ErrorContext(ctx, "partition worker failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maintainPartitions creates the partitions of this month and the premake
+// months after it and, unless detachAfter is 0, detaches the partitions of
+// months more than detachAfter months before this one
+func maintainPartitions(ctx context.Context, db *gorm.DB, now time.Time, premake, detachAfter int) error {
+	current := monthStart(now)
+	months := make([]time.Time, premake+1)
+	for i := range months {
+		months[i] = current.AddDate(0, i, 0)
+	}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return ensurePartitions(tx, qrRequestsTable, months)
+	})
+	if err != nil || detachAfter == 0 {
+		return err
+	}
+
+	var partitions []string
+	err = db.WithContext(ctx).Raw(`SELECT c.relname FROM pg_inherits h JOIN pg_class c ON c.oid = h.inhrelid
+WHERE h.inhparent = to_regclass(?) ORDER BY c.relname`, qrRequestsTable).Scan(&partitions).Error
+	if err != nil {
+		return err
+	}
+	oldest := current.AddDate(0, -detachAfter, 0)
+	for _, name := range partitions {
+		month, err := time.Parse("200601", strings.TrimPrefix(name, qrRequestsTable+"_"))
+		if err != nil || !month.Before(oldest) {
+			continue
+		}
+		if err := detachPartition(ctx, db, name); err != nil {
+			return fmt.Errorf("detach %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// detachPartition detaches a partition of qr_requests unless it holds
+// requests on legal hold or still pending, which have to stay reachable.
+// The partition is checked under a SHARE lock of its own, which keeps its
+// rows from changing, so the ACCESS EXCLUSIVE lock DETACH takes on
+// qr_requests is only held from the DETACH to the commit and not for the
+// scan of the month.
+func detachPartition(ctx context.Context, db *gorm.DB, name string) error {
+	kept := false
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Rather give up until the next run than queue all QR traffic
+		// behind a DETACH waiting for a long transaction
+		if err := tx.Exec("SET LOCAL lock_timeout = '5s'").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN SHARE MODE", name)).Error; err != nil {
+			return err
+		}
+		err := tx.Raw(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE legal_hold OR status = ?)", name), QRStatusPending).
+			Scan(&kept).Error
+		if err != nil {
+			return err
+		}
+		if kept {
+			return errPartitionKept
+		}
+		err = tx.Exec(fmt.Sprintf(`DELETE FROM qr_idempotency_keys k USING %s p
+WHERE k.merchant_id = p.merchant_id AND k.qr_request_id = p.id`, name)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", qrRequestsTable, name)).Error
+	})
+	if kept {
+		slog.WarnContext(ctx, "partition not detached, it holds requests on legal hold or pending", "partition", name)
+		return nil
+	}
+	if err == nil {
+		slog.InfoContext(ctx, "detached partition", "partition", name)
+	}
+	return err
+}
+
+var errPartitionKept = errors.New("partition holds requests that must stay")
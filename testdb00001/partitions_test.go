@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPartitionNaming(t *testing.T) {
+	bangkok := time.FixedZone("ICT", 7*60*60)
+	tests := []struct {
+		at        time.Time
+		name      string
+		start, to string
+	}{
+		{time.Date(2025, time.March, 15, 12, 0, 0, 0, time.UTC), "qr_requests_202503", "2025-03-01T00:00:00Z", "2025-04-01T00:00:00Z"},
+		{time.Date(2025, time.December, 31, 23, 59, 59, 0, time.UTC), "qr_requests_202512", "2025-12-01T00:00:00Z", "2026-01-01T00:00:00Z"},
+		// Still December in UTC
+		{time.Date(2026, time.January, 1, 6, 0, 0, 0, bangkok), "qr_requests_202512", "2025-12-01T00:00:00Z", "2026-01-01T00:00:00Z"},
+		{time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC), "qr_requests_202402", "2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		start := monthStart(tt.at)
+		if got := partitionName(qrRequestsTable, start); got != tt.name {
+			t.Errorf("partitionName(%s) = %s, want %s", tt.at, got, tt.name)
+		}
+		if got := start.Format(time.RFC3339); got != tt.start {
+			t.Errorf("monthStart(%s) = %s, want %s", tt.at, got, tt.start)
+		}
+		if got := start.AddDate(0, 1, 0).Format(time.RFC3339); got != tt.to {
+			t.Errorf("partition of %s ends %s, want %s", tt.at, got, tt.to)
+		}
+	}
+}
+
+func TestQRRequestIDTime(t *testing.T) {
+	createdAt := time.Date(2025, time.March, 31, 23, 59, 59, 999e6, time.UTC)
+	id := newQRRequestID(createdAt)
+	got, ok := qrIDTime(id)
+	if !ok || !got.Equal(createdAt) {
+		t.Errorf("qrIDTime(%s) = %s, %v, want %s", id, got, ok, createdAt)
+	}
+	if partitionName(qrRequestsTable, monthStart(got)) != "qr_requests_202503" {
+		t.Errorf("ID %s maps to the wrong partition", id)
+	}
+
+	for _, id := range []string{"not-a-uuid", "6ba7b810-9dad-11d1-80b4-00c04fd430c8", "f47ac10b-58cc-4372-a567-0e02b2c3d479"} {
+		if _, ok := qrIDTime(id); ok {
+			t.Errorf("qrIDTime(%s) reported a time for a non-v7 ID", id)
+		}
+	}
+}
+
+func TestDetachPartitionKeepsPendingRequests(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	month := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	name := partitionName(qrRequestsTable, month)
+	if err := ensurePartitions(db, qrRequestsTable, []time.Time{month}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS " + name) })
+
+	createdAt := month.Add(14 * 24 * time.Hour)
+	qr := &QRRequest{ID: newQRRequestID(createdAt), MerchantID: defaultMerchantID, Amount: 1,
+		Status: QRStatusPending, CreatedAt: createdAt.Unix()}
+	if err := db.Create(qr).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	attached := func() bool {
+		var count int64
+		err := db.Raw(`SELECT count(*) FROM pg_inherits h JOIN pg_class c ON c.oid = h.inhrelid
+WHERE h.inhparent = to_regclass(?) AND c.relname = ?`, qrRequestsTable, name).Scan(&count).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count == 1
+	}
+
+	if err := detachPartition(ctx, db, name); err != nil {
+		t.Fatal(err)
+	}
+	if !attached() {
+		t.Fatal("a partition with a pending request was detached")
+	}
+
+	if err := db.Model(&QRRequest{}).Where("id = ?", qr.ID).Update("status", QRStatusExpired).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := detachPartition(ctx, db, name); err != nil {
+		t.Fatal(err)
+	}
+	if attached() {
+		t.Fatal("a partition without pending requests or holds stayed attached")
+	}
+}
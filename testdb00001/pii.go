@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// EncryptedString is a string column that is encrypted at rest by fieldCipher.
+// Printing it with fmt or log shows the masked value.
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" {
+		return "", nil
+	}
+	if fieldCipher == nil {
+		return nil, errors.New("field encryption is not initialised")
+	}
+	return fieldCipher.Encrypt(string(s))
+}
+
+func (s *EncryptedString) Scan(value interface{}) error {
+	var stored string
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case []byte:
+		stored = string(v)
+	case string:
+		stored = v
+	default:
+		return fmt.Errorf("cannot scan %T into EncryptedString", value)
+	}
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		*s = EncryptedString(stored)
+		return nil
+	}
+	if fieldCipher == nil {
+		return errors.New("field encryption is not initialised")
+	}
+	plaintext, err := fieldCipher.Decrypt(stored)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+func (s EncryptedString) String() string {
+	return maskPII(string(s))
+}
+
+// maskPII keeps the last four characters of a sensitive value
+func maskPII(value string) string {
+	if value == "" {
+		return ""
+	}
+	visible := 4
+	if len(value) <= visible*2 {
+		visible = len(value) / 4
+	}
+	return strings.Repeat("*", len(value)-visible) + value[len(value)-visible:]
+}
+
+// blindIndex hashes value for equality lookups of encrypted columns
+func blindIndex(value string) string {
+	if fieldCipher == nil {
+		return ""
+	}
+	return fieldCipher.BlindIndex(value)
+}
+
+// BeforeSave keeps the blind index of RecipientID in step with its value
+func (qr *QRRequest) BeforeSave(tx *gorm.DB) error {
+	qr.RecipientIDIndex = blindIndex(string(qr.RecipientID))
+	return nil
+}
+
+// canUnmask reports whether the caller may see sensitive values in clear
+func canUnmask(c *fiber.Ctx) bool {
+	return hasPermission(currentRole(c), PermPIIUnmask)
+}
+
+// presentQRRequest returns the copy of qr that may be shown to the caller
+func presentQRRequest(c *fiber.Ctx, qr *QRRequest) *QRRequest {
+	if canUnmask(c) {
+		return qr
+	}
+	return maskQRRequest(qr)
+}
+
+// maskQRRequest returns a copy of qr with its sensitive values masked
+func maskQRRequest(qr *QRRequest) *QRRequest {
+	masked := *qr
+	masked.RecipientID = EncryptedString(maskPII(string(qr.RecipientID)))
+	return &masked
+}
+
+func presentQRRequests(c *fiber.Ctx, qrs []QRRequest) []*QRRequest {
+	out := make([]*QRRequest, len(qrs))
+	for i := range qrs {
+		out[i] = presentQRRequest(c, &qrs[i])
+	}
+	return out
+}
+
+// runEncryptionWorker encrypts rows written in clear every interval. They
+// come from instances of an older version, which keep writing while a
+// rolling deploy replaces them.
+func runEncryptionWorker(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n, err := encryptLegacyRows(ctx, db); err != nil {
+			slog.ErrorContext(ctx, "encryption worker failed", "error", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "encrypted rows written in clear", "count", n)
+		}
+	}
+}
+
+// encryptLegacyRows encrypts sensitive values stored in clear and fills in
+// their blind index, and returns how many rows it rewrote. Legacy QR requests
+// are found through the empty blind index, so a pass with nothing to do does
+// not scan the table.
+func encryptLegacyRows(ctx context.Context, db *gorm.DB) (int, error) {
+	db = db.WithContext(ctx)
+	encrypted := 0
+	for ctx.Err() == nil {
+		var rows []struct {
+			ID          string
+			RecipientID string
+		}
+		err := db.Table("qr_requests").Select("id, recipient_id").
+			Where("(recipient_id_index IS NULL OR recipient_id_index = '') AND recipient_id <> '' AND recipient_id NOT LIKE ?", encryptedPrefix+"%").
+			Limit(500).Find(&rows).Error
+		if err != nil {
+			return encrypted, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			enc, err := fieldCipher.Encrypt(row.RecipientID)
+			if err != nil {
+				return encrypted, err
+			}
+			err = db.Table("qr_requests").Where("id = ? AND recipient_id = ?", row.ID, row.RecipientID).Updates(map[string]interface{}{
+				"recipient_id":       enc,
+				"recipient_id_index": blindIndex(row.RecipientID),
+			}).Error
+			if err != nil {
+				return encrypted, err
+			}
+			encrypted++
+		}
+	}
+
+	var invoices []Invoice
+	err := db.Select("id, customer_tax_id, customer_email, customer_address").
+		Where("(customer_tax_id <> '' AND customer_tax_id NOT LIKE ?) OR (customer_email <> '' AND customer_email NOT LIKE ?) OR (customer_address <> '' AND customer_address NOT LIKE ?)",
+			encryptedPrefix+"%", encryptedPrefix+"%", encryptedPrefix+"%").
+		Find(&invoices).Error
+	if err != nil {
+		return encrypted, err
+	}
+	for _, inv := range invoices {
+		// Value encrypts the clear values Scan passed through
+		err := db.Model(&Invoice{}).Where("id = ?", inv.ID).UpdateColumns(map[string]interface{}{
+			"customer_tax_id":  inv.CustomerTaxID,
+			"customer_email":   inv.CustomerEmail,
+			"customer_address": inv.CustomerAddress,
+		}).Error
+		if err != nil {
+			return encrypted, err
+		}
+		encrypted++
+	}
+	return encrypted, ctx.Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Roles carried in the JWT "role" claim and on API keys
+const (
+	RoleAdmin    = "admin"
+	RoleMerchant = "merchant"
+	RoleViewer   = "viewer"
+	RoleSupport  = "support"
+	// RoleCompliance places and releases legal holds; merchants cannot, so
+	// they cannot lift a hold on their own data
+	RoleCompliance = "compliance"
+)
+
+// Permissions checked by requirePermission
+const (
+	PermQRCreate       = "qr:create"
+	PermQRRead         = "qr:read"
+	PermQRUpdate       = "qr:update"
+	PermQRCancel       = "qr:cancel"
+	PermAuditRead      = "audit:read"
+	PermSlipVerify     = "slip:verify"
+	PermMerchantRead   = "merchant:read"
+	PermMerchantUpdate = "merchant:update"
+	PermMerchantCreate = "merchant:create"
+	PermAPIKeyManage   = "apikey:manage"
+	PermTestData       = "testdata:manage"
+	PermPIIUnmask      = "pii:unmask"
+	PermKeyRotate      = "keys:rotate"
+	PermSandboxPay     = "sandbox:pay"
+	PermInvoiceRead    = "invoice:read"
+	PermInvoiceWrite   = "invoice:write"
+	PermBillingRead    = "billing:read"
+	PermBillingWrite   = "billing:write"
+	PermReportRead     = "report:read"
+	PermLegalHold      = "qr:hold"
+	PermMetricsRead    = "metrics:read"
+)
+
+// ErrCodePermissionDenied is returned with every 403 so clients can rely on it
+const ErrCodePermissionDenied = "PERMISSION_DENIED"
+
+var rolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermQRCreate, PermQRRead, PermQRUpdate, PermQRCancel, PermAuditRead, PermSlipVerify,
+		PermMerchantRead, PermMerchantUpdate, PermMerchantCreate,
+		PermAPIKeyManage, PermTestData, PermPIIUnmask, PermKeyRotate, PermSandboxPay,
+		PermInvoiceRead, PermInvoiceWrite, PermBillingRead, PermBillingWrite, PermReportRead,
+		PermLegalHold, PermMetricsRead,
+	},
+	RoleMerchant: {
+		PermQRCreate, PermQRRead, PermQRUpdate, PermQRCancel, PermAuditRead, PermSlipVerify,
+		PermMerchantRead, PermMerchantUpdate, PermAPIKeyManage, PermSandboxPay,
+		PermInvoiceRead, PermInvoiceWrite, PermBillingRead, PermBillingWrite, PermReportRead,
+	},
+	RoleSupport: {
+		PermQRRead, PermQRCancel, PermAuditRead, PermSlipVerify, PermMerchantRead, PermInvoiceRead,
+		PermBillingRead,
+	},
+	RoleViewer: {
+		PermQRRead, PermMerchantRead, PermInvoiceRead, PermBillingRead, PermReportRead,
+	},
+	RoleCompliance: {
+		PermQRRead, PermAuditRead, PermMerchantRead, PermLegalHold,
+	},
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// hasPermission reports whether role grants perm
+func hasPermission(role, perm string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// roleWithin reports whether every permission of role is also granted by
+// caller, so handing out role gives nothing the caller does not have
+func roleWithin(role, caller string) bool {
+	for _, p := range rolePermissions[role] {
+		if !hasPermission(caller, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// currentRole returns the role of the authenticated caller
+func currentRole(c *fiber.Ctx) string {
+	role, _ := c.Locals(localRole).(string)
+	return role
+}
+
+// requirePermission rejects callers whose role lacks perm. It must run after
+// authRequired.
+func requirePermission(perm string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !hasPermission(currentRole(c), perm) {
+			return newAppError(fiber.StatusForbidden, ErrCodePermissionDenied).with("permission", perm)
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"testdb00001/client"
+)
+
+func TestRoleWithin(t *testing.T) {
+	tests := []struct {
+		role, caller string
+		want         bool
+	}{
+		{RoleMerchant, RoleMerchant, true},
+		{RoleViewer, RoleMerchant, true},
+		{RoleSupport, RoleMerchant, true},
+		{RoleCompliance, RoleMerchant, false},
+		{RoleAdmin, RoleMerchant, false},
+		{RoleCompliance, RoleAdmin, true},
+		{RoleMerchant, RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := roleWithin(tt.role, tt.caller); got != tt.want {
+			t.Errorf("roleWithin(%s, %s) = %v, want %v", tt.role, tt.caller, got, tt.want)
+		}
+	}
+}
+
+func TestMerchantCannotIssueComplianceKey(t *testing.T) {
+	srv := newTestServer(t, nil)
+	c := client.New(srv.URL)
+	token, err := c.Login(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, role := range []string{RoleCompliance, RoleAdmin} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/merchant/apikeys",
+			strings.NewReader(`{"name":"escalate","role":"`+role+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "permissions you do not have") {
+			t.Errorf("merchant asking for a %s key: got %d %s, want 403", role, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Check digit schemes of reference patterns. Letters count as 10-35, as in
+// IBANs.
+const (
+	CheckDigitNone = "none"
+	// CheckDigitLuhn is the Luhn algorithm of card numbers
+	CheckDigitLuhn = "luhn"
+	// CheckDigitMod10 is the 3-1 weighted modulus 10 of GS1 barcodes
+	CheckDigitMod10 = "mod10"
+	// CheckDigitMod97 is ISO 7064 MOD 97-10, two digits
+	CheckDigitMod97 = "mod97"
+)
+
+// Date formats of reference patterns. The sequence restarts with every date.
+var referenceDateFormats = map[string]string{
+	"YYYYMMDD": "20060102",
+	"YYMMDD":   "060102",
+	"YYYYMM":   "200601",
+	"YYMM":     "0601",
+	"YYYY":     "2006",
+}
+
+const (
+	ErrCodeReferenceExhausted = "REFERENCE_SEQUENCE_EXHAUSTED"
+
+	defaultSequenceDigits = 6
+)
+
+// ReferencePattern describes generated references: Prefix, the date in
+// Bangkok time, the zero-padded sequence and the check digit, e.g.
+// INV2601150000427 for {Prefix: INV, Date: YYMMDD, CheckDigit: luhn}
+type ReferencePattern struct {
+	Prefix         string `json:"prefix,omitempty"`
+	Date           string `json:"date,omitempty"`
+	SequenceDigits int    `json:"sequenceDigits,omitempty"`
+	CheckDigit     string `json:"checkDigit,omitempty"`
+}
+
+// ReferencePatterns are the merchant's patterns for /generateqr requests
+// without references. Reference2 is only generated when it has a pattern.
+type ReferencePatterns struct {
+	Reference1 *ReferencePattern `json:"reference1,omitempty"`
+	Reference2 *ReferencePattern `json:"reference2,omitempty"`
+}
+
+// defaultReferencePattern is used for Reference1 when the merchant has none
+var defaultReferencePattern = ReferencePattern{Date: "YYMMDD", CheckDigit: CheckDigitLuhn}
+
+// ReferenceSequence hands out reference numbers per merchant, field and
+// date without gaps
+type ReferenceSequence struct {
+	MerchantID string `gorm:"primaryKey"`
+	Field      string `gorm:"primaryKey"`
+	Period     string `gorm:"primaryKey"`
+	Last       int64
+}
+
+func (p ReferencePattern) withDefaults() ReferencePattern {
+	if p.SequenceDigits == 0 {
+		p.SequenceDigits = defaultSequenceDigits
+	}
+	if p.CheckDigit == "" {
+		p.CheckDigit = CheckDigitNone
+	}
+	return p
+}
+
+// length is the length of the references p generates
+func (p ReferencePattern) length() int {
+	n := len(p.Prefix) + len(referenceDateFormats[p.Date]) + p.SequenceDigits
+	switch p.CheckDigit {
+	case CheckDigitLuhn, CheckDigitMod10:
+		n++
+	case CheckDigitMod97:
+		n += 2
+	}
+	return n
+}
+
+// validate reports the invalid fields of p, named below field
+func (p ReferencePattern) validate(field string) []FieldError {
+	p = p.withDefaults()
+	var fields []FieldError
+	if !validReference.MatchString(p.Prefix) {
+		fields = append(fields, FieldError{Field: field + ".prefix", Code: ErrCodeFieldInvalid, Detail: "only A-Z and 0-9"})
+	}
+	if _, ok := referenceDateFormats[p.Date]; p.Date != "" && !ok {
+		fields = append(fields, FieldError{Field: field + ".date", Code: ErrCodeFieldInvalid, Detail: "YYYYMMDD, YYMMDD, YYYYMM, YYMM or YYYY"})
+	}
+	if p.SequenceDigits < 1 || p.SequenceDigits > 12 {
+		fields = append(fields, FieldError{Field: field + ".sequenceDigits", Code: ErrCodeFieldInvalid, Detail: "between 1 and 12"})
+	}
+	switch p.CheckDigit {
+	case CheckDigitNone, CheckDigitLuhn, CheckDigitMod10, CheckDigitMod97:
+	default:
+		fields = append(fields, FieldError{Field: field + ".checkDigit", Code: ErrCodeFieldInvalid, Detail: "none, luhn, mod10 or mod97"})
+	}
+	if len(fields) == 0 && p.length() > maxReferenceLength {
+		fields = append(fields, FieldError{Field: field, Code: ErrCodeFieldInvalid, Detail: fmt.Sprintf("references would be longer than %d characters", maxReferenceLength)})
+	}
+	return fields
+}
+
+// validate reports invalid patterns of merchant settings
+func (r *ReferencePatterns) validate() error {
+	if r == nil {
+		return nil
+	}
+	var fields []FieldError
+	if r.Reference1 != nil {
+		fields = append(fields, r.Reference1.validate("settings.references.reference1")...)
+	}
+	if r.Reference2 != nil {
+		fields = append(fields, r.Reference2.validate("settings.references.reference2")...)
+	}
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+// referenceDigits converts s to the digits check digits are computed over
+func referenceDigits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteString(strconv.Itoa(int(r-'A') + 10))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// checkDigits returns the check digits of s under scheme
+func checkDigits(s, scheme string) string {
+	digits := referenceDigits(s)
+	switch scheme {
+	case CheckDigitLuhn:
+		sum := 0
+		for i := 0; i < len(digits); i++ {
+			d := int(digits[len(digits)-1-i] - '0')
+			// The check digit will be appended, so the last digit is doubled
+			if i%2 == 0 {
+				if d *= 2; d > 9 {
+					d -= 9
+				}
+			}
+			sum += d
+		}
+		return strconv.Itoa((10 - sum%10) % 10)
+	case CheckDigitMod10:
+		sum := 0
+		for i := 0; i < len(digits); i++ {
+			d := int(digits[len(digits)-1-i] - '0')
+			if i%2 == 0 {
+				d *= 3
+			}
+			sum += d
+		}
+		return strconv.Itoa((10 - sum%10) % 10)
+	case CheckDigitMod97:
+		n, _ := new(big.Int).SetString(digits+"00", 10)
+		rem := new(big.Int).Mod(n, big.NewInt(97)).Int64()
+		return fmt.Sprintf("%02d", 98-rem)
+	}
+	return ""
+}
+
+// nextReference allocates the merchant's next reference for field. The
+// sequence row stays locked until tx ends, so numbers have no gaps.
+func nextReference(tx *gorm.DB, merchantID, field string, p ReferencePattern, now time.Time) (string, error) {
+	p = p.withDefaults()
+	period := ""
+	if layout := referenceDateFormats[p.Date]; layout != "" {
+		period = now.In(bangkokTime).Format(layout)
+	}
+
+	seq := ReferenceSequence{MerchantID: merchantID, Field: field, Period: period}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&seq).Error; err != nil {
+		return "", err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&seq, "merchant_id = ? AND field = ? AND period = ?", merchantID, field, period).Error; err != nil {
+		return "", err
+	}
+	seq.Last++
+	if seq.Last >= pow10(p.SequenceDigits) {
+		return "", newAppError(fiber.StatusConflict, ErrCodeReferenceExhausted).
+			withDetail("all %d-digit numbers of %s have been used", p.SequenceDigits, field)
+	}
+	if err := tx.Save(&seq).Error; err != nil {
+		return "", err
+	}
+
+	ref := fmt.Sprintf("%s%s%0*d", p.Prefix, period, p.SequenceDigits, seq.Last)
+	return ref + checkDigits(ref, p.CheckDigit), nil
+}
+
+// assignReferences generates the references qr was created without
+func assignReferences(tx *gorm.DB, merchant *Merchant, qr *QRRequest, now time.Time) error {
+	patterns := merchant.Settings.References
+	if patterns == nil {
+		patterns = &ReferencePatterns{}
+	}
+	var err error
+	if qr.Reference1 == "" {
+		p := defaultReferencePattern
+		if patterns.Reference1 != nil {
+			p = *patterns.Reference1
+		}
+		if qr.Reference1, err = nextReference(tx, merchant.ID, "reference1", p, now); err != nil {
+			return err
+		}
+	}
+	if qr.Reference2 == "" && patterns.Reference2 != nil {
+		if qr.Reference2, err = nextReference(tx, merchant.ID, "reference2", *patterns.Reference2, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issueReference handles POST /references, for merchants that build their
+// own payloads
+func (h *Handler) issueReference(c *fiber.Ctx) error {
+	req := struct {
+		Field string `json:"field"`
+	}{Field: "reference1"}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return badRequestError(err)
+		}
+	}
+
+	if req.Field != "reference1" && req.Field != "reference2" {
+		return invalidField("field", ErrCodeFieldInvalid)
+	}
+
+	db := requestDB(c, h.db)
+	merchant, err := GetMerchant(db, currentMerchantID(c))
+	if err != nil {
+		return merchantError(err)
+	}
+	p := defaultReferencePattern
+	if patterns := merchant.Settings.References; patterns != nil {
+		switch {
+		case req.Field == "reference1" && patterns.Reference1 != nil:
+			p = *patterns.Reference1
+		case req.Field == "reference2" && patterns.Reference2 != nil:
+			p = *patterns.Reference2
+		}
+	}
+
+	var ref string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		ref, err = nextReference(tx, merchant.ID, req.Field, p, time.Now())
+		return err
+	})
+	if err != nil {
+		var appErr *AppError
+		if errors.As(err, &appErr) {
+			return appErr
+		}
+		return internalError(err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"field": req.Field, "reference": ref})
+}
+
+// completeQRRequest fills in what a /generateqr request left out: the
+// references, and without a payload of its own, the payload of qr.Scheme
+// paying the merchant's account in it. A PromptPay request of a merchant
+// without biller IDs stays without payload.
+func completeQRRequest(tx *gorm.DB, qr *QRRequest) error {
+	merchant, err := GetMerchant(tx, qr.MerchantID)
+	if err != nil {
+		return merchantError(err)
+	}
+	if err := assignReferences(tx, merchant, qr, time.Now()); err != nil {
+		return err
+	}
+	if qr.QRCode != "" {
+		return nil
+	}
+
+	acct, ok := merchantQRAccount(merchant, qr.Scheme)
+	if !ok {
+		if qr.Scheme == SchemePromptPay {
+			return nil
+		}
+		return validationError(FieldError{Field: "scheme", Code: ErrCodeFieldInvalid, Detail: "the merchant has no account in this scheme"})
+	}
+	// The account may predate a change of the merchant's billerIds
+	if qr.Scheme == SchemePromptPay && !merchant.AllowsBiller(acct.ID) {
+		return newAppError(fiber.StatusForbidden, ErrCodeBillerNotAllowed)
+	}
+	if qr.Type == "" {
+		qr.Type = "billpayment"
+		if qr.Scheme != SchemePromptPay {
+			qr.Type = qr.Scheme
+		}
+	}
+	if qr.MerchantName == "" {
+		qr.MerchantName = merchant.DefaultMerchantName
+	}
+	qr.QRCode, err = qrSchemes[qr.Scheme].Payload(acct, qr)
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCheckDigits(t *testing.T) {
+	tests := []struct {
+		in, scheme, want string
+	}{
+		{"7992739871", CheckDigitLuhn, "3"},
+		{"INV2024", CheckDigitLuhn, "7"},
+		{"400638133393", CheckDigitMod10, "1"},
+		{"INV2024", CheckDigitMod10, "2"},
+		{"123456", CheckDigitMod97, "76"},
+		{"INV2024", CheckDigitMod97, "47"},
+		{"0", CheckDigitMod97, "98"},
+		{"123456", CheckDigitNone, ""},
+	}
+	for _, tt := range tests {
+		if got := checkDigits(tt.in, tt.scheme); got != tt.want {
+			t.Errorf("checkDigits(%q, %s) = %q, want %q", tt.in, tt.scheme, got, tt.want)
+		}
+	}
+}
+
+func TestReferenceDigits(t *testing.T) {
+	if got := referenceDigits("AZ09"); got != "103509" {
+		t.Errorf("referenceDigits(AZ09) = %s", got)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// QRRollup counts the QRRequests created in an hour (UTC) by merchant,
+// Type, RecipientType, Scheme, Status and TestMode. Reports sum rollups
+// instead of scanning qr_requests.
+type QRRollup struct {
+	Hour          int64  `gorm:"primaryKey;autoIncrement:false"`
+	MerchantID    string `gorm:"primaryKey"`
+	Type          string `gorm:"primaryKey"`
+	RecipientType string `gorm:"primaryKey"`
+	Scheme        string `gorm:"primaryKey"`
+	Status        string `gorm:"primaryKey"`
+	TestMode      bool   `gorm:"primaryKey"`
+	Count         int64
+	Amount        float64
+}
+
+// RollupCursor is how far the audit trail has been folded into qr_rollups
+type RollupCursor struct {
+	Name        string `gorm:"primaryKey"`
+	LastEventID uint64
+	RefreshedAt int64
+}
+
+const (
+	rollupCursorName = "qr_rollups"
+	// rollupSettleDelay leaves recent audit events for the next refresh, so
+	// events committed out of ID order are not skipped
+	rollupSettleDelay = time.Minute
+	rollupBatch       = 5000
+
+	maxReportDays = 3 * 366
+)
+
+// rollupsEnd bounds the full rebuild of the rollups
+var rollupsEnd = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// rollupHours recomputes the rollups of the hours created_at falls in
+// between from (inclusive) and to. Rows archived to the archive table still
+// count; purged rows, rows archived to files and detached partitions drop
+// out once their hour is rebuilt.
+const rollupHours = `INSERT INTO qr_rollups
+	(hour, merchant_id, type, recipient_type, scheme, status, test_mode, count, amount)
+SELECT extract(epoch FROM date_trunc('hour', created_at AT TIME ZONE 'UTC'))::bigint, merchant_id, COALESCE(type, ''), COALESCE(recipient_type, ''),
+	COALESCE(NULLIF(scheme, ''), 'promptpay'), status, test_mode, count(*), COALESCE(sum(amount), 0)
+FROM (
+	SELECT created_at, merchant_id, type, recipient_type, scheme, status, test_mode, amount FROM qr_requests
+	WHERE created_at >= ? AND created_at < ?
+	UNION ALL
+	SELECT created_at, merchant_id, type, recipient_type, scheme, status, test_mode, amount FROM ` + archiveTable + `
+	WHERE created_at >= ? AND created_at < ?
+) q
+GROUP BY 1, 2, 3, 4, 5, 6, 7`
+
+// rollupIgnoredActions do not change what a QRRequest counts towards
+var rollupIgnoredActions = []string{AuditView, AuditHold, AuditRelease}
+
+// rollupChangedHours lists the hours of the requests changed by a range of
+// audit events. Events carry the hour of their request, so purged and
+// archived requests are found too; older events without it are joined to
+// qr_requests.
+const rollupChangedHours = `SELECT DISTINCT a.qr_created_at / 3600 * 3600
+FROM audit_events a
+WHERE a.id > ? AND a.id <= ? AND a.action NOT IN ? AND a.qr_created_at > 0
+UNION
+SELECT extract(epoch FROM date_trunc('hour', q.created_at AT TIME ZONE 'UTC'))::bigint
+FROM audit_events a JOIN qr_requests q ON q.id = a.qr_request_id
+WHERE a.id > ? AND a.id <= ? AND a.action NOT IN ? AND a.qr_created_at = 0`
+
+// runRollupWorker folds QRRequest changes into qr_rollups every interval
+// until ctx is cancelled
+func runRollupWorker(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := refreshRollups(ctx, db, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "rollup worker failed", "error", err)
+		} else if n > 0 {
+			slog.DebugContext(ctx, "refreshed rollups", "hours", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshRollups recomputes the hours of QRRequests changed since the last
+// refresh, found through their audit events, and returns how many hours it
+// recomputed. The first refresh builds every hour.
+func refreshRollups(ctx context.Context, db *gorm.DB, now time.Time) (int, error) {
+	settled := now.Add(-rollupSettleDelay).UnixNano()
+	refreshed := 0
+	for ctx.Err() == nil {
+		done := false
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			cursor := RollupCursor{Name: rollupCursorName}
+			created := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&cursor)
+			if created.Error != nil {
+				return created.Error
+			}
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cursor, "name = ?", rollupCursorName).Error; err != nil {
+				return err
+			}
+
+			if created.RowsAffected == 1 {
+				err := tx.Raw("SELECT COALESCE(max(id), 0) FROM audit_events WHERE created_at < ?", settled).
+					Scan(&cursor.LastEventID).Error
+				if err != nil {
+					return err
+				}
+				if err := rebuildRollups(tx, time.Unix(0, 0), rollupsEnd); err != nil {
+					return err
+				}
+				refreshed++
+				done = true
+			} else {
+				var last uint64
+				err := tx.Raw(`SELECT COALESCE(max(id), 0) FROM (
+	SELECT id FROM audit_events WHERE id > ? AND created_at < ? ORDER BY id LIMIT ?) batch`,
+					cursor.LastEventID, settled, rollupBatch).Scan(&last).Error
+				if err != nil {
+					return err
+				}
+				if last == 0 {
+					done = true
+				} else {
+					var hours []int64
+					err := tx.Raw(rollupChangedHours, cursor.LastEventID, last, rollupIgnoredActions,
+						cursor.LastEventID, last, rollupIgnoredActions).Scan(&hours).Error
+					if err != nil {
+						return err
+					}
+					for _, hour := range hours {
+						if err := rebuildRollups(tx, time.Unix(hour, 0), time.Unix(hour+3600, 0)); err != nil {
+							return err
+						}
+					}
+					refreshed += len(hours)
+					cursor.LastEventID = last
+				}
+			}
+
+			cursor.RefreshedAt = now.Unix()
+			return tx.Save(&cursor).Error
+		})
+		if err != nil {
+			return refreshed, err
+		}
+		if done {
+			break
+		}
+	}
+	return refreshed, nil
+}
+
+// rebuildRollups replaces the rollups of the hours between from and to
+func rebuildRollups(tx *gorm.DB, from, to time.Time) error {
+	if err := tx.Where("hour >= ? AND hour < ?", from.Unix(), to.Unix()).Delete(&QRRollup{}).Error; err != nil {
+		return err
+	}
+	return tx.Exec(rollupHours, from, to, from, to).Error
+}
+
+// Report intervals and the groupings a report can be broken down by
+var (
+	reportIntervals = []string{"day", "week", "month"}
+	reportGroups    = map[string]string{
+		"merchant":      "merchant_id",
+		"type":          "type",
+		"recipientType": "recipient_type",
+		"scheme":        "scheme",
+	}
+)
+
+// ReportStats are the totals of a report row. Ratios are of Count and
+// AverageTicket is the average paid amount.
+type ReportStats struct {
+	Count          int64   `json:"count"`
+	Amount         float64 `json:"amount"`
+	PaidCount      int64   `json:"paidCount"`
+	PaidAmount     float64 `json:"paidAmount"`
+	PendingCount   int64   `json:"pendingCount"`
+	ExpiredCount   int64   `json:"expiredCount"`
+	CancelledCount int64   `json:"cancelledCount"`
+	AverageTicket  float64 `json:"averageTicket"`
+	PaidRatio      float64 `json:"paidRatio"`
+	ExpiredRatio   float64 `json:"expiredRatio"`
+	CancelledRatio float64 `json:"cancelledRatio"`
+}
+
+// ReportRow is the ReportStats of one period and group
+type ReportRow struct {
+	Period        string `json:"period"`
+	MerchantID    string `json:"merchantId,omitempty"`
+	Type          string `json:"type,omitempty"`
+	RecipientType string `json:"recipientType,omitempty"`
+	Scheme        string `json:"scheme,omitempty"`
+	ReportStats
+}
+
+func (s *ReportStats) add(status string, count int64, amount float64) {
+	s.Count += count
+	s.Amount += amount
+	switch status {
+	case QRStatusPaid:
+		s.PaidCount += count
+		s.PaidAmount += amount
+	case QRStatusPending:
+		s.PendingCount += count
+	case QRStatusExpired:
+		s.ExpiredCount += count
+	case QRStatusCancelled:
+		s.CancelledCount += count
+	}
+}
+
+// finish rounds the amounts and derives the averages and ratios
+func (s *ReportStats) finish() {
+	s.Amount = roundBaht(s.Amount)
+	s.PaidAmount = roundBaht(s.PaidAmount)
+	if s.PaidCount > 0 {
+		s.AverageTicket = roundBaht(s.PaidAmount / float64(s.PaidCount))
+	}
+	if s.Count > 0 {
+		ratio := func(n int64) float64 {
+			return math.Round(float64(n)/float64(s.Count)*10000) / 10000
+		}
+		s.PaidRatio = ratio(s.PaidCount)
+		s.ExpiredRatio = ratio(s.ExpiredCount)
+		s.CancelledRatio = ratio(s.CancelledCount)
+	}
+}
+
+func roundBaht(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// reportQuery is a validated GET /reports/summary request
+type reportQuery struct {
+	From     time.Time
+	To       time.Time // exclusive
+	Location *time.Location
+	Interval string
+	GroupBy  []string
+}
+
+// parseReportQuery validates the query of GET /reports/summary. from and to
+// are dates in the timezone, both included.
+func parseReportQuery(c *fiber.Ctx) (*reportQuery, error) {
+	var fields []FieldError
+	invalid := func(field, detail string) {
+		fields = append(fields, FieldError{Field: field, Code: ErrCodeFieldInvalid, Detail: detail})
+	}
+
+	q := &reportQuery{Interval: c.Query("interval", "day")}
+	tz := c.Query("timezone", defaultBillingTimezone)
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		invalid("timezone", "an IANA time zone, e.g. Asia/Bangkok")
+		loc = bangkokTime
+	}
+	q.Location = loc
+
+	for _, name := range []string{"from", "to"} {
+		if c.Query(name) == "" {
+			fields = append(fields, FieldError{Field: name, Code: ErrCodeFieldRequired})
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", c.Query(name), loc)
+		if err != nil {
+			invalid(name, "a date, e.g. 2026-01-31")
+			continue
+		}
+		if name == "from" {
+			q.From = t
+		} else {
+			q.To = t.AddDate(0, 0, 1)
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() {
+		if !q.To.After(q.From) {
+			invalid("to", "not before from")
+		} else if q.To.Sub(q.From) > maxReportDays*24*time.Hour {
+			invalid("to", fmt.Sprintf("a report covers at most %d days", maxReportDays))
+		}
+		// Rollups are by the hour, so days must start on the hour
+		for _, t := range []time.Time{q.From, q.To} {
+			if _, offset := t.Zone(); offset%3600 != 0 {
+				invalid("timezone", "a time zone whose UTC offset is whole hours")
+				break
+			}
+		}
+	}
+
+	if !contains(reportIntervals, q.Interval) {
+		invalid("interval", "day, week or month")
+	}
+	if groupBy := c.Query("groupBy"); groupBy != "" {
+		for _, g := range strings.Split(groupBy, ",") {
+			g = strings.TrimSpace(g)
+			if _, ok := reportGroups[g]; !ok {
+				invalid("groupBy", "merchant, type, recipientType or scheme")
+				break
+			}
+			if !contains(q.GroupBy, g) {
+				q.GroupBy = append(q.GroupBy, g)
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return nil, validationError(fields...)
+	}
+	return q, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reportSummary handles GET /reports/summary. Merchants see their own
+// requests; admins see every merchant unless merchantId is given.
+func (h *Handler) reportSummary(c *fiber.Ctx) error {
+	q, err := parseReportQuery(c)
+	if err != nil {
+		return err
+	}
+
+	db := requestDB(c, h.db)
+	// Live and sandbox requests are never reported together
+	testMode := isSandbox(c) || c.QueryBool("testMode")
+	query := db.Model(&QRRollup{}).Where("hour >= ? AND hour < ? AND test_mode = ?", q.From.Unix(), q.To.Unix(), testMode)
+	switch merchantID := c.Query("merchantId"); {
+	case currentRole(c) != RoleAdmin:
+		query = query.Where("merchant_id = ?", currentMerchantID(c))
+	case merchantID != "":
+		query = query.Where("merchant_id = ?", merchantID)
+	}
+
+	columns := []string{"date_trunc(?, to_timestamp(hour) AT TIME ZONE ?) AS period"}
+	group := []string{"period"}
+	for _, g := range q.GroupBy {
+		columns = append(columns, reportGroups[g])
+		group = append(group, reportGroups[g])
+	}
+	group = append(group, "status")
+	columns = append(columns, "status", "sum(count) AS count", "sum(amount) AS amount")
+
+	var rows []struct {
+		Period        time.Time
+		MerchantID    string
+		Type          string
+		RecipientType string
+		Scheme        string
+		Status        string
+		Count         int64
+		Amount        float64
+	}
+	err = query.Select(strings.Join(columns, ", "), q.Interval, q.Location.String()).
+		Group(strings.Join(group, ", ")).Order(strings.Join(group, ", ")).
+		Scan(&rows).Error
+	if err != nil {
+		return internalError(err)
+	}
+
+	var cursor RollupCursor
+	if err := db.Limit(1).Find(&cursor, "name = ?", rollupCursorName).Error; err != nil {
+		return internalError(err)
+	}
+
+	report := []*ReportRow{}
+	var totals ReportStats
+	for _, r := range rows {
+		row := &ReportRow{
+			Period:        r.Period.Format("2006-01-02"),
+			MerchantID:    r.MerchantID,
+			Type:          r.Type,
+			RecipientType: r.RecipientType,
+			Scheme:        r.Scheme,
+		}
+		// Rows of one period and group are adjacent, one per status
+		if n := len(report); n > 0 {
+			prev := report[n-1]
+			if prev.Period == row.Period && prev.MerchantID == row.MerchantID && prev.Type == row.Type &&
+				prev.RecipientType == row.RecipientType && prev.Scheme == row.Scheme {
+				row = prev
+			} else {
+				report = append(report, row)
+			}
+		} else {
+			report = append(report, row)
+		}
+		row.add(r.Status, r.Count, r.Amount)
+		totals.add(r.Status, r.Count, r.Amount)
+	}
+	for _, row := range report {
+		row.finish()
+	}
+	totals.finish()
+
+	groupBy := q.GroupBy
+	if groupBy == nil {
+		groupBy = []string{}
+	}
+	return c.JSON(fiber.Map{
+		"from":        q.From.Format("2006-01-02"),
+		"to":          q.To.AddDate(0, 0, -1).Format("2006-01-02"),
+		"timezone":    q.Location.String(),
+		"interval":    q.Interval,
+		"groupBy":     groupBy,
+		"testMode":    testMode,
+		"refreshedAt": cursor.RefreshedAt,
+		"totals":      totals,
+		"rows":        report,
+	})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Retention actions. Rows on legal hold are never purged or archived.
+const (
+	RetentionKeep    = "keep"
+	RetentionPurge   = "purge"
+	RetentionArchive = "archive"
+)
+
+// Archive targets of the retention worker
+const (
+	ArchiveTable = "table"
+	ArchiveFile  = "file"
+)
+
+const (
+	archiveTable   = "qr_requests_archive"
+	retentionBatch = 500
+)
+
+// RetentionRule purges or archives QR requests of Status once they were
+// created more than AfterDays ago
+type RetentionRule struct {
+	Status    string `json:"status"`
+	Action    string `json:"action"`
+	AfterDays int    `json:"afterDays,omitempty"`
+}
+
+// retentionStatuses are the statuses rules may apply to; pending requests
+// are always kept
+var retentionStatuses = []string{QRStatusPaid, QRStatusExpired, QRStatusCancelled}
+
+// validateRetentionRules reports invalid rules, named below field
+func validateRetentionRules(rules []RetentionRule, field string) []FieldError {
+	var fields []FieldError
+	invalid := func(i int, name, detail string) {
+		fields = append(fields, FieldError{Field: fmt.Sprintf("%s.%d.%s", field, i, name), Code: ErrCodeFieldInvalid, Detail: detail})
+	}
+	seen := make(map[string]bool)
+	for i, r := range rules {
+		if !contains(retentionStatuses, r.Status) {
+			invalid(i, "status", "paid, expired or cancelled")
+		} else if seen[r.Status] {
+			invalid(i, "status", "one rule per status")
+		}
+		seen[r.Status] = true
+		switch r.Action {
+		case RetentionKeep:
+		case RetentionPurge, RetentionArchive:
+			if r.AfterDays < 1 {
+				invalid(i, "afterDays", "at least 1")
+			}
+		default:
+			invalid(i, "action", "keep, purge or archive")
+		}
+	}
+	return fields
+}
+
+// parseRetentionRules parses RETENTION_RULES, e.g.
+// "expired:purge:90,cancelled:purge:90,paid:archive:730"
+func parseRetentionRules(s string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		rule := RetentionRule{Status: fields[0]}
+		if len(fields) > 1 {
+			rule.Action = fields[1]
+		}
+		if len(fields) > 2 {
+			days, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%q: days must be a number", part)
+			}
+			rule.AfterDays = days
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%q must be status:action:days", part)
+		}
+		rules = append(rules, rule)
+	}
+	if fields := validateRetentionRules(rules, "rules"); len(fields) > 0 {
+		return nil, fmt.Errorf("%s: %s", fields[0].Field, fields[0].Detail)
+	}
+	return rules, nil
+}
+
+// effectiveRetention returns the defaults with the merchant's rules
+// replacing those of the same status
+func effectiveRetention(defaults, merchant []RetentionRule) []RetentionRule {
+	byStatus := make(map[string]RetentionRule)
+	for _, r := range defaults {
+		byStatus[r.Status] = r
+	}
+	for _, r := range merchant {
+		byStatus[r.Status] = r
+	}
+	var rules []RetentionRule
+	for _, status := range retentionStatuses {
+		if r, ok := byStatus[status]; ok && r.Action != RetentionKeep {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// Retention applies retention rules in the background
+type Retention struct {
+	db       *gorm.DB
+	defaults []RetentionRule
+	target   string
+	dir      string
+}
+
+// setupRetention returns the retention worker configured by cfg
+func setupRetention(cfg *Config, db *gorm.DB) (*Retention, error) {
+	rules, err := parseRetentionRules(cfg.RetentionRules)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RetentionArchive == ArchiveFile {
+		if err := os.MkdirAll(cfg.RetentionArchiveDir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &Retention{db: db, defaults: rules, target: cfg.RetentionArchive, dir: cfg.RetentionArchiveDir}, nil
+}
+
+// setupArchiveTable creates the archive table, partitioned by month of
+// created_at like qr_requests, and adds the columns qr_requests has gained
+// since. An archive table with Unix second columns is converted.
+func setupArchiveTable(db *gorm.DB) error {
+	var createdAtType string
+	err := db.Raw(`SELECT COALESCE((SELECT data_type FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name = ? AND column_name = 'created_at'), '')`, archiveTable).
+		Scan(&createdAtType).Error
+	if err != nil {
+		return err
+	}
+	if createdAtType != "timestamp with time zone" {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			legacy := ""
+			if createdAtType != "" {
+				var err error
+				if legacy, err = renameToLegacy(tx, archiveTable); err != nil {
+					return err
+				}
+			}
+			err := tx.Exec(`CREATE TABLE ` + archiveTable + ` (LIKE qr_requests INCLUDING DEFAULTS, archived_at timestamptz)
+	PARTITION BY RANGE (created_at)`).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Exec(`CREATE INDEX idx_qr_requests_archive_lookup ON ` + archiveTable + ` (merchant_id, id)`).Error; err != nil {
+				return err
+			}
+			if legacy == "" {
+				return nil
+			}
+			if err := copyLegacyRows(tx, legacy, archiveTable); err != nil {
+				return err
+			}
+			return tx.Exec("DROP TABLE " + legacy).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&QRRequest{}); err != nil {
+		return err
+	}
+	migrator := db.Table(archiveTable).Migrator()
+	for _, name := range stmt.Schema.DBNames {
+		if !migrator.HasColumn(&QRRequest{}, name) {
+			if err := migrator.AddColumn(&QRRequest{}, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runRetentionWorker applies the retention rules every interval until ctx
+// is cancelled
+func runRetentionWorker(ctx context.Context, r *Retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.apply(ctx, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "retention worker failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply purges and archives the QR requests of every merchant that are due
+func (r *Retention) apply(ctx context.Context, now time.Time) error {
+	var merchants []Merchant
+	if err := r.db.WithContext(ctx).Select("id", "settings").Find(&merchants).Error; err != nil {
+		return err
+	}
+	for _, m := range merchants {
+		for _, rule := range effectiveRetention(r.defaults, m.Settings.Retention) {
+			cutoff := now.AddDate(0, 0, -rule.AfterDays)
+			n, err := r.applyRule(ctx, m.ID, rule, cutoff, now)
+			if err != nil {
+				return fmt.Errorf("merchant %s, %s %s: %w", m.ID, rule.Action, rule.Status, err)
+			}
+			if n > 0 {
+				slog.InfoContext(ctx, "retention applied", "merchant_id", m.ID, "status", rule.Status, "action", rule.Action, "count", n)
+			}
+		}
+	}
+	return nil
+}
+
+// applyRule purges or archives the merchant's requests of rule.Status
+// created before cutoff, in batches, and returns how many it handled
+func (r *Retention) applyRule(ctx context.Context, merchantID string, rule RetentionRule, cutoff, now time.Time) (int, error) {
+	handled := 0
+	for ctx.Err() == nil {
+		var batch []QRRequest
+		var files []string
+		err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("merchant_id = ? AND status = ? AND created_at < ? AND NOT legal_hold", merchantID, rule.Status, cutoff).
+				Order("created_at").Limit(retentionBatch).Find(&batch).Error
+			if err != nil || len(batch) == 0 {
+				return err
+			}
+
+			action := AuditPurge
+			if rule.Action == RetentionArchive {
+				action = AuditArchive
+				switch r.target {
+				case ArchiveFile:
+					files, err = r.archiveToFile(tx, merchantID, rule.Status, batch, now)
+				default:
+					err = archiveToTable(tx, batch, now)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if err := tx.Where(inBatch(batch)).Delete(&QRRequest{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("merchant_id = ? AND qr_request_id IN ?", merchantID, batchIDs(batch)).Delete(&QRIdempotencyKey{}).Error; err != nil {
+				return err
+			}
+			for i := range batch {
+				if err := appendAuditEvent(tx, systemActor("retention"), action, &batch[i], &batch[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// The rows stay, so drop the files that would duplicate them
+			for _, f := range files {
+				os.Remove(f)
+			}
+			return handled, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		handled += len(batch)
+	}
+	return handled, nil
+}
+
+func batchIDs(batch []QRRequest) []string {
+	ids := make([]string, len(batch))
+	for i := range batch {
+		ids[i] = batch[i].ID
+	}
+	return ids
+}
+
+// inBatch selects the rows of a batch ordered by created_at, bounding
+// created_at so only their partitions are searched
+func inBatch(batch []QRRequest) clause.Expr {
+	return gorm.Expr("id IN ? AND created_at BETWEEN ? AND ?", batchIDs(batch),
+		time.Unix(batch[0].CreatedAt, 0), time.Unix(batch[len(batch)-1].CreatedAt, 0))
+}
+
+// archiveToTable copies the batch into the archive table, creating the
+// monthly partitions it needs
+func archiveToTable(tx *gorm.DB, batch []QRRequest, now time.Time) error {
+	var months []time.Time
+	for i := range batch {
+		month := monthStart(time.Unix(batch[i].CreatedAt, 0))
+		if len(months) == 0 || !months[len(months)-1].Equal(month) {
+			months = append(months, month)
+		}
+	}
+	if err := ensurePartitions(tx, archiveTable, months); err != nil {
+		return err
+	}
+
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(&QRRequest{}); err != nil {
+		return err
+	}
+	columns := strings.Join(stmt.Schema.DBNames, ", ")
+	return tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s, archived_at) SELECT %s, ? FROM qr_requests WHERE ?`,
+		archiveTable, columns, columns), now, inBatch(batch)).Error
+}
+
+// ArchiveManifest describes an archive file. recipient_id stays encrypted
+// with the field encryption keys.
+type ArchiveManifest struct {
+	File         string   `json:"file"`
+	Table        string   `json:"table"`
+	MerchantID   string   `json:"merchantId"`
+	Status       string   `json:"status"`
+	Rows         int      `json:"rows"`
+	IDs          []string `json:"ids"`
+	MinCreatedAt int64    `json:"minCreatedAt"`
+	MaxCreatedAt int64    `json:"maxCreatedAt"`
+	SHA256       string   `json:"sha256"`
+	ArchivedAt   int64    `json:"archivedAt"`
+}
+
+// archiveToFile writes the rows of the batch as stored to a gzipped NDJSON
+// file with a manifest next to it and returns the paths of both
+func (r *Retention) archiveToFile(tx *gorm.DB, merchantID, status string, batch []QRRequest, now time.Time) ([]string, error) {
+	// Maps keep the columns as stored, so recipient_id is not decrypted
+	var rows []map[string]interface{}
+	if err := tx.Table("qr_requests").Where(inBatch(batch)).Order("created_at").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	utc := now.UTC()
+	dir := filepath.Join(r.dir, utc.Format("2006"), utc.Format("01"))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("qr_requests-%s-%s-%d", merchantID, status, now.UnixNano())
+	manifest := ArchiveManifest{
+		File:       name + ".ndjson.gz",
+		Table:      "qr_requests",
+		MerchantID: merchantID,
+		Status:     status,
+		Rows:       len(rows),
+		IDs:        batchIDs(batch),
+		ArchivedAt: now.Unix(),
+	}
+	if len(rows) > 0 {
+		first, _ := rows[0]["created_at"].(time.Time)
+		last, _ := rows[len(rows)-1]["created_at"].(time.Time)
+		manifest.MinCreatedAt, manifest.MaxCreatedAt = first.Unix(), last.Unix()
+	}
+
+	path := filepath.Join(dir, manifest.File)
+	sum, err := writeArchiveFile(path, rows)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	manifest.SHA256 = sum
+
+	manifestPath := filepath.Join(dir, name+".manifest.json")
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.WriteFile(manifestPath, data, 0o600)
+	}
+	if err != nil {
+		os.Remove(path)
+		os.Remove(manifestPath)
+		return nil, err
+	}
+	return []string{path, manifestPath}, nil
+}
+
+// writeArchiveFile writes rows as gzipped NDJSON, synced to disk, and
+// returns the hex SHA-256 of the file
+func writeArchiveFile(path string, rows []map[string]interface{}) (string, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(f, sum))
+	enc := json.NewEncoder(zw)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), f.Close()
+}
+
+// setLegalHold handles PUT and DELETE /qr/:id/hold. A held request is never
+// purged or archived.
+func setLegalHold(db *gorm.DB, hold bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := struct {
+			Reason string `json:"reason"`
+		}{}
+		if hold {
+			if err := c.BodyParser(&req); err != nil {
+				return badRequestError(err)
+			}
+			if strings.TrimSpace(req.Reason) == "" {
+				return invalidField("reason", ErrCodeFieldRequired)
+			}
+		}
+
+		var qr *QRRequest
+		err := requestDB(c, db).Transaction(func(tx *gorm.DB) error {
+			before, err := getCallerQRRequest(tx.Clauses(clause.Locking{Strength: "UPDATE"}), c, c.Params("id"))
+			if err != nil {
+				return err
+			}
+			if hold && before.LegalHold {
+				return errQROnHold
+			}
+
+			after := *before
+			after.LegalHold = hold
+			after.LegalHoldReason = strings.TrimSpace(req.Reason)
+			if err := tx.Save(&after).Error; err != nil {
+				return err
+			}
+			qr = &after
+			action := AuditHold
+			if !hold {
+				action = AuditRelease
+			}
+			return recordAudit(tx, c, action, before, &after)
+		})
+		if err != nil {
+			return qrRequestError(err)
+		}
+		return c.JSON(presentQRRequest(c, qr))
+	}
+}
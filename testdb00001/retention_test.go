@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []RetentionRule
+		err  string
+	}{
+		{"", nil, ""},
+		{"expired:purge:90, paid:archive:730", []RetentionRule{
+			{Status: QRStatusExpired, Action: RetentionPurge, AfterDays: 90},
+			{Status: QRStatusPaid, Action: RetentionArchive, AfterDays: 730},
+		}, ""},
+		{"cancelled:keep", []RetentionRule{{Status: QRStatusCancelled, Action: RetentionKeep}}, ""},
+		{"pending:purge:1", nil, "paid, expired or cancelled"},
+		{"paid:purge:1,paid:archive:2", nil, "one rule per status"},
+		{"paid:shred:1", nil, "keep, purge or archive"},
+		{"paid:purge", nil, "at least 1"},
+		{"paid:purge:soon", nil, "days must be a number"},
+		{"paid:purge:1:2", nil, "must be status:action:days"},
+	}
+	for _, tt := range tests {
+		got, err := parseRetentionRules(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseRetentionRules(%q) = %v, want an error containing %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRetentionRules(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestEffectiveRetention(t *testing.T) {
+	defaults := []RetentionRule{
+		{Status: QRStatusExpired, Action: RetentionPurge, AfterDays: 90},
+		{Status: QRStatusPaid, Action: RetentionArchive, AfterDays: 730},
+	}
+	merchant := []RetentionRule{
+		{Status: QRStatusPaid, Action: RetentionKeep},
+		{Status: QRStatusCancelled, Action: RetentionPurge, AfterDays: 30},
+	}
+	want := []RetentionRule{
+		{Status: QRStatusExpired, Action: RetentionPurge, AfterDays: 90},
+		{Status: QRStatusCancelled, Action: RetentionPurge, AfterDays: 30},
+	}
+	if got := effectiveRetention(defaults, merchant); !reflect.DeepEqual(got, want) {
+		t.Errorf("effectiveRetention() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/howeyc/crc16"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Sandbox mode mirrors production without real money. A QRRequest created
+// with "testMode": true, or by a sandbox API key, is flagged TestMode: it is
+// left out of listings and metrics of live data, its payload is marked and it
+// can only be paid through the simulate-payment endpoint.
+
+// localSandbox is set by authRequired for sandbox credentials
+const localSandbox = "sandbox"
+
+// sandboxNamePrefix marks the merchant name of sandbox payloads so banking
+// apps show payers that the QR is not live
+const sandboxNamePrefix = "TEST "
+
+// maxMerchantNameLength is the EMVCo limit of tag 59
+const maxMerchantNameLength = 25
+
+// sandboxAID replaces the AID (or GUID) of every merchant account template
+// of a sandbox payload. No scheme routes it, so banking apps refuse to pay
+// the QR instead of moving real money.
+const sandboxAID = "SANDBOX.NOTPAYABLE"
+
+// Simulated payments come from a bank code and carry references that no
+// real bank issues
+const (
+	sandboxSendingBank    = "SANDBOX"
+	sandboxTransRefPrefix = "SANDBOX"
+)
+
+// Errors of mixing sandbox and live payments
+const (
+	ErrCodeQRSandbox    = "QR_SANDBOX"
+	ErrCodeQRNotSandbox = "QR_NOT_SANDBOX"
+)
+
+// isSandbox reports whether the caller authenticated with sandbox credentials
+func isSandbox(c *fiber.Ctx) bool {
+	sandbox, _ := c.Locals(localSandbox).(bool)
+	return sandbox
+}
+
+// getCallerQRRequest loads a QRRequest of the authenticated merchant. Sandbox
+// callers cannot see live requests.
+func getCallerQRRequest(db *gorm.DB, c *fiber.Ctx, id string) (*QRRequest, error) {
+	qr, err := GetQRRequest(db, currentMerchantID(c), id)
+	if err == nil && isSandbox(c) && !qr.TestMode {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return qr, err
+}
+
+// markSandboxPayload makes an EMVCo payload unpayable: the merchant account
+// templates (tags 26-51) get sandboxAID, or are dropped when they cannot be
+// parsed, the merchant name is prefixed with sandboxNamePrefix and the CRC
+// recomputed. Payloads that are not EMVCo are returned unchanged; the
+// TestMode flag still marks them.
+func markSandboxPayload(payload string) string {
+	if len(payload) < 8 || payload[len(payload)-8:len(payload)-4] != "6304" || checkCRC(payload) != nil {
+		return payload
+	}
+	body := payload[:len(payload)-8]
+
+	var out strings.Builder
+	named := false
+	for i := 0; i < len(body); {
+		if i+4 > len(body) {
+			return payload
+		}
+		tag := body[i : i+2]
+		length, err := strconv.Atoi(body[i+2 : i+4])
+		if err != nil || i+4+length > len(body) {
+			return payload
+		}
+		value := body[i+4 : i+4+length]
+		i += 4 + length
+
+		if tag >= "26" && tag <= "51" {
+			value = sandboxAccount(value)
+		}
+		if tag == "59" {
+			named = true
+			if !strings.HasPrefix(value, sandboxNamePrefix) {
+				value = sandboxNamePrefix + value
+			}
+			value = truncateUTF8(value, maxMerchantNameLength)
+		}
+		out.WriteString(formatQRField(tag, value))
+	}
+	if !named {
+		out.WriteString(formatQRField("59", strings.TrimSpace(sandboxNamePrefix)))
+	}
+
+	data := out.String() + "6304"
+	return data + fmt.Sprintf("%04X", crc16.ChecksumCCITTFalse([]byte(data)))
+}
+
+// sandboxAccount returns the merchant account template with its AID (tag 00)
+// replaced by sandboxAID, or "" when the template is not tag-length-value
+func sandboxAccount(template string) string {
+	var out strings.Builder
+	out.WriteString(formatQRField("00", sandboxAID))
+	for i := 0; i < len(template); {
+		if i+4 > len(template) {
+			return ""
+		}
+		tag := template[i : i+2]
+		length, err := strconv.Atoi(template[i+2 : i+4])
+		if err != nil || i+4+length > len(template) {
+			return ""
+		}
+		if tag != "00" {
+			out.WriteString(template[i : i+4+length])
+		}
+		i += 4 + length
+	}
+	if out.Len() > maxQRFieldLength {
+		return ""
+	}
+	return out.String()
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// markQRPaid moves a pending QRRequest to paid and records the audit event.
+// qr must have been loaded in tx with a row lock and checked to be pending.
+func markQRPaid(tx *gorm.DB, c *fiber.Ctx, qr *QRRequest) (*QRRequest, error) {
+	paid := *qr
+	paid.Status = QRStatusPaid
+	if err := tx.Save(&paid).Error; err != nil {
+		return nil, err
+	}
+	if err := recordAudit(tx, c, AuditPaid, qr, &paid); err != nil {
+		return nil, err
+	}
+	return &paid, nil
+}
+
+type simulatePaymentRequest struct {
+	// Amount defaults to the requested amount; set it to try a mismatch
+	Amount *float64 `json:"amount"`
+}
+
+// simulatePayment handles POST /sandbox/qr/:id/simulate-payment. It pays a
+// sandbox QRRequest the way a verified slip would, callback included.
+func (h *Handler) simulatePayment(c *fiber.Ctx) error {
+	req := new(simulatePaymentRequest)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return badRequestError(err)
+		}
+	}
+
+	var qr *QRRequest
+	var payment *Payment
+	err := requestDB(c, h.db).Transaction(func(tx *gorm.DB) error {
+		pending, err := getCallerQRRequest(tx.Clauses(clause.Locking{Strength: "UPDATE"}), c, c.Params("id"))
+		if err != nil {
+			return err
+		}
+		if !pending.TestMode {
+			return newAppError(fiber.StatusConflict, ErrCodeQRNotSandbox)
+		}
+		if pending.Status != QRStatusPending {
+			return errQRNotPending
+		}
+
+		amount := pending.Amount
+		if req.Amount != nil {
+			amount = *req.Amount
+		}
+		if !amountsEqual(pending.Amount, amount) {
+			return newAppError(fiber.StatusUnprocessableEntity, ErrCodeSlipAmountMismatch).
+				withDetail("slip amount %.2f does not match requested amount %.2f", amount, pending.Amount)
+		}
+
+		payment = &Payment{
+			ID:          uuid.New().String(),
+			MerchantID:  pending.MerchantID,
+			QRRequestID: pending.ID,
+			SendingBank: sandboxSendingBank,
+			TransRef:    sandboxTransRefPrefix + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:16]),
+			Amount:      amount,
+			PaidAt:      time.Now().Unix(),
+			Source:      "sandbox",
+			TestMode:    true,
+		}
+		if err := tx.Create(payment).Error; err != nil {
+			return err
+		}
+		qr, err = markQRPaid(tx, c, pending)
+		return err
+	})
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	} else if err != nil {
+		return qrRequestError(err)
+	}
+	observeQRStatus(qr)
+	h.notifyPaid(c, qr, payment.TransRef, payment.PaidAt)
+
+	return c.JSON(fiber.Map{
+		"qrRequest": presentQRRequest(c, qr),
+		"payment":   payment,
+	})
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/howeyc/crc16"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Payment records money received for a QRRequest
+type Payment struct {
+	ID          string `gorm:"primaryKey"`
+	MerchantID  string `gorm:"index"`
+	QRRequestID string `gorm:"index"`
+	SendingBank string
+	TransRef    string `gorm:"uniqueIndex"`
+	Amount      float64
+	PaidAt      int64
+	Source      string
+	TestMode    bool `gorm:"index"`
+}
+
+// UsedSlip remembers every transfer slip that has been accepted so the same
+// slip cannot be presented twice
+type UsedSlip struct {
+	TransRef    string `gorm:"primaryKey"`
+	SendingBank string
+	MerchantID  string `gorm:"index"`
+	QRRequestID string `gorm:"index"`
+	PaymentID   string
+	VerifiedAt  int64
+}
+
+// SlipPayload is the decoded content of a bank transfer slip mini-QR
+type SlipPayload struct {
+	APIType     string `json:"apiType"`
+	SendingBank string `json:"sendingBank"`
+	BankName    string `json:"bankName,omitempty"`
+	TransRef    string `json:"transRef"`
+	Country     string `json:"country"`
+}
+
+// SlipTransaction is what a bank reports for a transfer reference
+type SlipTransaction struct {
+	TransRef    string  `json:"transRef"`
+	SendingBank string  `json:"sendingBank"`
+	Amount      float64 `json:"amount"`
+	PaidAt      int64   `json:"paidAt"`
+	Receiver    string  `json:"receiver,omitempty"`
+}
+
+// SlipProvider asks a bank (or an aggregator) about a transfer reference
+type SlipProvider interface {
+	VerifySlip(ctx context.Context, sendingBank, transRef string) (*SlipTransaction, error)
+}
+
+var ErrSlipNotFound = errors.New("slip transaction not found")
+
+// slipProviderTimeout bounds every call to the slip provider
+const slipProviderTimeout = 10 * time.Second
+
+// slipAPIType is the API identifier carried by BOT slip verification QRs
+const slipAPIType = "000001"
+
+var thaiBankNames = map[string]string{
+	"002": "BBL",
+	"004": "KBANK",
+	"006": "KTB",
+	"011": "TTB",
+	"014": "SCB",
+	"022": "CIMBT",
+	"024": "UOBT",
+	"025": "BAY",
+	"030": "GSB",
+	"033": "GHB",
+	"034": "BAAC",
+	"067": "TISCO",
+	"069": "KKP",
+	"073": "LHFG",
+}
+
+// parseTLV splits an EMVCo style tag-length-value string into its fields
+func parseTLV(data string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for i := 0; i < len(data); {
+		if i+4 > len(data) {
+			return nil, fmt.Errorf("truncated field at offset %d", i)
+		}
+		tag := data[i : i+2]
+		length, err := strconv.Atoi(data[i+2 : i+4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid length for tag %s", tag)
+		}
+		i += 4
+		if i+length > len(data) {
+			return nil, fmt.Errorf("value of tag %s overflows payload", tag)
+		}
+		fields[tag] = data[i : i+length]
+		i += length
+	}
+	return fields, nil
+}
+
+// checkCRC validates the trailing CRC16 (CCITT-FALSE) of a QR payload whose
+// last field is the 4 hex digit checksum
+func checkCRC(data string) error {
+	if len(data) < 8 {
+		return fmt.Errorf("payload too short")
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	expected := fmt.Sprintf("%04X", crc16.ChecksumCCITTFalse([]byte(body)))
+	if !strings.EqualFold(expected, sum) {
+		return fmt.Errorf("crc mismatch: got %s, expected %s", strings.ToUpper(sum), expected)
+	}
+	return nil
+}
+
+// DecodeSlipQR parses and validates a transfer slip QR string
+func DecodeSlipQR(data string) (*SlipPayload, error) {
+	data = strings.TrimSpace(data)
+	if err := checkCRC(data); err != nil {
+		return nil, err
+	}
+
+	fields, err := parseTLV(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fields["91"]; !ok {
+		return nil, fmt.Errorf("missing crc field")
+	}
+
+	inner, err := parseTLV(fields["00"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid slip data: %v", err)
+	}
+
+	slip := &SlipPayload{
+		APIType:     inner["00"],
+		SendingBank: inner["01"],
+		TransRef:    inner["02"],
+		Country:     fields["51"],
+	}
+	if slip.APIType != slipAPIType {
+		return nil, fmt.Errorf("unsupported slip api type %q", slip.APIType)
+	}
+	if slip.SendingBank == "" || slip.TransRef == "" {
+		return nil, fmt.Errorf("slip is missing sending bank or transaction reference")
+	}
+	slip.BankName = thaiBankNames[slip.SendingBank]
+
+	return slip, nil
+}
+
+// maxSlipImagePixels bounds the size of slip images. Decoding allocates
+// memory for every pixel a header declares, so a small file could claim
+// enough to exhaust it; phone screenshots are a few megapixels.
+const maxSlipImagePixels = 25_000_000
+
+// readQRFromImage extracts the QR text from a PNG or JPEG image
+func readQRFromImage(data []byte) (string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot decode image: %v", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSlipImagePixels {
+		return "", fmt.Errorf("image of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot decode image: %v", err)
+	}
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+	hints := map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_TRY_HARDER: true}
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, hints)
+	if err != nil {
+		return "", fmt.Errorf("no QR code found in image")
+	}
+	return result.GetText(), nil
+}
+
+// FakeSlipProvider is an in-memory SlipProvider for local development
+type FakeSlipProvider struct {
+	mu           sync.RWMutex
+	transactions map[string]SlipTransaction
+}
+
+func NewFakeSlipProvider() *FakeSlipProvider {
+	return &FakeSlipProvider{transactions: make(map[string]SlipTransaction)}
+}
+
+// Add registers a transaction the fake bank will confirm
+func (p *FakeSlipProvider) Add(tx SlipTransaction) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transactions[tx.SendingBank+"/"+tx.TransRef] = tx
+}
+
+func (p *FakeSlipProvider) VerifySlip(ctx context.Context, sendingBank, transRef string) (*SlipTransaction, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	tx, ok := p.transactions[sendingBank+"/"+transRef]
+	if !ok {
+		return nil, ErrSlipNotFound
+	}
+	return &tx, nil
+}
+
+// HTTPSlipProvider asks a slip verification service over HTTP. It posts
+// {"sendingBank", "transRef"} and expects a SlipTransaction back, or 404 for
+// an unknown transfer.
+type HTTPSlipProvider struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (p *HTTPSlipProvider) VerifySlip(ctx context.Context, sendingBank, transRef string) (*SlipTransaction, error) {
+	data, err := json.Marshal(map[string]string{"sendingBank": sendingBank, "transRef": transRef})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if p.Token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+p.Token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrSlipNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("slip provider returned %s", resp.Status)
+	}
+	var tx SlipTransaction
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tx); err != nil {
+		return nil, fmt.Errorf("slip provider response: %v", err)
+	}
+	return &tx, nil
+}
+
+// setupSlipProvider returns the configured SlipProvider. Without
+// SLIP_PROVIDER_URL dev mode gets an empty FakeSlipProvider and other
+// deployments can only verify payments recorded from bank callbacks.
+func setupSlipProvider(cfg *Config) SlipProvider {
+	switch {
+	case cfg.SlipProviderURL != "":
+		return &HTTPSlipProvider{URL: cfg.SlipProviderURL, Token: cfg.SlipProviderToken, Client: newOutboundClient(slipProviderTimeout)}
+	case cfg.DevMode:
+		return NewFakeSlipProvider()
+	}
+	slog.Warn("SLIP_PROVIDER_URL not set, slips are only checked against recorded payments")
+	return nil
+}
+
+type slipVerifyRequest struct {
+	QRData      string `json:"qrData" form:"qrData"`
+	QRRequestID string `json:"qrRequestId" form:"qrRequestId"`
+}
+
+// verifySlip handles POST /slips/verify with either a JSON body carrying the
+// slip QR string or a multipart upload of the slip image in field "slip"
+func (h *Handler) verifySlip(c *fiber.Ctx) error {
+	// Real slips never touch sandbox data
+	if isSandbox(c) {
+		return newAppError(fiber.StatusConflict, ErrCodeQRSandbox)
+	}
+
+	req := new(slipVerifyRequest)
+	if err := c.BodyParser(req); err != nil {
+		return badRequestError(err)
+	}
+
+	if req.QRData == "" {
+		file, err := c.FormFile("slip")
+		if err != nil {
+			return newAppError(fiber.StatusBadRequest, ErrCodeSlipRequired)
+		}
+		f, err := file.Open()
+		if err != nil {
+			return badRequestError(err)
+		}
+		defer f.Close()
+
+		buf, err := io.ReadAll(f)
+		if err != nil {
+			return badRequestError(err)
+		}
+		if req.QRData, err = readQRFromImage(buf); err != nil {
+			return &AppError{Status: fiber.StatusUnprocessableEntity, Code: ErrCodeSlipUnreadable, Err: err}
+		}
+	}
+
+	slip, err := DecodeSlipQR(req.QRData)
+	if err != nil {
+		return newAppError(fiber.StatusUnprocessableEntity, ErrCodeSlipInvalid).withDetail("%v", err)
+	}
+
+	merchantID := currentMerchantID(c)
+
+	if dup, err := slipDuplicate(requestDB(c, h.db), merchantID, slip); err != nil {
+		return internalError(err)
+	} else if dup != nil {
+		return dup
+	}
+
+	var qr *QRRequest
+	if req.QRRequestID != "" {
+		if qr, err = GetQRRequest(requestDB(c, h.db), merchantID, req.QRRequestID); err != nil {
+			return qrRequestError(err)
+		}
+		if qr.TestMode {
+			return newAppError(fiber.StatusConflict, ErrCodeQRSandbox)
+		}
+		// The slip is left unused for the request it was meant for
+		if qr.Status != QRStatusPending {
+			return qrRequestError(errQRNotPending)
+		}
+	}
+
+	bankTx, source, err := h.lookupSlipTransaction(c, merchantID, slip)
+	if errors.Is(err, ErrSlipNotFound) {
+		return newAppError(fiber.StatusUnprocessableEntity, ErrCodeSlipNotFound).with("valid", false).with("slip", slip)
+	} else if err != nil {
+		return &AppError{Status: fiber.StatusBadGateway, Code: ErrCodeBankUnavailable, Err: err}
+	}
+
+	// Payments recorded from the merchant's own bank callbacks were paid to
+	// it; a transfer the provider confirms may have gone to anyone
+	if source != "recorded" {
+		merchant, err := GetMerchant(requestDB(c, h.db), merchantID)
+		if err != nil {
+			return merchantError(err)
+		}
+		if !paidToAny(bankTx.Receiver, slipPayees(merchant, qr)) {
+			return newAppError(fiber.StatusUnprocessableEntity, ErrCodeSlipReceiverMismatch).
+				with("valid", false).with("slip", slip).with("transaction", bankTx)
+		}
+	}
+
+	if qr != nil && !amountsEqual(qr.Amount, bankTx.Amount) {
+		return newAppError(fiber.StatusUnprocessableEntity, ErrCodeSlipAmountMismatch).
+			withDetail("slip amount %.2f does not match requested amount %.2f", bankTx.Amount, qr.Amount).
+			with("valid", false).with("slip", slip).with("transaction", bankTx)
+	}
+
+	used := UsedSlip{
+		TransRef:    slip.TransRef,
+		SendingBank: slip.SendingBank,
+		MerchantID:  merchantID,
+		VerifiedAt:  time.Now().Unix(),
+	}
+	if qr != nil {
+		used.QRRequestID = qr.ID
+	}
+
+	paidNow := false
+	err = requestDB(c, h.db).Transaction(func(tx *gorm.DB) error {
+		// Reload the request under a row lock, a concurrent cancel, update or
+		// slip may have changed it since it was read
+		if qr != nil {
+			locked, err := GetQRRequest(tx.Clauses(clause.Locking{Strength: "UPDATE"}), merchantID, qr.ID)
+			if err != nil {
+				return err
+			}
+			if locked.Status != QRStatusPending {
+				return errQRNotPending
+			}
+			qr = locked
+		}
+		if source != "recorded" {
+			payment := &Payment{
+				ID:          uuid.New().String(),
+				MerchantID:  merchantID,
+				QRRequestID: used.QRRequestID,
+				SendingBank: slip.SendingBank,
+				TransRef:    slip.TransRef,
+				Amount:      bankTx.Amount,
+				PaidAt:      bankTx.PaidAt,
+				Source:      source,
+			}
+			if err := tx.Create(payment).Error; err != nil {
+				return err
+			}
+			used.PaymentID = payment.ID
+		}
+		if err := tx.Create(&used).Error; err != nil {
+			return err
+		}
+
+		if qr == nil {
+			return nil
+		}
+		paid, err := markQRPaid(tx, c, qr)
+		if err != nil {
+			return err
+		}
+		qr = paid
+		paidNow = true
+		return nil
+	})
+	if errors.Is(err, errQRNotPending) {
+		return qrRequestError(err)
+	} else if err != nil {
+		// A concurrent verification or bank callback may have won the race
+		// on the unique trans_ref
+		if dup, findErr := slipDuplicate(requestDB(c, h.db), merchantID, slip); findErr == nil && dup != nil {
+			return dup
+		}
+		return internalError(err)
+	}
+	if paidNow {
+		observeQRStatus(qr)
+		h.notifyPaid(c, qr, slip.TransRef, bankTx.PaidAt)
+	}
+
+	return c.JSON(fiber.Map{
+		"valid":       true,
+		"duplicate":   false,
+		"source":      source,
+		"slip":        slip,
+		"transaction": bankTx,
+	})
+}
+
+// slipPayees lists the accounts a slip may have paid: those qr's payload was
+// made for, or without a request every account of the merchant
+func slipPayees(merchant *Merchant, qr *QRRequest) []string {
+	var payees []string
+	if qr != nil {
+		if qr.RecipientID != "" {
+			payees = append(payees, string(qr.RecipientID))
+		}
+		if acct, ok := merchantQRAccount(merchant, qr.Scheme); ok {
+			payees = append(payees, acct.ID)
+		}
+		return payees
+	}
+	payees = append(payees, merchant.BillerIDList()...)
+	for _, acct := range merchant.Settings.Schemes {
+		payees = append(payees, acct.ID)
+	}
+	return payees
+}
+
+// paidToAny reports whether receiver, as reported by the bank, is one of
+// payees. Punctuation such as the dashes of account numbers is ignored; an
+// unknown receiver matches nothing.
+func paidToAny(receiver string, payees []string) bool {
+	receiver = accountDigits(receiver)
+	if receiver == "" {
+		return false
+	}
+	for _, payee := range payees {
+		if accountDigits(payee) == receiver {
+			return true
+		}
+	}
+	return false
+}
+
+// accountDigits keeps the letters and digits of an account, upper case
+func accountDigits(account string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'A' && r <= 'Z':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return -1
+	}, account)
+}
+
+// slipDuplicate returns the SLIP_DUPLICATE error when slip was already used,
+// or its transfer was recorded as a payment to another merchant, and nil
+// otherwise. A slip can only be used once across all merchants, but only the
+// owner gets to see what it was used for.
+func slipDuplicate(db *gorm.DB, merchantID string, slip *SlipPayload) (*AppError, error) {
+	var used UsedSlip
+	if err := db.Limit(1).Find(&used, "trans_ref = ?", slip.TransRef).Error; err != nil {
+		return nil, err
+	}
+	if used.TransRef == "" {
+		var others int64
+		err := db.Model(&Payment{}).Where("trans_ref = ? AND merchant_id <> ?", slip.TransRef, merchantID).Count(&others).Error
+		if err != nil || others == 0 {
+			return nil, err
+		}
+	}
+
+	appErr := newAppError(fiber.StatusConflict, ErrCodeSlipDuplicate).
+		with("valid", false).with("duplicate", true).with("slip", slip)
+	if used.TransRef != "" && used.MerchantID == merchantID {
+		appErr.with("usedFor", used.QRRequestID).with("usedAt", used.VerifiedAt)
+	}
+	return appErr, nil
+}
+
+// lookupSlipTransaction checks recorded payments first and falls back to the
+// configured bank provider
+func (h *Handler) lookupSlipTransaction(c *fiber.Ctx, merchantID string, slip *SlipPayload) (*SlipTransaction, string, error) {
+	ctx := c.UserContext()
+	var payment Payment
+	err := requestDB(c, h.db).WithContext(ctx).First(&payment, "trans_ref = ? AND merchant_id = ?", slip.TransRef, merchantID).Error
+	if err == nil {
+		return &SlipTransaction{
+			TransRef:    payment.TransRef,
+			SendingBank: payment.SendingBank,
+			Amount:      payment.Amount,
+			PaidAt:      payment.PaidAt,
+		}, "recorded", nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", err
+	}
+
+	if h.slipProvider == nil {
+		return nil, "", ErrSlipNotFound
+	}
+	ctx, span := tracer.Start(ctx, "SlipProvider.VerifySlip",
+		trace.WithAttributes(attribute.String("slip.sending_bank", slip.SendingBank)))
+	defer span.End()
+	tx, err := h.slipProvider.VerifySlip(ctx, slip.SendingBank, slip.TransRef)
+	if err != nil {
+		if !errors.Is(err, ErrSlipNotFound) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return nil, "", err
+	}
+	return tx, "provider", nil
+}
+
+func amountsEqual(a, b float64) bool {
+	return fmt.Sprintf("%.2f", a) == fmt.Sprintf("%.2f", b)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestPaidToAny(t *testing.T) {
+	merchant := &Merchant{
+		BillerIDs: "010753600010286",
+		Settings:  MerchantSettings{Schemes: map[string]QRAccount{SchemePayNow: {ID: "201403121W", ProxyType: "uen"}}},
+	}
+	qr := &QRRequest{Scheme: SchemePromptPay, RecipientID: "0812345678"}
+
+	tests := []struct {
+		name     string
+		receiver string
+		qr       *QRRequest
+		want     bool
+	}{
+		{"request recipient", "081-234-5678", qr, true},
+		{"request biller", "010753600010286", qr, true},
+		{"other scheme account of the request", "201403121w", qr, false},
+		{"merchant account without a request", "201403121w", nil, true},
+		{"someone else", "0899999999", qr, false},
+		{"unknown receiver", "", qr, false},
+		{"only punctuation", "---", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := paidToAny(tt.receiver, slipPayees(merchant, tt.qr)); got != tt.want {
+				t.Fatalf("paidToAny(%q) = %v, want %v", tt.receiver, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadQRFromImageRejectsHugeImages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	// Claim 100000x100000 pixels in the IHDR chunk and fix up its CRC
+	data := buf.Bytes()
+	ihdr := data[12 : 12+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	binary.BigEndian.PutUint32(ihdr[8:], 100000)
+	binary.BigEndian.PutUint32(data[12+4+13:], crc32.ChecksumIEEE(ihdr))
+
+	_, err := readQRFromImage(data)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("want a too large error, got %v", err)
+	}
+}
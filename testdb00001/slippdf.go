@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gofiber/fiber/v2"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/makiuchi-d/gozxing/qrcode/decoder"
+	"gorm.io/gorm"
+)
+
+// SlipTemplate configures the PDF payment slips and receipts of a merchant
+type SlipTemplate struct {
+	// Layout is a4, a5 or 80mm (thermal roll)
+	Layout string `json:"layout,omitempty"`
+	// Title replaces the merchant name in the header
+	Title   string `json:"title,omitempty"`
+	Address string `json:"address,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+	TaxID   string `json:"taxId,omitempty"`
+	Footer  string `json:"footer,omitempty"`
+	// AccentColor is a #RRGGBB color for rules and headings
+	AccentColor string `json:"accentColor,omitempty"`
+}
+
+// slipLayout sizes are in mm. A zero height grows with the content.
+type slipLayout struct {
+	width, height float64
+	margin        float64
+	fontSize      float64
+	qrSize        float64
+}
+
+var slipLayouts = map[string]slipLayout{
+	"a4":   {width: 210, height: 297, margin: 20, fontSize: 12, qrSize: 70},
+	"a5":   {width: 148, height: 210, margin: 12, fontSize: 10, qrSize: 55},
+	"80mm": {width: 80, margin: 4, fontSize: 8, qrSize: 50},
+}
+
+const defaultSlipLayout = "a4"
+
+// Kinds of printed documents
+const (
+	slipKindPayment = "slip"
+	slipKindReceipt = "receipt"
+)
+
+const ErrCodeQRNotPaid = "QR_NOT_PAID"
+
+// Thai has no daylight saving time, slips always show Bangkok time
+var bangkokTime = time.FixedZone("ICT", 7*60*60)
+
+// fallbackThaiFonts are tried when no font is configured. Laksaman is the
+// TH Sarabun derived font of the fonts-thai-tlwg package.
+var fallbackThaiFonts = [][2]string{
+	{"/usr/share/fonts/truetype/tlwg/Laksaman.ttf", "/usr/share/fonts/truetype/tlwg/Laksaman-Bold.ttf"},
+	{"/usr/share/fonts/truetype/tlwg/Garuda.ttf", "/usr/share/fonts/truetype/tlwg/Garuda-Bold.ttf"},
+}
+
+// SlipRenderer renders slips and receipts. Without a Thai font they are
+// printed in English only.
+type SlipRenderer struct {
+	font, boldFont []byte
+}
+
+// loadSlipRenderer reads the fonts configured by cfg, or the first installed
+// fallback font
+func loadSlipRenderer(cfg *Config) (*SlipRenderer, error) {
+	candidates := fallbackThaiFonts
+	if cfg.PDFFont != "" {
+		candidates = [][2]string{{cfg.PDFFont, cfg.PDFFontBold}}
+	}
+	for _, paths := range candidates {
+		font, err := os.ReadFile(paths[0])
+		if err != nil {
+			if cfg.PDFFont != "" {
+				return nil, fmt.Errorf("PDF_FONT: %v", err)
+			}
+			continue
+		}
+		boldFont := font
+		if paths[1] != "" {
+			if boldFont, err = os.ReadFile(paths[1]); err != nil {
+				if cfg.PDFFont != "" {
+					return nil, fmt.Errorf("PDF_FONT_BOLD: %v", err)
+				}
+				boldFont = font
+			}
+		}
+		return &SlipRenderer{font: font, boldFont: boldFont}, nil
+	}
+	slog.Warn("no Thai font found, PDF slips are printed in English only; set PDF_FONT")
+	return &SlipRenderer{}, nil
+}
+
+// slipDocument is everything printed on a slip or receipt
+type slipDocument struct {
+	kind     string
+	merchant *Merchant
+	template SlipTemplate
+	qr       *QRRequest
+	payment  *Payment
+}
+
+// slipWriter wraps the PDF with the document's fonts and layout
+type slipWriter struct {
+	pdf    *fpdf.Fpdf
+	layout slipLayout
+	thai   bool
+	accent [3]int
+}
+
+func (r *SlipRenderer) newWriter(layout slipLayout, height float64, accent [3]int) *slipWriter {
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		UnitStr: "mm",
+		Size:    fpdf.SizeType{Wd: layout.width, Ht: height},
+	})
+	pdf.SetMargins(layout.margin, layout.margin, layout.margin)
+	pdf.SetAutoPageBreak(false, layout.margin)
+	w := &slipWriter{pdf: pdf, layout: layout, thai: r.font != nil, accent: accent}
+	if w.thai {
+		pdf.AddUTF8FontFromBytes("thai", "", r.font)
+		pdf.AddUTF8FontFromBytes("thai", "B", r.boldFont)
+	}
+	pdf.AddPage()
+	return w
+}
+
+// label picks the Thai and English text, or English only without a Thai font
+func (w *slipWriter) label(th, en string) string {
+	if w.thai {
+		return th + " / " + en
+	}
+	return en
+}
+
+func (w *slipWriter) font(bold bool, scale float64) {
+	style := ""
+	if bold {
+		style = "B"
+	}
+	family := "Helvetica"
+	if w.thai {
+		family = "thai"
+	}
+	w.pdf.SetFont(family, style, w.layout.fontSize*scale)
+}
+
+// text writes a full-width paragraph
+func (w *slipWriter) text(s, align string, bold bool, scale float64) {
+	if !w.thai {
+		s = asciiOnly(s)
+	}
+	if s == "" {
+		return
+	}
+	w.font(bold, scale)
+	w.pdf.MultiCell(0, w.layout.fontSize*scale*0.5, s, "", align, false)
+}
+
+// row writes a label and its value
+func (w *slipWriter) row(label, value string) {
+	if !w.thai {
+		value = asciiOnly(value)
+	}
+	if value == "" {
+		return
+	}
+	lineHeight := w.layout.fontSize * 0.55
+	labelWidth := (w.layout.width - 2*w.layout.margin) * 0.4
+	w.font(false, 1)
+	y := w.pdf.GetY()
+	w.pdf.MultiCell(labelWidth, lineHeight, label, "", "L", false)
+	labelEnd := w.pdf.GetY()
+	w.pdf.SetXY(w.layout.margin+labelWidth, y)
+	w.font(true, 1)
+	w.pdf.MultiCell(0, lineHeight, value, "", "L", false)
+	w.pdf.SetY(math.Max(labelEnd, w.pdf.GetY()))
+}
+
+func (w *slipWriter) rule() {
+	w.pdf.Ln(w.layout.fontSize * 0.2)
+	w.pdf.SetDrawColor(w.accent[0], w.accent[1], w.accent[2])
+	w.pdf.SetLineWidth(0.4)
+	y := w.pdf.GetY()
+	w.pdf.Line(w.layout.margin, y, w.layout.width-w.layout.margin, y)
+	w.pdf.Ln(w.layout.fontSize * 0.3)
+}
+
+// qrCode draws payload as vector modules centered on the page
+func (w *slipWriter) qrCode(payload string) error {
+	hints := map[gozxing.EncodeHintType]interface{}{
+		gozxing.EncodeHintType_ERROR_CORRECTION: decoder.ErrorCorrectionLevel_M,
+		gozxing.EncodeHintType_MARGIN:           0,
+	}
+	matrix, err := qrcode.NewQRCodeWriter().Encode(payload, gozxing.BarcodeFormat_QR_CODE, 0, 0, hints)
+	if err != nil {
+		return err
+	}
+
+	size := w.layout.qrSize
+	module := size / float64(matrix.GetWidth())
+	x0 := (w.layout.width - size) / 2
+	y0 := w.pdf.GetY() + w.layout.fontSize*0.3
+	w.pdf.SetFillColor(0, 0, 0)
+	for y := 0; y < matrix.GetHeight(); y++ {
+		for x := 0; x < matrix.GetWidth(); x++ {
+			if matrix.Get(x, y) {
+				// Slightly oversized so adjacent modules leave no hairlines
+				w.pdf.Rect(x0+float64(x)*module, y0+float64(y)*module, module+0.01, module+0.01, "F")
+			}
+		}
+	}
+	w.pdf.SetY(y0 + size + w.layout.fontSize*0.3)
+	return nil
+}
+
+// watermark marks sandbox documents across the page
+func (w *slipWriter) watermark(height float64) {
+	w.pdf.SetAlpha(0.15, "Normal")
+	w.pdf.SetTextColor(200, 0, 0)
+	w.font(true, 6)
+	w.pdf.TransformBegin()
+	w.pdf.TransformRotate(35, w.layout.width/2, height/2)
+	w.pdf.Text(w.layout.width/2-w.pdf.GetStringWidth("TEST")/2, height/2, "TEST")
+	w.pdf.TransformEnd()
+	w.pdf.SetAlpha(1, "Normal")
+	w.pdf.SetTextColor(0, 0, 0)
+}
+
+// Render returns the PDF of doc. A layout of "" uses the template's.
+func (r *SlipRenderer) Render(doc *slipDocument, layoutName string) ([]byte, error) {
+	if layoutName == "" {
+		layoutName = doc.template.Layout
+	}
+	layout, ok := slipLayouts[layoutName]
+	if !ok {
+		layout = slipLayouts[defaultSlipLayout]
+	}
+	accent := parseHexColor(doc.template.AccentColor)
+
+	height := layout.height
+	if height == 0 {
+		// Thermal rolls: measure the content first, then cut the page to it
+		w := r.newWriter(layout, 1000, accent)
+		if err := w.draw(doc); err != nil {
+			return nil, err
+		}
+		height = w.pdf.GetY() + layout.margin
+	}
+
+	w := r.newWriter(layout, height, accent)
+	if err := w.draw(doc); err != nil {
+		return nil, err
+	}
+	if doc.qr.TestMode {
+		w.watermark(height)
+	}
+
+	var buf bytes.Buffer
+	if err := w.pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *slipWriter) draw(doc *slipDocument) error {
+	qr, tpl := doc.qr, doc.template
+	amount := Money(math.Round(qr.Amount * 100))
+
+	// Merchant header
+	title := tpl.Title
+	if title == "" {
+		title = doc.merchant.Name
+	}
+	w.pdf.SetTextColor(w.accent[0], w.accent[1], w.accent[2])
+	w.text(title, "C", true, 1.5)
+	w.pdf.SetTextColor(0, 0, 0)
+	w.text(tpl.Address, "C", false, 0.9)
+	if tpl.Phone != "" {
+		w.text(w.label("โทร", "Tel")+" "+tpl.Phone, "C", false, 0.9)
+	}
+	if tpl.TaxID != "" {
+		w.text(w.label("เลขประจำตัวผู้เสียภาษี", "Tax ID")+" "+tpl.TaxID, "C", false, 0.9)
+	}
+	w.rule()
+
+	if doc.kind == slipKindReceipt {
+		w.text(w.label("ใบเสร็จรับเงิน", "Receipt"), "C", true, 1.3)
+	} else {
+		w.text(w.label("ใบแจ้งชำระเงิน", "Payment slip"), "C", true, 1.3)
+	}
+	w.pdf.Ln(w.layout.fontSize * 0.3)
+
+	w.row(w.label("เลขที่รายการ", "Request ID"), qr.ID)
+	w.row(w.label("ผู้รับเงิน", "Payee"), qr.MerchantName)
+	w.row(w.label("อ้างอิง 1", "Reference 1"), qr.Reference1)
+	w.row(w.label("อ้างอิง 2", "Reference 2"), qr.Reference2)
+	w.row(w.label("วันที่ออก", "Issued"), formatSlipTime(qr.CreatedAt))
+	if doc.kind == slipKindPayment && qr.Expire > 0 {
+		w.row(w.label("ชำระภายใน", "Pay by"), formatSlipTime(qr.Expire))
+	}
+	w.row(w.label("หมายเหตุ", "Remark"), qr.Remark)
+	if doc.payment != nil {
+		w.row(w.label("วันที่ชำระ", "Paid at"), formatSlipTime(doc.payment.PaidAt))
+		w.row(w.label("เลขที่อ้างอิงการโอน", "Transaction"), doc.payment.TransRef)
+		w.row(w.label("ธนาคารผู้โอน", "Sending bank"), doc.payment.SendingBank)
+	}
+	w.rule()
+
+	w.row(w.label("จำนวนเงิน", "Amount"), formatBaht(amount)+" THB")
+	if w.thai {
+		w.text("("+bahtText(amount)+")", "R", false, 1)
+	}
+
+	if doc.kind == slipKindReceipt {
+		w.pdf.Ln(w.layout.fontSize * 0.5)
+		w.pdf.SetTextColor(w.accent[0], w.accent[1], w.accent[2])
+		w.text(w.label("ชำระแล้ว", "PAID"), "C", true, 1.6)
+		w.pdf.SetTextColor(0, 0, 0)
+	} else if qr.QRCode != "" && qr.Status == QRStatusPending {
+		if err := w.qrCode(qr.QRCode); err != nil {
+			return err
+		}
+		w.text(w.label("สแกนเพื่อชำระเงิน", "Scan to pay"), "C", false, 1)
+	}
+
+	if tpl.Footer != "" {
+		w.rule()
+		w.text(tpl.Footer, "C", false, 0.8)
+	}
+	return w.pdf.Error()
+}
+
+func formatSlipTime(unix int64) string {
+	if unix <= 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).In(bangkokTime).Format("02/01/2006 15:04")
+}
+
+// parseHexColor reads #RRGGBB, defaulting to black
+func parseHexColor(s string) [3]int {
+	var rgb [3]int
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return rgb
+	}
+	for i := range rgb {
+		v, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return [3]int{}
+		}
+		rgb[i] = int(v)
+	}
+	return rgb
+}
+
+// asciiOnly drops what the built-in PDF fonts cannot show
+func asciiOnly(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r > 126 {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// slipPDFHandler serves GET /qr/:id/slip.pdf and /qr/:id/receipt.pdf
+func (h *Handler) slipPDFHandler(kind string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := requestDB(c, h.db)
+		qr, err := getCallerQRRequest(db, c, c.Params("id"))
+		if err != nil {
+			return qrRequestError(err)
+		}
+		merchant, err := GetMerchant(db, qr.MerchantID)
+		if err != nil {
+			return merchantError(err)
+		}
+
+		doc := &slipDocument{kind: kind, merchant: merchant, qr: presentQRRequest(c, qr)}
+		if merchant.Settings.Slip != nil {
+			doc.template = *merchant.Settings.Slip
+		}
+		if kind == slipKindPayment && qr.Status != QRStatusPending {
+			return newAppError(fiber.StatusConflict, ErrCodeQRNotPending)
+		}
+		if kind == slipKindReceipt {
+			if qr.Status != QRStatusPaid {
+				return newAppError(fiber.StatusConflict, ErrCodeQRNotPaid)
+			}
+			var payment Payment
+			err := db.Where("qr_request_id = ? AND merchant_id = ?", qr.ID, qr.MerchantID).Order("paid_at DESC").First(&payment).Error
+			if err == nil {
+				doc.payment = &payment
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return internalError(err)
+			}
+		}
+
+		ctx, span := tracer.Start(c.UserContext(), "SlipRenderer.Render")
+		data, err := h.slipRenderer.Render(doc, c.Query("layout"))
+		span.End()
+		if err != nil {
+			return internalError(err)
+		}
+
+		if err := recordView(db.WithContext(ctx), c, qr); err != nil {
+			return internalError(err)
+		}
+
+		c.Set(fiber.HeaderContentType, "application/pdf")
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="%s-%s.pdf"`, kind, qr.ID))
+		return c.Send(data)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// tracer creates every span of the service. It follows the provider
+// installed by setupTracing and records nothing until then.
+var tracer = otel.Tracer("testdb00001")
+
+// setupTracing installs the tracer provider and W3C trace context
+// propagation. The returned func flushes pending spans and must run at
+// shutdown.
+func setupTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exporter sdktrace.SpanExporter
+		file     *os.File
+		err      error
+	)
+	switch cfg.TraceExporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		file, err = os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("trace file: %v", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case "otlp":
+		// The endpoint, headers and TLS come from the standard
+		// OTEL_EXPORTER_OTLP_* variables
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.TraceExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+// fiberHeaderCarrier reads propagation headers from the request
+type fiberHeaderCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h fiberHeaderCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h fiberHeaderCarrier) Set(key, value string) {
+	h.c.Request().Header.Set(key, value)
+}
+
+func (h fiberHeaderCarrier) Keys() []string {
+	var keys []string
+	h.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// tracingMiddleware starts a server span for every request, continuing the
+// caller's trace when it sent a traceparent header
+func tracingMiddleware(c *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberHeaderCarrier{c})
+	ctx, span := tracer.Start(ctx, c.Method(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", c.Method()),
+			attribute.String("http.target", c.Path()),
+			attribute.String("request.id", requestIDFromContext(ctx)),
+		),
+	)
+	defer span.End()
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+
+	// The route template is only known once the router has matched
+	span.SetName(c.Method() + " " + c.Route().Path)
+	status := responseStatus(c, err)
+	span.SetAttributes(
+		attribute.String("http.route", c.Route().Path),
+		attribute.Int("http.status_code", status),
+	)
+	if merchantID := currentMerchantID(c); merchantID != "" {
+		span.SetAttributes(attribute.String("merchant.id", merchantID))
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	return err
+}
+
+// tracingTransport starts a client span for every outbound call and passes
+// the trace on in the traceparent header
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+			attribute.String("net.peer.name", req.URL.Hostname()),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// gormTracingPlugin wraps every gorm statement in a client span. Statements
+// are recorded without their bound values.
+type gormTracingPlugin struct{}
+
+const gormTracingKey = "tracing:span"
+
+type gormSpan struct {
+	span   trace.Span
+	parent context.Context
+}
+
+func (p *gormTracingPlugin) Name() string {
+	return "tracing"
+}
+
+func (p *gormTracingPlugin) Initialize(db *gorm.DB) error {
+	before := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			parent := tx.Statement.Context
+			ctx, span := tracer.Start(parent, "gorm."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.String("db.system", "postgresql")),
+			)
+			tx.Statement.Context = ctx
+			tx.InstanceSet(gormTracingKey, gormSpan{span: span, parent: parent})
+		}
+	}
+	after := func(tx *gorm.DB) {
+		v, ok := tx.InstanceGet(gormTracingKey)
+		if !ok {
+			return
+		}
+		s := v.(gormSpan)
+		tx.Statement.Context = s.parent
+
+		s.span.SetAttributes(
+			attribute.String("db.sql.table", tx.Statement.Table),
+			attribute.String("db.statement", tx.Statement.SQL.String()),
+			attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+		)
+		if err := tx.Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.span.RecordError(err)
+			s.span.SetStatus(codes.Error, err.Error())
+		}
+		s.span.End()
+	}
+
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tracing:before_create", before("create")),
+		cb.Create().After("gorm:create").Register("tracing:after_create", after),
+		cb.Query().Before("gorm:query").Register("tracing:before_query", before("query")),
+		cb.Query().After("gorm:query").Register("tracing:after_query", after),
+		cb.Update().Before("gorm:update").Register("tracing:before_update", before("update")),
+		cb.Update().After("gorm:update").Register("tracing:after_update", after),
+		cb.Delete().Before("gorm:delete").Register("tracing:before_delete", before("delete")),
+		cb.Delete().After("gorm:delete").Register("tracing:after_delete", after),
+		cb.Row().Before("gorm:row").Register("tracing:before_row", before("row")),
+		cb.Row().After("gorm:row").Register("tracing:after_row", after),
+		cb.Raw().Before("gorm:raw").Register("tracing:before_raw", before("raw")),
+		cb.Raw().After("gorm:raw").Register("tracing:after_raw", after),
+	)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+// xlsxWriter streams a single-sheet XLSX workbook. Rows go straight into
+// the zip entry of the sheet, so memory use does not grow with the rows.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+}
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(sheet, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return &xlsxWriter{zw: zw, sheet: sheet}, err
+}
+
+// WriteRow appends a row. float64 values become numbers, everything else
+// inline strings.
+func (x *xlsxWriter) WriteRow(cells ...interface{}) error {
+	if _, err := io.WriteString(x.sheet, "<row>"); err != nil {
+		return err
+	}
+	for _, cell := range cells {
+		var err error
+		switch v := cell.(type) {
+		case float64:
+			_, err = io.WriteString(x.sheet, `<c><v>`+strconv.FormatFloat(v, 'f', -1, 64)+`</v></c>`)
+		default:
+			s, _ := v.(string)
+			if _, err = io.WriteString(x.sheet, `<c t="inlineStr"><is><t xml:space="preserve">`); err == nil {
+				if err = xml.EscapeText(x.sheet, []byte(s)); err == nil {
+					_, err = io.WriteString(x.sheet, `</t></is></c>`)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(x.sheet, "</row>")
+	return err
+}
+
+// Close ends the sheet and the zip; it does not close the underlying writer
+func (x *xlsxWriter) Close() error {
+	if _, err := io.WriteString(x.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}